@@ -2,6 +2,7 @@ package acl
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -45,9 +46,13 @@ type Permission struct {
 	Profile   int        `json:"profile,omitempty"`
 }
 
+// Permissions is the reply to an 'acl:show' request. Total and Next are only set for a paginated
+// request (the permissions are then ordered by door).
 type Permissions struct {
 	CardNumber  uint32       `json:"card-number"`
 	Permissions []Permission `json:"permissions"`
+	Total       *int         `json:"total,omitempty"`
+	Next        *string      `json:"next,omitempty"`
 }
 
 func (a *ACL) info(tag, msg string) {
@@ -70,7 +75,7 @@ func (a *ACL) verify(uname string, acl, signature []byte) error {
 	return nil
 }
 
-func (a *ACL) fetch(tag, uri string) (*api.ACL, error) {
+func (a *ACL) fetch(ctx context.Context, tag, uri string) (*api.ACL, error) {
 	a.info(tag, fmt.Sprintf("Fetching ACL from %v", uri))
 
 	f := a.fetchHTTP
@@ -80,7 +85,7 @@ func (a *ACL) fetch(tag, uri string) (*api.ACL, error) {
 		f = a.fetchFile
 	}
 
-	b, err := f(uri)
+	b, err := f(ctx, uri)
 	if err != nil {
 		return nil, err
 	}
@@ -123,8 +128,13 @@ func (a *ACL) fetch(tag, uri string) (*api.ACL, error) {
 	return &acl, nil
 }
 
-func (a *ACL) fetchHTTP(url string) ([]byte, error) {
-	response, err := http.Get(url)
+func (a *ACL) fetchHTTP(ctx context.Context, url string) ([]byte, error) {
+	rq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := http.DefaultClient.Do(rq)
 	if err != nil {
 		return nil, err
 	}
@@ -139,7 +149,7 @@ func (a *ACL) fetchHTTP(url string) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
-func (a *ACL) fetchS3(uri string) ([]byte, error) {
+func (a *ACL) fetchS3(ctx context.Context, uri string) ([]byte, error) {
 	match := regexp.MustCompile("^s3://(.*?)/(.*)").FindStringSubmatch(uri)
 	if len(match) != 3 {
 		return nil, fmt.Errorf("Invalid S3 URI (%s)", uri)
@@ -160,14 +170,14 @@ func (a *ACL) fetchS3(uri string) ([]byte, error) {
 
 	buffer := make([]byte, 1024)
 	b := aws.NewWriteAtBuffer(buffer)
-	if _, err := s3manager.NewDownloader(ss).Download(b, &object); err != nil {
+	if _, err := s3manager.NewDownloader(ss).DownloadWithContext(ctx, b, &object); err != nil {
 		return nil, err
 	}
 
 	return b.Bytes(), nil
 }
 
-func (a *ACL) fetchFile(url string) ([]byte, error) {
+func (a *ACL) fetchFile(ctx context.Context, url string) ([]byte, error) {
 	match := regexp.MustCompile("^file://(.*)").FindStringSubmatch(url)
 	if len(match) != 2 {
 		return nil, fmt.Errorf("Invalid file URI (%s)", url)
@@ -176,7 +186,7 @@ func (a *ACL) fetchFile(url string) ([]byte, error) {
 	return ioutil.ReadFile(match[1])
 }
 
-func (a *ACL) store(tag, uri, filename string, content []byte) error {
+func (a *ACL) store(ctx context.Context, tag, uri, filename string, content []byte) error {
 	files := map[string][]byte{
 		filename: content,
 	}
@@ -207,7 +217,7 @@ func (a *ACL) store(tag, uri, filename string, content []byte) error {
 	} else {
 	}
 
-	if err := f(uri, bytes.NewReader(b.Bytes())); err != nil {
+	if err := f(ctx, uri, bytes.NewReader(b.Bytes())); err != nil {
 		return err
 	}
 
@@ -216,8 +226,8 @@ func (a *ACL) store(tag, uri, filename string, content []byte) error {
 	return nil
 }
 
-func (a *ACL) storeHTTP(url string, r io.Reader) error {
-	rq, err := http.NewRequest("PUT", url, r)
+func (a *ACL) storeHTTP(ctx context.Context, url string, r io.Reader) error {
+	rq, err := http.NewRequestWithContext(ctx, "PUT", url, r)
 	if err != nil {
 		return err
 	}
@@ -234,7 +244,7 @@ func (a *ACL) storeHTTP(url string, r io.Reader) error {
 	return nil
 }
 
-func (a *ACL) storeS3(uri string, r io.Reader) error {
+func (a *ACL) storeS3(ctx context.Context, uri string, r io.Reader) error {
 	match := regexp.MustCompile("^s3://(.*?)/(.*)").FindStringSubmatch(uri)
 	if len(match) != 3 {
 		return fmt.Errorf("Invalid S3 URI (%s)", uri)
@@ -254,14 +264,14 @@ func (a *ACL) storeS3(uri string, r io.Reader) error {
 		WithRegion(a.Region)
 
 	ss := session.Must(session.NewSession(cfg))
-	if _, err := s3manager.NewUploader(ss).Upload(&object); err != nil {
+	if _, err := s3manager.NewUploader(ss).UploadWithContext(ctx, &object); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (a *ACL) storeFile(url string, r io.Reader) error {
+func (a *ACL) storeFile(ctx context.Context, url string, r io.Reader) error {
 	match := regexp.MustCompile("^file://(.*)").FindStringSubmatch(url)
 	if len(match) != 2 {
 		return fmt.Errorf("Invalid file URI (%s)", url)
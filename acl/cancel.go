@@ -0,0 +1,71 @@
+package acl
+
+import (
+	"context"
+
+	"github.com/uhppoted/uhppote-core/types"
+	"github.com/uhppoted/uhppote-core/uhppote"
+)
+
+// cancellable wraps the UHPPOTE interface used for ACL operations so that the card and time
+// profile functions fail once the request context has been cancelled or has expired, which
+// stops long running operations (e.g. updating the ACL for a large number of cards) cleanly.
+type cancellable struct {
+	uhppote.IUHPPOTE
+	ctx context.Context
+}
+
+func (a *ACL) uhppote(ctx context.Context) uhppote.IUHPPOTE {
+	return cancellable{
+		IUHPPOTE: a.UHPPOTE,
+		ctx:      ctx,
+	}
+}
+
+func (u cancellable) GetCards(deviceID uint32) (uint32, error) {
+	if err := u.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return u.IUHPPOTE.GetCards(deviceID)
+}
+
+func (u cancellable) GetCardByIndex(deviceID, index uint32) (*types.Card, error) {
+	if err := u.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return u.IUHPPOTE.GetCardByIndex(deviceID, index)
+}
+
+func (u cancellable) GetCardByID(deviceID, cardNumber uint32) (*types.Card, error) {
+	if err := u.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return u.IUHPPOTE.GetCardByID(deviceID, cardNumber)
+}
+
+func (u cancellable) PutCard(deviceID uint32, card types.Card) (bool, error) {
+	if err := u.ctx.Err(); err != nil {
+		return false, err
+	}
+
+	return u.IUHPPOTE.PutCard(deviceID, card)
+}
+
+func (u cancellable) DeleteCard(deviceID uint32, cardNumber uint32) (bool, error) {
+	if err := u.ctx.Err(); err != nil {
+		return false, err
+	}
+
+	return u.IUHPPOTE.DeleteCard(deviceID, cardNumber)
+}
+
+func (u cancellable) GetTimeProfile(deviceID uint32, profileID uint8) (*types.TimeProfile, error) {
+	if err := u.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return u.IUHPPOTE.GetTimeProfile(deviceID, profileID)
+}
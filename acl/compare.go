@@ -1,6 +1,7 @@
 package acl
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -35,7 +36,7 @@ type Report struct {
 	Diffs    map[uint32]api.Diff
 }
 
-func (a *ACL) Compare(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (a *ACL) Compare(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		URL struct {
 			ACL    *string `json:"acl"`
@@ -65,7 +66,7 @@ func (a *ACL) Compare(impl uhppoted.IUHPPOTED, request []byte) (interface{}, err
 		return common.MakeError(StatusBadRequest, "Missing/invalid report URL", err), fmt.Errorf("Invalid report URL '%v' (%w)", body.URL.Report, err)
 	}
 
-	acl, err := a.fetch("acl:compare", uri.String())
+	acl, err := a.fetch(ctx, "acl:compare", uri.String())
 	if err != nil {
 		return common.MakeError(StatusBadRequest, "Error downloading ACL", err), err
 	}
@@ -78,7 +79,7 @@ func (a *ACL) Compare(impl uhppoted.IUHPPOTED, request []byte) (interface{}, err
 		a.info("acl:compare", fmt.Sprintf("%v  Retrieved %v records", k, len(l)))
 	}
 
-	current, errors := api.GetACL(a.UHPPOTE, a.Devices)
+	current, errors := api.GetACL(a.uhppote(ctx), a.Devices)
 	if len(errors) > 0 {
 		err := fmt.Errorf("%v", errors)
 		return common.MakeError(StatusInternalServerError, "Error retrieving current ACL", err), err
@@ -95,7 +96,7 @@ func (a *ACL) Compare(impl uhppoted.IUHPPOTED, request []byte) (interface{}, err
 	}
 
 	filename := time.Now().Format("acl-2006-01-02T150405.rpt")
-	if err = a.store("acl:compare", rpt.String(), filename, []byte(w.String())); err != nil {
+	if err = a.store(ctx, "acl:compare", rpt.String(), filename, []byte(w.String())); err != nil {
 		return common.MakeError(StatusBadRequest, "Error uploading report", err), err
 	}
 
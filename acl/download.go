@@ -1,6 +1,7 @@
 package acl
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/url"
@@ -10,7 +11,7 @@ import (
 	"github.com/uhppoted/uhppoted-mqtt/common"
 )
 
-func (a *ACL) Download(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (a *ACL) Download(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		URL *string `json:"url"`
 	}{}
@@ -28,7 +29,7 @@ func (a *ACL) Download(impl uhppoted.IUHPPOTED, request []byte) (interface{}, er
 		return common.MakeError(StatusBadRequest, "Missing/invalid download URL", err), fmt.Errorf("Invalid download URL '%v' (%w)", body.URL, err)
 	}
 
-	acl, err := a.fetch("acl:download", uri.String())
+	acl, err := a.fetch(ctx, "acl:download", uri.String())
 	if err != nil {
 		return common.MakeError(StatusBadRequest, "Error downloading ACL", err), err
 	}
@@ -41,7 +42,7 @@ func (a *ACL) Download(impl uhppoted.IUHPPOTED, request []byte) (interface{}, er
 		a.info("acl:download", fmt.Sprintf("%v  Retrieved %v records", k, len(l)))
 	}
 
-	rpt, errors := api.PutACL(a.UHPPOTE, *acl, false)
+	rpt, errors := api.PutACL(a.uhppote(ctx), *acl, false)
 	if len(errors) > 0 {
 		err := fmt.Errorf("%v", errors)
 		return common.MakeError(StatusInternalServerError, "Error updating ACL", err), err
@@ -1,6 +1,7 @@
 package acl
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -9,7 +10,7 @@ import (
 	"github.com/uhppoted/uhppoted-mqtt/common"
 )
 
-func (a *ACL) Revoke(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (a *ACL) Revoke(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		CardNumber *uint32  `json:"card-number"`
 		Doors      []string `json:"doors"`
@@ -23,7 +24,7 @@ func (a *ACL) Revoke(impl uhppoted.IUHPPOTED, request []byte) (interface{}, erro
 		return common.MakeError(StatusBadRequest, "Missing/invalid card number", nil), fmt.Errorf("Missing/invalid card number")
 	}
 
-	err := api.Revoke(a.UHPPOTE, a.Devices, *body.CardNumber, body.Doors)
+	err := api.Revoke(a.uhppote(ctx), a.Devices, *body.CardNumber, body.Doors)
 	if err != nil {
 		return common.MakeError(StatusInternalServerError, err.Error(), nil), err
 	}
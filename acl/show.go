@@ -1,6 +1,7 @@
 package acl
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -9,9 +10,10 @@ import (
 	"github.com/uhppoted/uhppoted-mqtt/common"
 )
 
-func (a *ACL) Show(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (a *ACL) Show(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		CardNumber *uint32 `json:"card-number"`
+		common.Page[string]
 	}{}
 
 	if err := json.Unmarshal(request, &body); err != nil {
@@ -22,7 +24,11 @@ func (a *ACL) Show(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error)
 		return common.MakeError(StatusBadRequest, "Missing/invalid card number", nil), fmt.Errorf("Missing/invalid card number")
 	}
 
-	acl, err := api.GetCard(a.UHPPOTE, a.Devices, *body.CardNumber)
+	if err := body.Page.Validate(); err != nil {
+		return common.MakeError(StatusBadRequest, err.Error(), nil), err
+	}
+
+	acl, err := api.GetCard(a.uhppote(ctx), a.Devices, *body.CardNumber)
 	if err != nil {
 		return common.MakeError(StatusInternalServerError, "Error retrieving card access permissions", err), err
 	}
@@ -45,5 +51,11 @@ func (a *ACL) Show(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error)
 		})
 	}
 
+	if body.Page.Paged() {
+		total := len(response.Permissions)
+		response.Permissions, response.Next = common.Paginate(response.Permissions, func(p Permission) string { return p.Door }, body.Page)
+		response.Total = &total
+	}
+
 	return response, nil
 }
@@ -1,6 +1,7 @@
 package acl
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/url"
@@ -11,7 +12,7 @@ import (
 	"github.com/uhppoted/uhppoted-mqtt/common"
 )
 
-func (a *ACL) Upload(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (a *ACL) Upload(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		URL *string `json:"url"`
 	}{}
@@ -29,7 +30,7 @@ func (a *ACL) Upload(impl uhppoted.IUHPPOTED, request []byte) (interface{}, erro
 		return common.MakeError(StatusBadRequest, "Missing/invalid upload URI", err), fmt.Errorf("Invalid upload URL '%v' (%w)", body.URL, err)
 	}
 
-	acl, errors := api.GetACL(a.UHPPOTE, a.Devices)
+	acl, errors := api.GetACL(a.uhppote(ctx), a.Devices)
 	if len(errors) > 0 {
 		err := fmt.Errorf("%v", errors)
 		return common.MakeError(StatusInternalServerError, "Error retrieving ACL", err), err
@@ -48,7 +49,7 @@ func (a *ACL) Upload(impl uhppoted.IUHPPOTED, request []byte) (interface{}, erro
 		return common.MakeError(StatusInternalServerError, "Error reformatting card access permissions", err), err
 	}
 
-	if err = a.store("acl:upload", uri.String(), "uhppoted.acl", []byte(w.String())); err != nil {
+	if err = a.store(ctx, "acl:upload", uri.String(), "uhppoted.acl", []byte(w.String())); err != nil {
 		return common.MakeError(StatusBadRequest, "Error uploading ACL", err), err
 	}
 
@@ -6,6 +6,7 @@ import (
 	"github.com/uhppoted/uhppoted-lib/kvs"
 	"log"
 	"strconv"
+	"sync"
 )
 
 type Nonce struct {
@@ -18,7 +19,8 @@ type Nonce struct {
 		*kvs.KeyValueStore
 		filepath string
 	}
-	log *log.Logger
+	log   *log.Logger
+	guard *sync.Mutex
 }
 
 func NewNonce(verify bool, server, clients string, logger *log.Logger) (*Nonce, error) {
@@ -44,7 +46,8 @@ func NewNonce(verify bool, server, clients string, logger *log.Logger) (*Nonce,
 			kvs.NewKeyValueStore("nonce:clients", f),
 			clients,
 		},
-		log: logger,
+		log:   logger,
+		guard: &sync.Mutex{},
 	}
 
 	if err = nonce.mqttd.LoadFromFile(server); err != nil {
@@ -68,6 +71,11 @@ func (n *Nonce) Validate(clientID *string, nonce *uint64) error {
 			return errors.New("missing nonce missing")
 		}
 
+		// NOTE: requests are validated concurrently so the check and update must be atomic
+		//       (otherwise a replayed nonce could be accepted twice)
+		n.guard.Lock()
+		defer n.guard.Unlock()
+
 		c, ok := n.counters.Get(*clientID)
 		if !ok {
 			c = uint64(0)
@@ -84,6 +92,9 @@ func (n *Nonce) Validate(clientID *string, nonce *uint64) error {
 }
 
 func (n *Nonce) Next() uint64 {
+	n.guard.Lock()
+	defer n.guard.Unlock()
+
 	c, ok := n.mqttd.Get("mqttd")
 	if !ok {
 		c = uint64(0)
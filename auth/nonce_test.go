@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"io"
+	"log"
+	"sync"
+	"testing"
+)
+
+func TestNonceNextIsUnique(t *testing.T) {
+	n, _ := NewNonce(true, "", "", log.New(io.Discard, "", 0))
+
+	var wg sync.WaitGroup
+	var guard sync.Mutex
+
+	nonces := map[uint64]bool{}
+
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			nonce := n.Next()
+
+			guard.Lock()
+			defer guard.Unlock()
+
+			if nonces[nonce] {
+				t.Errorf("Duplicate nonce %v", nonce)
+			}
+
+			nonces[nonce] = true
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestNonceValidateRejectsReusedNonce(t *testing.T) {
+	n, _ := NewNonce(true, "", "", log.New(io.Discard, "", 0))
+
+	clientID := "QWERTY"
+	nonce := uint64(17)
+
+	var wg sync.WaitGroup
+	var accepted sync.Map
+
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := n.Validate(&clientID, &nonce); err == nil {
+				accepted.Store(i, true)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	count := 0
+	accepted.Range(func(k, v any) bool { count++; return true })
+
+	if count != 1 {
+		t.Errorf("Incorrect number of requests accepted with nonce %v - expected:%v, got:%v", nonce, 1, count)
+	}
+}
@@ -14,15 +14,56 @@ type Permissions struct {
 	groups  *kvs.KeyValueStore
 }
 
+// permission is a group permission, configured as resource:action with an optional
+// @device-id or @device-id/door scope (e.g. door:*@405419896/3) that restricts the permission
+// to requests sent to the device-addressed request topics for the controller (and door).
 type permission struct {
 	resource *regexp.Regexp
 	action   *regexp.Regexp
+	device   *regexp.Regexp
+	door     *regexp.Regexp
+}
+
+// Scope is the controller and (optional) door addressed by a device-addressed request topic.
+type Scope struct {
+	DeviceID uint32
+	Door     uint8
 }
 
 func (p permission) String() string {
+	if p.device != nil && p.door != nil {
+		return fmt.Sprintf("resource:`%s` action:`%s` device:`%s` door:`%s`", p.resource, p.action, p.device, p.door)
+	} else if p.device != nil {
+		return fmt.Sprintf("resource:`%s` action:`%s` device:`%s`", p.resource, p.action, p.device)
+	}
+
 	return fmt.Sprintf("resource:`%s` action:`%s`", p.resource, p.action)
 }
 
+func (p permission) matches(resource, action string, scope *Scope) bool {
+	if !p.resource.MatchString(resource) || !p.action.MatchString(action) {
+		return false
+	}
+
+	if p.device != nil {
+		if scope == nil || !p.device.MatchString(fmt.Sprintf("%v", scope.DeviceID)) {
+			return false
+		}
+	}
+
+	if p.door != nil {
+		if scope == nil || scope.Door == 0 || !p.door.MatchString(fmt.Sprintf("%v", scope.Door)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func glob(s string) (*regexp.Regexp, error) {
+	return regexp.Compile("^" + strings.ReplaceAll(regexp.QuoteMeta(s), `\*`, ".*") + "$")
+}
+
 func NewPermissions(enabled bool, users, groups string, logger *log.Logger) (*Permissions, error) {
 	separator := regexp.MustCompile(`\s*,\s*`)
 
@@ -32,10 +73,10 @@ func NewPermissions(enabled bool, users, groups string, logger *log.Logger) (*Pe
 
 	g := func(value string) (interface{}, error) {
 		permissions := []permission{}
-		re := regexp.MustCompile(`(.*?):(.*)`)
+		re := regexp.MustCompile(`(.*?):([^@]*)(?:@([^/]+)(?:/(.+))?)?`)
 		tokens := separator.Split(value, -1)
 		for _, s := range tokens {
-			if match := re.FindStringSubmatch(s); len(match) == 3 {
+			if match := re.FindStringSubmatch(s); len(match) == 5 {
 				resource, err := regexp.Compile("^" + strings.ReplaceAll(match[1], "*", ".*") + "$")
 				if err != nil {
 					return permissions, err
@@ -46,10 +87,24 @@ func NewPermissions(enabled bool, users, groups string, logger *log.Logger) (*Pe
 					return permissions, err
 				}
 
-				permissions = append(permissions, permission{
+				p := permission{
 					resource: resource,
 					action:   action,
-				})
+				}
+
+				if match[3] != "" {
+					if p.device, err = glob(match[3]); err != nil {
+						return permissions, err
+					}
+				}
+
+				if match[4] != "" {
+					if p.door, err = glob(match[4]); err != nil {
+						return permissions, err
+					}
+				}
+
+				permissions = append(permissions, p)
 			}
 		}
 
@@ -81,6 +136,12 @@ func NewPermissions(enabled bool, users, groups string, logger *log.Logger) (*Pe
 }
 
 func (p *Permissions) Validate(clientID, resource, action string) error {
+	return p.ValidateScope(clientID, resource, action, nil)
+}
+
+// ValidateScope validates a request for a device-addressed topic, for which the scoped (@device-id)
+// permissions also apply. A nil scope is the same as Validate.
+func (p *Permissions) ValidateScope(clientID, resource, action string, scope *Scope) error {
 	groups, ok := p.users.Get(clientID)
 	if !ok {
 		return fmt.Errorf("%s: Not a member of any groups", clientID)
@@ -89,7 +150,7 @@ func (p *Permissions) Validate(clientID, resource, action string) error {
 	for _, g := range groups.([]string) {
 		if permissions, ok := p.groups.Get(g); ok {
 			for _, q := range permissions.([]permission) {
-				if q.resource.MatchString(resource) && q.action.MatchString(action) {
+				if q.matches(resource, action, scope) {
 					return nil
 				}
 			}
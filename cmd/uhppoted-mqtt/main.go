@@ -14,6 +14,7 @@ var cli = []uhppoted.Command{
 	&commands.RUN,
 	&commands.DAEMONIZE,
 	&commands.UNDAEMONIZE,
+	&commands.ASYNCAPI,
 	&uhppoted.Version{
 		Application: commands.SERVICE,
 		Version:     uhppote.VERSION,
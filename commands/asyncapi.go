@@ -0,0 +1,98 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/uhppoted/uhppote-core/uhppote"
+	"github.com/uhppoted/uhppoted-lib/config"
+	"github.com/uhppoted/uhppoted-mqtt/mqtt"
+)
+
+var ASYNCAPI = AsyncAPI{
+	configuration: config.DefaultConfig,
+	out:           "",
+}
+
+type AsyncAPI struct {
+	configuration string
+	out           string
+}
+
+func (cmd *AsyncAPI) Name() string {
+	return "asyncapi"
+}
+
+func (cmd *AsyncAPI) FlagSet() *flag.FlagSet {
+	flagset := flag.NewFlagSet("asyncapi", flag.ExitOnError)
+
+	flagset.StringVar(&cmd.configuration, "config", cmd.configuration, "Sets the configuration file path")
+	flagset.StringVar(&cmd.out, "out", cmd.out, "Sets the output file path (defaults to stdout)")
+
+	return flagset
+}
+
+func (cmd *AsyncAPI) Description() string {
+	return fmt.Sprintf("Writes an AsyncAPI specification for the %s MQTT API", SERVICE)
+}
+
+func (cmd *AsyncAPI) Usage() string {
+	return fmt.Sprintf("%s asyncapi [--config <file>] [--out <file>]", SERVICE)
+}
+
+func (cmd *AsyncAPI) Help() {
+	fmt.Println()
+	fmt.Printf("  Usage: %s asyncapi [--config <file>] [--out <file>]\n", SERVICE)
+	fmt.Println()
+	fmt.Printf("    Writes an AsyncAPI 2.6 specification for the %s MQTT API, using the topics from the\n", SERVICE)
+	fmt.Printf("    configuration file\n")
+	fmt.Println()
+
+	helpOptions(cmd.FlagSet())
+}
+
+func (cmd *AsyncAPI) Execute(args ...interface{}) error {
+	c := config.NewConfig()
+	if err := c.Load(cmd.configuration); err != nil {
+		fmt.Fprintf(os.Stderr, "WARN  Could not load configuration (%v)\n", err)
+	}
+
+	x := newExtensions()
+	if err := x.load(cmd.configuration); err != nil {
+		fmt.Fprintf(os.Stderr, "WARN  Could not load configuration extensions (%v)\n", err)
+	}
+
+	mqttd := mqtt.MQTTD{
+		ServerID: c.ServerID,
+		Connection: mqtt.Connection{
+			Brokers: []mqtt.Broker{
+				mqtt.Broker{URL: c.Connection.Broker},
+			},
+			Version: x.Connection.Version,
+		},
+		Topics: topics(c, x),
+	}
+
+	for _, b := range x.Connection.Failover {
+		mqttd.Connection.Brokers = append(mqttd.Connection.Brokers, mqtt.Broker{URL: b.Broker})
+	}
+
+	spec, err := mqttd.AsyncAPI(uhppote.VERSION)
+	if err != nil {
+		return err
+	}
+
+	if cmd.out == "" {
+		fmt.Println(string(spec))
+		return nil
+	}
+
+	if err := os.WriteFile(cmd.out, append(spec, '\n'), 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("   ... AsyncAPI specification written to %v\n", cmd.out)
+
+	return nil
+}
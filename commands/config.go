@@ -0,0 +1,300 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uhppoted/uhppoted-lib/encoding/conf"
+)
+
+// extensions holds the uhppoted-mqtt settings that are not (yet) part of the communal
+// uhppoted.conf configuration implemented by uhppoted-lib. The settings are read from
+// the same configuration file.
+type extensions struct {
+	Connection struct {
+		Version  string        `conf:"version"`
+		Failover failover      `conf:"failover"`
+		Failback time.Duration `conf:"failback.interval"`
+
+		Reconnect struct {
+			Delay      time.Duration `conf:"delay"`
+			MaxDelay   time.Duration `conf:"max-delay"`
+			Multiplier float         `conf:"multiplier"`
+			Jitter     float         `conf:"jitter"`
+		} `conf:"reconnect"`
+	} `conf:"mqtt.connection"`
+
+	Topics struct {
+		Status   string `conf:"status"`
+		RPC      string `conf:"rpc"`
+		Doors    string `conf:"doors"`
+		Requests struct {
+			QoS byte `conf:"qos"`
+		} `conf:"requests"`
+		Replies qos `conf:"replies"`
+		Events  qos `conf:"events"`
+		System  qos `conf:"system"`
+	} `conf:"mqtt.topic"`
+
+	Shared struct {
+		Group    string        `conf:"group"`
+		Instance string        `conf:"instance"`
+		Lease    time.Duration `conf:"lease"`
+	} `conf:"mqtt.shared"`
+
+	Dispatch struct {
+		Workers int           `conf:"workers"`
+		Queue   int           `conf:"queue"`
+		Limits  limits        `conf:"limit"`
+		Timeout time.Duration `conf:"timeout"`
+	} `conf:"mqtt.dispatch"`
+
+	Publish struct {
+		Timeout time.Duration `conf:"timeout"`
+		Retries int           `conf:"retries"`
+	} `conf:"mqtt.publish"`
+
+	Queue struct {
+		Dir    string        `conf:"dir"`
+		Size   int           `conf:"size"`
+		MaxAge time.Duration `conf:"max-age"`
+	} `conf:"mqtt.queue"`
+
+	Cache struct {
+		Size int           `conf:"size"`
+		TTL  time.Duration `conf:"ttl"`
+		File string        `conf:"file"`
+	} `conf:"mqtt.cache"`
+
+	Security struct {
+		Canonical bool `conf:"canonical"`
+	} `conf:"mqtt.security"`
+
+	Encoding struct {
+		Clients encodings `conf:"client"`
+	} `conf:"mqtt.encoding"`
+
+	HomeAssistant struct {
+		Enabled   bool          `conf:"enabled"`
+		Discovery string        `conf:"discovery"`
+		Topic     string        `conf:"topic"`
+		Locks     bool          `conf:"locks"`
+		Card      uint32        `conf:"card"`
+		Code      string        `conf:"code"`
+		ClientID  string        `conf:"client-id"`
+		Interval  time.Duration `conf:"interval"`
+	} `conf:"mqtt.homeassistant"`
+
+	Embedded struct {
+		Enabled     bool   `conf:"enabled"`
+		TCP         string `conf:"tcp"`
+		TLS         string `conf:"tls"`
+		Certificate string `conf:"tls.certificate"`
+		Key         string `conf:"tls.key"`
+		CA          string `conf:"tls.ca"`
+		Websocket   string `conf:"websocket"`
+		Users       string `conf:"users"`
+		Anonymous   bool   `conf:"anonymous"`
+		Bridge      bool   `conf:"bridge"`
+		Publish     string `conf:"acl.publish"`
+	} `conf:"mqtt.embedded"`
+
+	Simulator struct {
+		Interval time.Duration `conf:"interval"`
+	} `conf:"mqtt.simulator"`
+}
+
+// failover is the ordered list of standby MQTT brokers, configured as e.g.:
+//
+//	mqtt.connection.failover.1.broker = tls://192.168.1.101:8883
+//	mqtt.connection.failover.1.username = ...
+//	mqtt.connection.failover.1.password = ...
+//	mqtt.connection.failover.1.broker.certificate = ...
+//	mqtt.connection.failover.1.client.certificate = ...
+//	mqtt.connection.failover.1.client.key = ...
+type failover []broker
+
+type qos struct {
+	QoS      byte `conf:"qos"`
+	Retained bool `conf:"retained"`
+}
+
+// limits is the map of per-method request concurrency limits, configured as e.g.:
+//
+//	mqtt.dispatch.limit.get-cards = 1
+//	mqtt.dispatch.limit.acl:download = 1
+type limits map[string]int
+
+// encodings is the map of per-client reply encodings, configured as e.g.:
+//
+//	mqtt.encoding.client.QWERTY = cbor
+//	mqtt.encoding.client.UIOP = msgpack
+type encodings map[string]string
+
+// float is a float64 configuration value (not supported natively by conf.Unmarshal).
+type float float64
+
+type broker struct {
+	Broker            string
+	Username          string
+	Password          string
+	BrokerCertificate string
+	ClientCertificate string
+	ClientKey         string
+}
+
+func newExtensions() *extensions {
+	x := extensions{}
+
+	x.Connection.Version = "3.1.1"
+	x.Connection.Failover = failover{}
+	x.Connection.Failback = 60 * time.Second
+	x.Connection.Reconnect.Delay = 10 * time.Second
+	x.Connection.Reconnect.MaxDelay = 5 * time.Minute
+	x.Connection.Reconnect.Multiplier = 2.0
+	x.Connection.Reconnect.Jitter = 0.25
+	x.Shared.Lease = 30 * time.Second
+	x.Dispatch.Workers = 8
+	x.Dispatch.Queue = 64
+	x.Dispatch.Limits = limits{}
+	x.Dispatch.Timeout = 60 * time.Second
+	x.Publish.Timeout = 10 * time.Second
+	x.Publish.Retries = 2
+	x.Queue.Size = 1024
+	x.Queue.MaxAge = 24 * time.Hour
+	x.Cache.Size = 256
+	x.Cache.TTL = 5 * time.Minute
+	x.Encoding.Clients = encodings{}
+	x.HomeAssistant.Discovery = "homeassistant"
+	x.HomeAssistant.Topic = "homeassistant"
+	x.HomeAssistant.ClientID = "homeassistant"
+	x.HomeAssistant.Interval = 60 * time.Second
+	x.Simulator.Interval = 30 * time.Second
+
+	return &x
+}
+
+func (x *extensions) load(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return conf.Unmarshal(bytes, x)
+}
+
+func (f *failover) UnmarshalConf(tag string, values map[string]string) (interface{}, error) {
+	re := regexp.MustCompile(`^` + regexp.QuoteMeta(tag) + `\.([0-9]+)\.(.*)$`)
+	brokers := map[int]*broker{}
+
+	for key, value := range values {
+		match := re.FindStringSubmatch(key)
+		if len(match) != 3 {
+			continue
+		}
+
+		index, err := strconv.Atoi(match[1])
+		if err != nil {
+			return f, fmt.Errorf("Invalid failover broker key %s: %v", key, err)
+		}
+
+		b, ok := brokers[index]
+		if !ok {
+			b = &broker{}
+			brokers[index] = b
+		}
+
+		switch match[2] {
+		case "broker":
+			b.Broker = value
+
+		case "username":
+			b.Username = value
+
+		case "password":
+			b.Password = value
+
+		case "broker.certificate":
+			b.BrokerCertificate = value
+
+		case "client.certificate":
+			b.ClientCertificate = value
+
+		case "client.key":
+			b.ClientKey = value
+		}
+	}
+
+	indices := []int{}
+	for k := range brokers {
+		indices = append(indices, k)
+	}
+
+	sort.Ints(indices)
+
+	list := failover{}
+	for _, k := range indices {
+		if brokers[k].Broker != "" {
+			list = append(list, *brokers[k])
+		}
+	}
+
+	return &list, nil
+}
+
+func (f *float) UnmarshalConf(tag string, values map[string]string) (interface{}, error) {
+	value, ok := values[tag]
+	if !ok {
+		return f, nil
+	}
+
+	v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return f, fmt.Errorf("Invalid %v value '%v' (%v)", tag, value, err)
+	}
+
+	g := float(v)
+
+	return &g, nil
+}
+
+func (l *limits) UnmarshalConf(tag string, values map[string]string) (interface{}, error) {
+	prefix := tag + "."
+	m := limits{}
+
+	for key, value := range values {
+		if strings.HasPrefix(key, prefix) {
+			method := strings.TrimPrefix(key, prefix)
+			limit, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || limit < 0 {
+				return l, fmt.Errorf("Invalid %v value '%v'", key, value)
+			}
+
+			m[method] = limit
+		}
+	}
+
+	return &m, nil
+}
+
+func (e *encodings) UnmarshalConf(tag string, values map[string]string) (interface{}, error) {
+	prefix := tag + "."
+	m := encodings{}
+
+	for key, value := range values {
+		if strings.HasPrefix(key, prefix) {
+			m[strings.TrimPrefix(key, prefix)] = strings.TrimSpace(value)
+		}
+	}
+
+	return &m, nil
+}
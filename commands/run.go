@@ -20,6 +20,7 @@ import (
 	"github.com/uhppoted/uhppoted-lib/monitoring"
 	"github.com/uhppoted/uhppoted-mqtt/auth"
 	"github.com/uhppoted/uhppoted-mqtt/mqtt"
+	"github.com/uhppoted/uhppoted-mqtt/simulator"
 )
 
 type Run struct {
@@ -30,6 +31,7 @@ type Run struct {
 	logFileSize         int
 	console             bool
 	debug               bool
+	simulate            bool
 	healthCheckInterval time.Duration
 	watchdogInterval    time.Duration
 }
@@ -43,12 +45,12 @@ func (cmd *Run) Description() string {
 }
 
 func (cmd *Run) Usage() string {
-	return fmt.Sprintf("%s [run] [--console] [--config <file>] [--dir <workdir>] [--pid <file>] [--logfile <file>] [--logfilesize <bytes>] [--debug]", SERVICE)
+	return fmt.Sprintf("%s [run] [--console] [--config <file>] [--dir <workdir>] [--pid <file>] [--logfile <file>] [--logfilesize <bytes>] [--debug] [--simulate]", SERVICE)
 }
 
 func (cmd *Run) Help() {
 	fmt.Println()
-	fmt.Printf("  Usage: %s  [--console] [--config <file>] [--dir <workdir>] [--pid <file>] [--logfile <file>] [--logfilesize <bytes>] [--debug]\n", SERVICE)
+	fmt.Printf("  Usage: %s  [--console] [--config <file>] [--dir <workdir>] [--pid <file>] [--logfile <file>] [--logfilesize <bytes>] [--debug] [--simulate]\n", SERVICE)
 	fmt.Println()
 
 	helpOptions(cmd.FlagSet())
@@ -90,6 +92,14 @@ func (cmd *Run) run(c *config.Config, logger *log.Logger, interrupt chan os.Sign
 	cmd.healthCheckInterval = c.HealthCheckInterval
 	cmd.watchdogInterval = c.WatchdogInterval
 
+	x := newExtensions()
+	x.Topics.Events.QoS = c.Alerts.QOS
+	x.Topics.Events.Retained = c.Alerts.Retained
+
+	if err := x.load(cmd.configuration); err != nil {
+		logger.Printf("WARN  Could not load configuration extensions (%v)", err)
+	}
+
 	// ... initialise MQTT
 
 	bind, broadcast, listen := config.DefaultIpAddresses()
@@ -113,7 +123,13 @@ func (cmd *Run) run(c *config.Config, logger *log.Logger, interrupt chan os.Sign
 		}
 	}
 
-	u := uhppote.NewUHPPOTE(bind, broadcast, listen, c.Timeout, devices, cmd.debug)
+	var u uhppote.IUHPPOTE
+	if cmd.simulate {
+		logger.Printf("%-5s %-12s %v", "INFO", "simulator", fmt.Sprintf("Simulating %v controllers", len(devices)))
+		u = simulator.NewSimulator(devices, listen, x.Simulator.Interval)
+	} else {
+		u = uhppote.NewUHPPOTE(bind, broadcast, listen, c.Timeout, devices, cmd.debug)
+	}
 
 	permissions, err := auth.NewPermissions(
 		c.MQTT.Permissions.Enabled,
@@ -127,23 +143,30 @@ func (cmd *Run) run(c *config.Config, logger *log.Logger, interrupt chan os.Sign
 
 	mqttd := mqtt.MQTTD{
 		ServerID: c.ServerID,
-		TLS:      &tls.Config{},
 		Connection: mqtt.Connection{
-			Broker:   fmt.Sprintf(c.Connection.Broker),
+			Brokers: []mqtt.Broker{
+				mqtt.Broker{
+					URL:      c.Connection.Broker,
+					UserName: c.Connection.Username,
+					Password: c.Connection.Password,
+				},
+			},
 			ClientID: c.Connection.ClientID,
-			UserName: c.Connection.Username,
-			Password: c.Connection.Password,
-		},
-		Topics: mqtt.Topics{
-			Requests: c.Topics.Resolve(c.Topics.Requests),
-			Replies:  c.Topics.Resolve(c.Topics.Replies),
-			Events:   c.Topics.Resolve(c.Topics.Events),
-			System:   c.Topics.Resolve(c.Topics.System),
+			Version:  x.Connection.Version,
+			Failback: x.Connection.Failback,
+			Reconnect: mqtt.Reconnect{
+				Delay:      x.Connection.Reconnect.Delay,
+				MaxDelay:   x.Connection.Reconnect.MaxDelay,
+				Multiplier: float64(x.Connection.Reconnect.Multiplier),
+				Jitter:     float64(x.Connection.Reconnect.Jitter),
+			},
 		},
+		Topics: topics(c, x),
 		Alerts: mqtt.Alerts{
 			QOS:      c.Alerts.QOS,
 			Retained: c.Alerts.Retained,
 		},
+		Canonical: x.Security.Canonical,
 		Encryption: mqtt.Encryption{
 			SignOutgoing:    c.SignOutgoing,
 			EncryptOutgoing: c.EncryptOutgoing,
@@ -156,10 +179,79 @@ func (cmd *Run) run(c *config.Config, logger *log.Logger, interrupt chan os.Sign
 		EventMap:       c.EventIDs,
 		AWS:            mqtt.AWS{},
 		Protocol:       c.MQTT.Protocol,
+		Queue: mqtt.Queue{
+			Dir:    filepath.Join(cmd.dir, "mqtt.queue"),
+			Size:   x.Queue.Size,
+			MaxAge: x.Queue.MaxAge,
+		},
+		Dispatch: mqtt.Dispatch{
+			Workers: x.Dispatch.Workers,
+			Queue:   x.Dispatch.Queue,
+			Limits:  x.Dispatch.Limits,
+			Timeout: x.Dispatch.Timeout,
+		},
+		Publish: mqtt.Publish{
+			Timeout: x.Publish.Timeout,
+			Retries: x.Publish.Retries,
+		},
+		Cache: mqtt.Cache{
+			Size: x.Cache.Size,
+			TTL:  x.Cache.TTL,
+			File: x.Cache.File,
+		},
+		Encoding: mqtt.Encoding{
+			Clients: x.Encoding.Clients,
+		},
+		HomeAssistant: mqtt.HomeAssistant{
+			Enabled:   x.HomeAssistant.Enabled,
+			Discovery: x.HomeAssistant.Discovery,
+			Topic:     c.Topics.Resolve(x.HomeAssistant.Topic),
+			Locks:     x.HomeAssistant.Locks,
+			Card:      x.HomeAssistant.Card,
+			Code:      x.HomeAssistant.Code,
+			ClientID:  x.HomeAssistant.ClientID,
+			Interval:  x.HomeAssistant.Interval,
+		},
 
 		Debug: cmd.debug,
 	}
 
+	if x.Queue.Dir != "" {
+		mqttd.Queue.Dir = x.Queue.Dir
+	}
+
+	// ... shared subscription mode
+
+	if x.Shared.Group != "" {
+		instance := x.Shared.Instance
+		if instance == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				logger.Printf("ERROR: shared subscription mode requires an instance ID (%v)", err)
+				return
+			}
+
+			instance = hostname
+		}
+
+		mqttd.Shared = mqtt.Shared{
+			Group:    x.Shared.Group,
+			Instance: instance,
+			Lease:    x.Shared.Lease,
+		}
+
+		// NOTE: each instance has its own server status topic (otherwise the retained status and
+		//       last will of the instances would overwrite each other)
+		mqttd.Connection.ClientID = c.Connection.ClientID + "-" + instance
+		mqttd.Topics.Status = c.Topics.Resolve(c.Topics.System) + "/" + c.ServerID + "/" + instance + "/status"
+
+		if x.Topics.Status != "" {
+			mqttd.Topics.Status = c.Topics.Resolve(x.Topics.Status) + "/" + instance
+		}
+	} else if x.Topics.Status != "" {
+		mqttd.Topics.Status = c.Topics.Resolve(x.Topics.Status)
+	}
+
 	if c.AWS.Credentials != "" {
 		mqttd.AWS.Credentials = credentials.NewSharedCredentials(c.AWS.Credentials, c.AWS.Profile)
 		mqttd.AWS.Region = c.AWS.Region
@@ -167,24 +259,69 @@ func (cmd *Run) run(c *config.Config, logger *log.Logger, interrupt chan os.Sign
 
 	// ... TLS
 
-	if strings.HasPrefix(mqttd.Connection.Broker, "tls:") {
-		pem, err := os.ReadFile(c.Connection.BrokerCertificate)
-		if err != nil {
-			logger.Printf("ERROR: %v", err)
-		} else {
-			mqttd.TLS.InsecureSkipVerify = false
-			mqttd.TLS.RootCAs = x509.NewCertPool()
+	mqttd.Connection.Brokers[0].TLS = tlsConfig(
+		c.Connection.Broker,
+		c.Connection.BrokerCertificate,
+		c.Connection.ClientCertificate,
+		c.Connection.ClientKey,
+		logger)
 
-			if ok := mqttd.TLS.RootCAs.AppendCertsFromPEM(pem); !ok {
-				logger.Printf("ERROR: Could not initialise MQTTD CA certificates")
+	// ... failover brokers
+
+	for _, b := range x.Connection.Failover {
+		broker := mqtt.Broker{
+			URL:      b.Broker,
+			UserName: b.Username,
+			Password: b.Password,
+		}
+
+		brokerCertificate := c.Connection.BrokerCertificate
+		clientCertificate := c.Connection.ClientCertificate
+		clientKey := c.Connection.ClientKey
+
+		if b.BrokerCertificate != "" {
+			brokerCertificate = b.BrokerCertificate
+		}
+
+		if b.ClientCertificate != "" {
+			clientCertificate = b.ClientCertificate
+		}
+
+		if b.ClientKey != "" {
+			clientKey = b.ClientKey
+		}
+
+		broker.TLS = tlsConfig(b.Broker, brokerCertificate, clientCertificate, clientKey, logger)
+
+		mqttd.Connection.Brokers = append(mqttd.Connection.Brokers, broker)
+	}
+
+	// ... embedded broker
+
+	if x.Embedded.Enabled {
+		mqttd.Embedded = mqtt.Embedded{
+			Enabled:   true,
+			TCP:       x.Embedded.TCP,
+			TLS:       x.Embedded.TLS,
+			Websocket: x.Embedded.Websocket,
+			Users:     x.Embedded.Users,
+			Anonymous: x.Embedded.Anonymous,
+			Bridge:    x.Embedded.Bridge,
+			Publish:   []string{},
+		}
+
+		for _, filter := range strings.Split(x.Embedded.Publish, ",") {
+			if filter = strings.TrimSpace(filter); filter != "" {
+				mqttd.Embedded.Publish = append(mqttd.Embedded.Publish, filter)
 			}
 		}
 
-		certificate, err := tls.LoadX509KeyPair(c.Connection.ClientCertificate, c.Connection.ClientKey)
-		if err != nil {
-			logger.Printf("ERROR: %v", err)
-		} else {
-			mqttd.TLS.Certificates = []tls.Certificate{certificate}
+		if x.Embedded.TCP == "" && x.Embedded.TLS == "" && x.Embedded.Websocket == "" {
+			mqttd.Embedded.TCP = ":1883"
+		}
+
+		if x.Embedded.Certificate != "" {
+			mqttd.Embedded.TLSConfig = embeddedTLS(x.Embedded.Certificate, x.Embedded.Key, x.Embedded.CA, logger)
 		}
 	}
 
@@ -324,6 +461,94 @@ func (r *Run) listen(
 	}
 }
 
+// Returns the MQTT topics and topic QoS settings from the configuration.
+func topics(c *config.Config, x *extensions) mqtt.Topics {
+	t := mqtt.Topics{
+		Requests: c.Topics.Resolve(c.Topics.Requests),
+		Replies:  c.Topics.Resolve(c.Topics.Replies),
+		Events:   c.Topics.Resolve(c.Topics.Events),
+		System:   c.Topics.Resolve(c.Topics.System),
+		Status:   c.Topics.Resolve(c.Topics.System) + "/" + c.ServerID + "/status",
+
+		RequestQoS: x.Topics.Requests.QoS,
+		ReplyQoS:   mqtt.QoS{QoS: x.Topics.Replies.QoS, Retained: x.Topics.Replies.Retained},
+		EventQoS:   mqtt.QoS{QoS: x.Topics.Events.QoS, Retained: x.Topics.Events.Retained},
+		SystemQoS:  mqtt.QoS{QoS: x.Topics.System.QoS, Retained: x.Topics.System.Retained},
+	}
+
+	if x.Topics.Status != "" {
+		t.Status = c.Topics.Resolve(x.Topics.Status)
+	}
+
+	if x.Topics.RPC != "" {
+		t.RPC = c.Topics.Resolve(x.Topics.RPC)
+	}
+
+	if x.Topics.Doors != "" {
+		t.Doors = c.Topics.Resolve(x.Topics.Doors)
+	}
+
+	return t
+}
+
+func tlsConfig(broker, brokerCertificate, clientCertificate, clientKey string, logger *log.Logger) *tls.Config {
+	config := tls.Config{}
+
+	if strings.HasPrefix(broker, "tls:") {
+		pem, err := os.ReadFile(brokerCertificate)
+		if err != nil {
+			logger.Printf("ERROR: %v", err)
+		} else {
+			config.InsecureSkipVerify = false
+			config.RootCAs = x509.NewCertPool()
+
+			if ok := config.RootCAs.AppendCertsFromPEM(pem); !ok {
+				logger.Printf("ERROR: Could not initialise MQTTD CA certificates")
+			}
+		}
+
+		certificate, err := tls.LoadX509KeyPair(clientCertificate, clientKey)
+		if err != nil {
+			logger.Printf("ERROR: %v", err)
+		} else {
+			config.Certificates = []tls.Certificate{certificate}
+		}
+	}
+
+	return &config
+}
+
+// Returns the TLS configuration for the embedded broker TLS and websocket listeners. Client
+// certificates are optional but, if presented, must be signed by the CA certificate.
+func embeddedTLS(certificate, key, ca string, logger *log.Logger) *tls.Config {
+	keypair, err := tls.LoadX509KeyPair(certificate, key)
+	if err != nil {
+		logger.Printf("ERROR: %v", err)
+		return nil
+	}
+
+	config := tls.Config{
+		Certificates: []tls.Certificate{keypair},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			logger.Printf("ERROR: %v", err)
+		} else {
+			config.ClientCAs = x509.NewCertPool()
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+
+			if ok := config.ClientCAs.AppendCertsFromPEM(pem); !ok {
+				logger.Printf("ERROR: Could not initialise embedded broker client CA certificates")
+			}
+		}
+	}
+
+	return &config
+}
+
 func authorized(file string) ([]string, error) {
 	b, err := os.ReadFile(file)
 	if err != nil {
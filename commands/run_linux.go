@@ -33,6 +33,7 @@ func (r *Run) FlagSet() *flag.FlagSet {
 	flagset.IntVar(&r.logFileSize, "logfilesize", r.logFileSize, "Sets the log file size before forcing a log rotate")
 	flagset.BoolVar(&r.console, "console", r.console, "Writes log entries to stdout")
 	flagset.BoolVar(&r.debug, "debug", r.debug, "Displays internal information for diagnosing errors")
+	flagset.BoolVar(&r.simulate, "simulate", r.simulate, "Uses simulated controllers instead of the UHPPOTE controllers")
 
 	return flagset
 }
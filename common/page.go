@@ -0,0 +1,65 @@
+package common
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// Page holds the (optional) pagination fields of a request for a list. The list is ordered by
+// key and 'after' (the 'next' cursor from the previous reply) takes precedence over 'offset'.
+type Page[K cmp.Ordered] struct {
+	Offset *int `json:"offset"`
+	Limit  *int `json:"limit"`
+	After  *K   `json:"after"`
+}
+
+// Returns true if the request has any pagination fields.
+func (p Page[K]) Paged() bool {
+	return p.Offset != nil || p.Limit != nil || p.After != nil
+}
+
+func (p Page[K]) Validate() error {
+	if p.Offset != nil && *p.Offset < 0 {
+		return fmt.Errorf("Invalid offset (%v)", *p.Offset)
+	}
+
+	if p.Limit != nil && *p.Limit < 1 {
+		return fmt.Errorf("Invalid limit (%v)", *p.Limit)
+	}
+
+	return nil
+}
+
+// Paginate returns the requested page of a list ordered by key, along with the cursor for the
+// next page (nil if there are no more items).
+func Paginate[T any, K cmp.Ordered](list []T, key func(T) K, p Page[K]) ([]T, *K) {
+	sorted := slices.Clone(list)
+
+	slices.SortFunc(sorted, func(a, b T) int {
+		return cmp.Compare(key(a), key(b))
+	})
+
+	start := 0
+	if p.After != nil {
+		start = sort.Search(len(sorted), func(i int) bool { return key(sorted[i]) > *p.After })
+	} else if p.Offset != nil {
+		start = min(*p.Offset, len(sorted))
+	}
+
+	// NOTE: compared with the remaining items rather than added to 'start' so that a very large
+	//       limit cannot overflow
+	end := len(sorted)
+	if p.Limit != nil && *p.Limit < end-start {
+		end = start + *p.Limit
+	}
+
+	if end < len(sorted) {
+		next := key(sorted[end-1])
+
+		return sorted[start:end], &next
+	}
+
+	return sorted[start:end], nil
+}
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestPaginate(t *testing.T) {
+	cards := []uint32{8165538, 8165535, 8165539, 8165537, 8165536}
+	key := func(card uint32) uint32 { return card }
+
+	offset := func(v int) *int { return &v }
+	limit := func(v int) *int { return &v }
+	after := func(v uint32) *uint32 { return &v }
+
+	tests := []struct {
+		page     Page[uint32]
+		expected []uint32
+		next     *uint32
+	}{
+		{Page[uint32]{}, []uint32{8165535, 8165536, 8165537, 8165538, 8165539}, nil},
+		{Page[uint32]{Limit: limit(2)}, []uint32{8165535, 8165536}, after(8165536)},
+		{Page[uint32]{Offset: offset(2), Limit: limit(2)}, []uint32{8165537, 8165538}, after(8165538)},
+		{Page[uint32]{Offset: offset(4), Limit: limit(2)}, []uint32{8165539}, nil},
+		{Page[uint32]{Offset: offset(7)}, []uint32{}, nil},
+		{Page[uint32]{After: after(8165536), Limit: limit(2)}, []uint32{8165537, 8165538}, after(8165538)},
+		{Page[uint32]{After: after(8165536), Offset: offset(4)}, []uint32{8165537, 8165538, 8165539}, nil},
+		{Page[uint32]{After: after(8165540)}, []uint32{}, nil},
+		{Page[uint32]{Offset: offset(1), Limit: limit(math.MaxInt)}, []uint32{8165536, 8165537, 8165538, 8165539}, nil},
+		{Page[uint32]{After: after(8165535), Limit: limit(math.MaxInt)}, []uint32{8165536, 8165537, 8165538, 8165539}, nil},
+	}
+
+	for _, v := range tests {
+		page, next := Paginate(cards, key, v.page)
+
+		if !reflect.DeepEqual(page, v.expected) {
+			t.Errorf("Incorrect page - expected:%v, got:%v", v.expected, page)
+		}
+
+		if !reflect.DeepEqual(next, v.next) {
+			t.Errorf("Incorrect 'next' cursor - expected:%v, got:%v", v.next, next)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package device
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/uhppoted/uhppote-core/types"
@@ -8,9 +9,14 @@ import (
 	"github.com/uhppoted/uhppoted-mqtt/common"
 )
 
-func (d *Device) GetCards(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+// GetCards returns the list of cards stored on a controller. The list is returned in the
+// controller order unless the request has 'offset', 'limit' or 'after' pagination fields, in
+// which case the page is taken from the list ordered by card number and the reply includes the
+// total number of cards and the 'next' cursor (if there are more cards).
+func (d *Device) GetCards(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID *uhppoted.DeviceID `json:"device-id"`
+		common.Page[uint32]
 	}{}
 
 	if response, err := unmarshal(request, &body); err != nil {
@@ -21,6 +27,10 @@ func (d *Device) GetCards(impl uhppoted.IUHPPOTED, request []byte) (interface{},
 		return common.MakeError(uhppoted.StatusBadRequest, "Invalid/missing device ID", nil), fmt.Errorf("Invalid/missing device ID")
 	}
 
+	if err := body.Page.Validate(); err != nil {
+		return common.MakeError(uhppoted.StatusBadRequest, err.Error(), nil), err
+	}
+
 	rq := uhppoted.GetCardsRequest{
 		DeviceID: *body.DeviceID,
 	}
@@ -30,10 +40,26 @@ func (d *Device) GetCards(impl uhppoted.IUHPPOTED, request []byte) (interface{},
 		return common.MakeError(uhppoted.StatusInternalServerError, fmt.Sprintf("Could not retrieve cards from %d", *body.DeviceID), err), err
 	}
 
-	return response, nil
+	if !body.Page.Paged() {
+		return response, nil
+	}
+
+	cards, next := common.Paginate(response.Cards, func(card uint32) uint32 { return card }, body.Page)
+
+	return struct {
+		DeviceID uhppoted.DeviceID `json:"device-id"`
+		Cards    []uint32          `json:"cards"`
+		Total    int               `json:"total"`
+		Next     *uint32           `json:"next,omitempty"`
+	}{
+		DeviceID: response.DeviceID,
+		Cards:    cards,
+		Total:    len(response.Cards),
+		Next:     next,
+	}, nil
 }
 
-func (d *Device) DeleteCards(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) DeleteCards(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID *uhppoted.DeviceID `json:"device-id"`
 	}{}
@@ -58,7 +84,7 @@ func (d *Device) DeleteCards(impl uhppoted.IUHPPOTED, request []byte) (interface
 	return response, nil
 }
 
-func (d *Device) GetCard(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) GetCard(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID   *uhppoted.DeviceID `json:"device-id"`
 		CardNumber *uint32            `json:"card-number"`
@@ -89,7 +115,7 @@ func (d *Device) GetCard(impl uhppoted.IUHPPOTED, request []byte) (interface{},
 	return response, nil
 }
 
-func (d *Device) PutCard(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) PutCard(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	type card struct {
 		CardNumber uint32                `json:"card-number"`
 		From       *types.Date           `json:"start-date"`
@@ -176,7 +202,7 @@ func (d *Device) PutCard(impl uhppoted.IUHPPOTED, request []byte) (interface{},
 	}, nil
 }
 
-func (d *Device) DeleteCard(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) DeleteCard(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID   *uhppoted.DeviceID `json:"device-id"`
 		CardNumber *uint32            `json:"card-number"`
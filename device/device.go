@@ -1,8 +1,10 @@
 package device
 
 import (
+	"context"
 	"encoding/json"
 	"log"
+	"net/http"
 
 	"github.com/uhppoted/uhppoted-lib/uhppoted"
 	"github.com/uhppoted/uhppoted-mqtt/common"
@@ -13,6 +15,7 @@ const (
 	StatusBadRequest          = uhppoted.StatusBadRequest
 	StatusUnauthorized        = uhppoted.StatusUnauthorized
 	StatusNotFound            = uhppoted.StatusNotFound
+	StatusGatewayTimeout      = http.StatusGatewayTimeout
 )
 
 type Device struct {
@@ -33,3 +36,13 @@ func unmarshal(bytes []byte, request interface{}) (interface{}, error) {
 
 	return nil, nil
 }
+
+// Returns a 'request timeout' error if the request deadline has passed (or the request was
+// cancelled), for handlers that make more than one call to the controller.
+func cancelled(ctx context.Context) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return common.MakeError(StatusGatewayTimeout, "Request timeout", err), err
+	}
+
+	return nil, nil
+}
@@ -1,6 +1,7 @@
 package device
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"time"
@@ -10,7 +11,7 @@ import (
 	"github.com/uhppoted/uhppoted-mqtt/common"
 )
 
-func (d *Device) GetDoorDelay(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) GetDoorDelay(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID *uhppoted.DeviceID `json:"device-id"`
 		Door     *uint8             `json:"door"`
@@ -45,7 +46,7 @@ func (d *Device) GetDoorDelay(impl uhppoted.IUHPPOTED, request []byte) (interfac
 	return response, nil
 }
 
-func (d *Device) SetDoorDelay(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) SetDoorDelay(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID *uhppoted.DeviceID `json:"device-id"`
 		Door     *uint8             `json:"door"`
@@ -97,7 +98,7 @@ func (d *Device) SetDoorDelay(impl uhppoted.IUHPPOTED, request []byte) (interfac
 	return response, nil
 }
 
-func (d *Device) GetDoorControl(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) GetDoorControl(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID *uhppoted.DeviceID `json:"device-id"`
 		Door     *uint8             `json:"door"`
@@ -132,7 +133,7 @@ func (d *Device) GetDoorControl(impl uhppoted.IUHPPOTED, request []byte) (interf
 	return response, nil
 }
 
-func (d *Device) SetDoorControl(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) SetDoorControl(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID *uhppoted.DeviceID  `json:"device-id"`
 		Door     *uint8              `json:"door"`
@@ -184,7 +185,7 @@ func (d *Device) SetDoorControl(impl uhppoted.IUHPPOTED, request []byte) (interf
 	return response, nil
 }
 
-func (d *Device) OpenDoor(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) OpenDoor(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID *uhppoted.DeviceID `json:"device-id"`
 		Card     *uint32            `json:"card-number"`
@@ -221,6 +222,10 @@ func (d *Device) OpenDoor(impl uhppoted.IUHPPOTED, request []byte) (interface{},
 			fmt.Errorf("Failed to validate access for card %v to device %v, door %v (%v)", card, deviceID, door, err)
 	}
 
+	if response, err := cancelled(ctx); err != nil {
+		return response, err
+	}
+
 	rq := uhppoted.OpenDoorRequest{
 		DeviceID: *body.DeviceID,
 		Door:     *body.Door,
@@ -1,6 +1,7 @@
 package device
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -26,10 +27,15 @@ type Event struct {
 	ReasonText    string         `json:"event-reason-text"`
 }
 
-func (d *Device) GetEvents(impl uhppoted.IUHPPOTED, request []byte) (any, error) {
+// Default number of events in a page of events, since each event is retrieved with a separate
+// request to the controller.
+const eventsPageSize = 100
+
+func (d *Device) GetEvents(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (any, error) {
 	body := struct {
 		DeviceID uint32 `json:"device-id"`
 		Count    int    `json:"count,omitempty"`
+		common.Page[uint32]
 	}{}
 
 	if response, err := unmarshal(request, &body); err != nil {
@@ -40,6 +46,15 @@ func (d *Device) GetEvents(impl uhppoted.IUHPPOTED, request []byte) (any, error)
 		return common.MakeError(StatusBadRequest, "Invalid/missing device ID", nil), fmt.Errorf("Invalid/missing device ID")
 	}
 
+	if body.Page.Paged() {
+		if body.Count > 0 {
+			return common.MakeError(StatusBadRequest, "'count' cannot be combined with 'offset', 'limit' or 'after'", nil),
+				fmt.Errorf("Invalid request ('count' with pagination)")
+		}
+
+		return getEventsPage(ctx, impl, body.DeviceID, body.Page)
+	}
+
 	deviceID := body.DeviceID
 	count := body.Count
 	events := []any{}
@@ -55,6 +70,10 @@ func (d *Device) GetEvents(impl uhppoted.IUHPPOTED, request []byte) (any, error)
 		}
 	}
 
+	if response, err := cancelled(ctx); err != nil {
+		return response, err
+	}
+
 	first, last, current, err := impl.GetEventIndices(deviceID)
 	if err != nil {
 		return common.MakeError(StatusInternalServerError, fmt.Sprintf("Could not retrieve events from %d", deviceID), err), err
@@ -77,7 +96,83 @@ func (d *Device) GetEvents(impl uhppoted.IUHPPOTED, request []byte) (any, error)
 	return response, nil
 }
 
-func (d *Device) GetEvent(impl uhppoted.IUHPPOTED, request []byte) (any, error) {
+// Returns a page of the events stored on a controller by event index, starting after the 'after'
+// index or at 'offset' from the first event. Unlike 'count', retrieving a page of events does not
+// update the controller event index.
+func getEventsPage(ctx context.Context, impl uhppoted.IUHPPOTED, deviceID uint32, page common.Page[uint32]) (any, error) {
+	if err := page.Validate(); err != nil {
+		return common.MakeError(StatusBadRequest, err.Error(), nil), err
+	}
+
+	first, last, current, err := impl.GetEventIndices(deviceID)
+	if err != nil {
+		return common.MakeError(StatusInternalServerError, fmt.Sprintf("Could not retrieve events from %d", deviceID), err), err
+	}
+
+	// NOTE: the event indices are calculated as uint64 so that 'after' the last possible event
+	//       index (or a large 'offset') does not wrap around to the first event
+	index := uint64(first)
+	if page.After != nil {
+		index = uint64(*page.After) + 1
+	} else if page.Offset != nil {
+		index = uint64(first) + uint64(*page.Offset)
+	}
+
+	if index < uint64(first) {
+		index = uint64(first)
+	}
+
+	limit := eventsPageSize
+	if page.Limit != nil {
+		limit = *page.Limit
+	}
+
+	events := []any{}
+	var next *uint32
+
+	for ; first > 0 && index <= uint64(last) && len(events) < limit; index++ {
+		if response, err := cancelled(ctx); err != nil {
+			return response, err
+		}
+
+		event, err := impl.GetEvent(deviceID, uint32(index))
+		if err != nil {
+			return common.MakeError(StatusInternalServerError, fmt.Sprintf("Could not retrieve event %v from %v", index, deviceID), err), err
+		} else if event != nil {
+			events = append(events, Transmogrify(*event))
+		}
+	}
+
+	if first > 0 && index <= uint64(last) {
+		cursor := uint32(index - 1)
+		next = &cursor
+	}
+
+	total := 0
+	if first > 0 && last >= first {
+		total = int(last - first + 1)
+	}
+
+	return struct {
+		DeviceID uint32  `json:"device-id,omitempty"`
+		First    uint32  `json:"first,omitempty"`
+		Last     uint32  `json:"last,omitempty"`
+		Current  uint32  `json:"current,omitempty"`
+		Events   []any   `json:"events"`
+		Total    int     `json:"total"`
+		Next     *uint32 `json:"next,omitempty"`
+	}{
+		DeviceID: deviceID,
+		First:    first,
+		Last:     last,
+		Current:  current,
+		Events:   events,
+		Total:    total,
+		Next:     next,
+	}, nil
+}
+
+func (d *Device) GetEvent(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (any, error) {
 	var deviceID uint32
 	var index string
 
@@ -140,7 +235,7 @@ func (d *Device) GetEvent(impl uhppoted.IUHPPOTED, request []byte) (any, error)
 // Handler for the special-events MQTT message. Extracts the 'enabled' value from the request
 // and invokes the uhppoted-lib.RecordSpecialEvents API function to update the controller
 // 'record special events' flag.
-func (d *Device) RecordSpecialEvents(impl uhppoted.IUHPPOTED, request []byte) (any, error) {
+func (d *Device) RecordSpecialEvents(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (any, error) {
 	body := struct {
 		DeviceID *uhppoted.DeviceID `json:"device-id"`
 		Enabled  *bool              `json:"enabled"`
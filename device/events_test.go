@@ -0,0 +1,119 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/uhppoted/uhppoted-lib/uhppoted"
+)
+
+// stub implements the event log functions of IUHPPOTED for a controller with events first..last.
+type stub struct {
+	uhppoted.IUHPPOTED
+	first uint32
+	last  uint32
+}
+
+func (s *stub) GetEventIndices(deviceID uint32) (uint32, uint32, uint32, error) {
+	return s.first, s.last, s.first, nil
+}
+
+func (s *stub) GetEvent(deviceID uint32, index uint32) (*uhppoted.Event, error) {
+	if index < s.first || index > s.last {
+		return nil, fmt.Errorf("no event %v", index)
+	}
+
+	return &uhppoted.Event{DeviceID: deviceID, Index: index}, nil
+}
+
+func TestGetEventsPage(t *testing.T) {
+	tests := []struct {
+		first    uint32
+		last     uint32
+		request  string
+		events   []uint32
+		next     *uint32
+		total    int
+		rejected bool
+	}{
+		{1, 10, `{"limit":3}`, []uint32{1, 2, 3}, cursor(3), 10, false},
+		{1, 10, `{"limit":3,"after":3}`, []uint32{4, 5, 6}, cursor(6), 10, false},
+		{1, 10, `{"limit":3,"after":9}`, []uint32{10}, nil, 10, false},
+		{1, 10, `{"limit":3,"after":10}`, []uint32{}, nil, 10, false},
+		{1, 10, `{"limit":4,"offset":6}`, []uint32{7, 8, 9, 10}, nil, 10, false},
+		{1, 10, `{"limit":3,"offset":6}`, []uint32{7, 8, 9}, cursor(9), 10, false},
+		{5, 10, `{"limit":3,"after":1}`, []uint32{5, 6, 7}, cursor(7), 6, false},
+		{1, 10, `{"limit":3,"after":4294967295}`, []uint32{}, nil, 10, false},
+		{4294967290, 4294967295, `{"limit":4,"after":4294967293}`, []uint32{4294967294, 4294967295}, nil, 6, false},
+		{4294967290, 4294967295, `{"limit":2,"after":4294967292}`, []uint32{4294967293, 4294967294}, cursor(4294967294), 6, false},
+		{1, 10, `{"limit":3,"offset":4294967296}`, []uint32{}, nil, 10, false},
+		{0, 0, `{"limit":3}`, []uint32{}, nil, 0, false},
+		{1, 10, `{"limit":0}`, nil, nil, 0, true},
+	}
+
+	for _, v := range tests {
+		d := Device{}
+		impl := stub{first: v.first, last: v.last}
+		request := []byte(`{"device-id":405419896,` + v.request[1:])
+
+		response, err := d.GetEvents(context.Background(), &impl, request)
+		if v.rejected {
+			if err == nil {
+				t.Errorf("%v: expected error, got %v", v.request, response)
+			}
+
+			continue
+		} else if err != nil {
+			t.Fatalf("%v: unexpected error (%v)", v.request, err)
+		}
+
+		bytes, err := json.Marshal(response)
+		if err != nil {
+			t.Fatalf("%v: error marshalling response (%v)", v.request, err)
+		}
+
+		page := struct {
+			Events []struct {
+				Index uint32 `json:"event-id"`
+			} `json:"events"`
+			Total int     `json:"total"`
+			Next  *uint32 `json:"next"`
+		}{}
+
+		if err := json.Unmarshal(bytes, &page); err != nil {
+			t.Fatalf("%v: error unmarshalling response (%v)", v.request, err)
+		}
+
+		events := []uint32{}
+		for _, e := range page.Events {
+			events = append(events, e.Index)
+		}
+
+		if !reflect.DeepEqual(events, v.events) {
+			t.Errorf("%v: incorrect events - expected:%v, got:%v", v.request, v.events, events)
+		}
+
+		if !reflect.DeepEqual(page.Next, v.next) {
+			t.Errorf("%v: incorrect 'next' cursor - expected:%v, got:%v", v.request, deref(v.next), deref(page.Next))
+		}
+
+		if page.Total != v.total {
+			t.Errorf("%v: incorrect total - expected:%v, got:%v", v.request, v.total, page.Total)
+		}
+	}
+}
+
+func cursor(v uint32) *uint32 {
+	return &v
+}
+
+func deref(v *uint32) any {
+	if v == nil {
+		return nil
+	}
+
+	return *v
+}
@@ -1,13 +1,14 @@
 package device
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/uhppoted/uhppoted-lib/uhppoted"
 	"github.com/uhppoted/uhppoted-mqtt/common"
 )
 
-func (d *Device) GetDevices(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) GetDevices(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	rq := uhppoted.GetDevicesRequest{}
 
 	response, err := impl.GetDevices(rq)
@@ -18,7 +19,7 @@ func (d *Device) GetDevices(impl uhppoted.IUHPPOTED, request []byte) (interface{
 	return response, nil
 }
 
-func (d *Device) GetDevice(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) GetDevice(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID *uhppoted.DeviceID `json:"device-id"`
 	}{}
@@ -1,6 +1,7 @@
 package device
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/uhppoted/uhppote-core/types"
@@ -20,7 +21,7 @@ type Status struct {
 	Event          any            `json:"event,omitempty"`
 }
 
-func (d *Device) GetStatus(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) GetStatus(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID uint32 `json:"device-id"`
 	}{}
@@ -1,6 +1,7 @@
 package device
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/uhppoted/uhppote-core/types"
@@ -8,7 +9,7 @@ import (
 	"github.com/uhppoted/uhppoted-mqtt/common"
 )
 
-func (d *Device) PutTaskList(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) PutTaskList(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID *uint32      `json:"device-id"`
 		Tasks    []types.Task `json:"tasks"`
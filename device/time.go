@@ -1,6 +1,7 @@
 package device
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/uhppoted/uhppote-core/types"
@@ -8,7 +9,7 @@ import (
 	"github.com/uhppoted/uhppoted-mqtt/common"
 )
 
-func (d *Device) GetTime(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) GetTime(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID *uhppoted.DeviceID `json:"device-id"`
 	}{}
@@ -33,7 +34,7 @@ func (d *Device) GetTime(impl uhppoted.IUHPPOTED, request []byte) (interface{},
 	return response, nil
 }
 
-func (d *Device) SetTime(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) SetTime(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID *uhppoted.DeviceID `json:"device-id"`
 		DateTime *types.DateTime    `json:"date-time"`
@@ -1,6 +1,7 @@
 package device
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/uhppoted/uhppote-core/types"
@@ -8,7 +9,7 @@ import (
 	"github.com/uhppoted/uhppoted-mqtt/common"
 )
 
-func (d *Device) GetTimeProfile(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) GetTimeProfile(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID  *uint32 `json:"device-id"`
 		ProfileID *uint8  `json:"profile-id"`
@@ -39,7 +40,7 @@ func (d *Device) GetTimeProfile(impl uhppoted.IUHPPOTED, request []byte) (interf
 	return response, nil
 }
 
-func (d *Device) PutTimeProfile(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) PutTimeProfile(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID *uint32            `json:"device-id"`
 		Profile  *types.TimeProfile `json:"profile"`
@@ -70,7 +71,7 @@ func (d *Device) PutTimeProfile(impl uhppoted.IUHPPOTED, request []byte) (interf
 	return response, nil
 }
 
-func (d *Device) ClearTimeProfiles(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) ClearTimeProfiles(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID *uint32 `json:"device-id"`
 	}{}
@@ -95,7 +96,7 @@ func (d *Device) ClearTimeProfiles(impl uhppoted.IUHPPOTED, request []byte) (int
 	return response, nil
 }
 
-func (d *Device) GetTimeProfiles(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) GetTimeProfiles(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID *uint32 `json:"device-id"`
 		From     int     `json:"from"`
@@ -127,7 +128,7 @@ func (d *Device) GetTimeProfiles(impl uhppoted.IUHPPOTED, request []byte) (inter
 	return response, nil
 }
 
-func (d *Device) PutTimeProfiles(impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+func (d *Device) PutTimeProfiles(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
 	body := struct {
 		DeviceID *uint32             `json:"device-id"`
 		Profiles []types.TimeProfile `json:"profiles"`
@@ -1,18 +1,26 @@
 module github.com/uhppoted/uhppoted-mqtt
 
-go 1.18
+go 1.24.0
 
 require (
 	github.com/aws/aws-sdk-go v1.44.68
+	github.com/eclipse/paho.golang v0.23.0
 	github.com/eclipse/paho.mqtt.golang v1.4.1
+	github.com/fxamacker/cbor/v2 v2.4.0
+	github.com/mochi-mqtt/server/v2 v2.6.6
 	github.com/uhppoted/uhppote-core v0.8.1
 	github.com/uhppoted/uhppoted-lib v0.8.2-0.20220803173656-034525be3037
-	golang.org/x/sys v0.0.0-20220731174439-a90be440212d
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	golang.org/x/sys v0.35.0
 )
 
 require (
-	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
-	golang.org/x/net v0.0.0-20220802222814-0bcc04d9c69b // indirect
+	github.com/rs/xid v1.4.0 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/net v0.43.0 // indirect
 	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,91 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/uhppoted/uhppoted-mqtt/auth"
+)
+
+// Parses a device-addressed request topic (e.g. <requests>/device/405419896/door/3/lock:open),
+// returning the dispatch table topic (<requests>/device/door/lock:open) and the controller and
+// door addressed by the topic. The door is optional (e.g. <requests>/device/405419896/status:get)
+// and <requests>/device/<device-id>:get is the addressed topic for <requests>/device:get.
+func (m *MQTTD) addressed(topic string) (string, *auth.Scope, bool) {
+	prefix := m.Topics.Requests + "/device/"
+	if !strings.HasPrefix(topic, prefix) {
+		return "", nil, false
+	}
+
+	fields := strings.Split(strings.TrimPrefix(topic, prefix), "/")
+	id, action, _ := strings.Cut(fields[0], ":")
+
+	deviceID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil || deviceID == 0 {
+		return "", nil, false
+	}
+
+	scope := auth.Scope{
+		DeviceID: uint32(deviceID),
+	}
+
+	if len(fields) == 1 {
+		if action == "" {
+			return "", nil, false
+		}
+
+		return m.Topics.Requests + "/device:" + action, &scope, true
+	} else if action != "" {
+		return "", nil, false
+	}
+
+	rest := fields[1:]
+	if len(rest) > 2 && rest[0] == "door" {
+		door, err := strconv.ParseUint(rest[1], 10, 8)
+		if err != nil || door < 1 || door > 4 {
+			return "", nil, false
+		}
+
+		scope.Door = uint8(door)
+		rest = append([]string{"door"}, rest[2:]...)
+	}
+
+	return prefix + strings.Join(rest, "/"), &scope, true
+}
+
+// Sets the device-id (and door) of a request sent to a device-addressed topic from the topic,
+// returning an error if the request has a different device-id or door.
+func scoped(request []byte, scope *auth.Scope) ([]byte, error) {
+	body := map[string]json.RawMessage{}
+	if err := json.Unmarshal(request, &body); err != nil {
+		return nil, err
+	}
+
+	if v, ok := body["device-id"]; ok {
+		var deviceID uint32
+		if err := json.Unmarshal(v, &deviceID); err != nil {
+			return nil, fmt.Errorf("invalid device-id (%v)", err)
+		} else if deviceID != scope.DeviceID {
+			return nil, fmt.Errorf("request device-id (%v) does not match topic device-id (%v)", deviceID, scope.DeviceID)
+		}
+	}
+
+	body["device-id"] = json.RawMessage(fmt.Sprintf("%v", scope.DeviceID))
+
+	if scope.Door != 0 {
+		if v, ok := body["door"]; ok {
+			var door uint8
+			if err := json.Unmarshal(v, &door); err != nil {
+				return nil, fmt.Errorf("invalid door (%v)", err)
+			} else if door != scope.Door {
+				return nil, fmt.Errorf("request door (%v) does not match topic door (%v)", door, scope.Door)
+			}
+		}
+
+		body["door"] = json.RawMessage(fmt.Sprintf("%v", scope.Door))
+	}
+
+	return json.Marshal(body)
+}
@@ -0,0 +1,66 @@
+package mqtt
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/uhppoted/uhppoted-mqtt/auth"
+)
+
+func TestAddressed(t *testing.T) {
+	mqttd := MQTTD{
+		Topics: Topics{Requests: "uhppoted/gateway/requests"},
+	}
+
+	tests := []struct {
+		topic    string
+		expected string
+		scope    *auth.Scope
+	}{
+		{"uhppoted/gateway/requests/device/405419896/door/3/lock:open", "uhppoted/gateway/requests/device/door/lock:open", &auth.Scope{DeviceID: 405419896, Door: 3}},
+		{"uhppoted/gateway/requests/device/405419896/door/delay:get", "uhppoted/gateway/requests/device/door/delay:get", &auth.Scope{DeviceID: 405419896, Door: 0}},
+		{"uhppoted/gateway/requests/device/405419896/status:get", "uhppoted/gateway/requests/device/status:get", &auth.Scope{DeviceID: 405419896, Door: 0}},
+		{"uhppoted/gateway/requests/device/405419896:get", "uhppoted/gateway/requests/device:get", &auth.Scope{DeviceID: 405419896, Door: 0}},
+		{"uhppoted/gateway/requests/device/status:get", "", nil},
+		{"uhppoted/gateway/requests/device/door/lock:open", "", nil},
+		{"uhppoted/gateway/requests/device/405419896/door/5/lock:open", "", nil},
+		{"uhppoted/gateway/requests/device/405419896:get/status", "", nil},
+		{"uhppoted/gateway/requests/acl/card:show", "", nil},
+	}
+
+	for _, v := range tests {
+		topic, scope, ok := mqttd.addressed(v.topic)
+
+		if ok != (v.scope != nil) {
+			t.Errorf("%v: incorrectly parsed as device-addressed topic - expected:%v, got:%v", v.topic, v.scope != nil, ok)
+		} else if topic != v.expected || !reflect.DeepEqual(scope, v.scope) {
+			t.Errorf("%v: incorrectly parsed\n   expected:%v %v\n   got:     %v %v", v.topic, v.expected, v.scope, topic, scope)
+		}
+	}
+}
+
+func TestScoped(t *testing.T) {
+	scope := auth.Scope{DeviceID: 405419896, Door: 3}
+
+	tests := []struct {
+		request  string
+		expected string
+		ok       bool
+	}{
+		{`{"card-number":8165538}`, `{"card-number":8165538,"device-id":405419896,"door":3}`, true},
+		{`{"device-id":405419896,"door":3,"card-number":8165538}`, `{"card-number":8165538,"device-id":405419896,"door":3}`, true},
+		{`{"device-id":303986753,"card-number":8165538}`, "", false},
+		{`{"device-id":405419896,"door":4}`, "", false},
+	}
+
+	for _, v := range tests {
+		request, err := scoped([]byte(v.request), &scope)
+		if v.ok && err != nil {
+			t.Errorf("%v: unexpected error (%v)", v.request, err)
+		} else if !v.ok && err == nil {
+			t.Errorf("%v: expected error, got %s", v.request, request)
+		} else if v.ok && string(request) != v.expected {
+			t.Errorf("%v: incorrect request - expected:%v, got:%s", v.request, v.expected, request)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/uhppoted/uhppoted-lib/uhppoted"
+	"github.com/uhppoted/uhppoted-mqtt/common"
+)
+
+type apiMethod struct {
+	Method      string          `json:"method"`
+	Topic       string          `json:"topic"`
+	Resource    string          `json:"resource"`
+	Action      string          `json:"action"`
+	Permitted   bool            `json:"permitted"`
+	Description string          `json:"description,omitempty"`
+	Request     json.RawMessage `json:"request,omitempty"`
+	Reply       json.RawMessage `json:"reply,omitempty"`
+}
+
+// Lists the dispatch table methods with the request topic, resource:action and request/reply
+// JSON schemas for each method. 'permitted' is true if the requesting client is authorised to
+// use the method.
+func (d *dispatcher) api(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+	body := struct {
+		ClientID *string `json:"client-id"`
+	}{}
+
+	if err := json.Unmarshal(request, &body); err != nil {
+		return common.MakeError(uhppoted.StatusBadRequest, "Cannot parse request", err), err
+	}
+
+	methods := []apiMethod{}
+
+	for method, topic := range d.methods {
+		resource, action, _ := resourceAction(topic)
+
+		m := apiMethod{
+			Method:    method,
+			Topic:     topic,
+			Resource:  resource,
+			Action:    action,
+			Permitted: d.mqttd.authorise(body.ClientID, topic) == nil,
+		}
+
+		if s, ok := d.schemas[method]; ok {
+			m.Description = s.Description
+			m.Request = s.Request
+			m.Reply = s.Reply
+		}
+
+		methods = append(methods, m)
+	}
+
+	sort.Slice(methods, func(i, j int) bool { return methods[i].Method < methods[j].Method })
+
+	return struct {
+		Methods []apiMethod `json:"methods"`
+	}{
+		Methods: methods,
+	}, nil
+}
+
+// Validates a request against the JSON schema for the method (if any).
+func (d *dispatcher) validate(method string, request []byte) error {
+	if s, ok := d.schemas[method]; ok {
+		return s.validate(request)
+	}
+
+	return nil
+}
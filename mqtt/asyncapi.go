@@ -0,0 +1,398 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/uhppoted/uhppote-core/uhppote"
+	"github.com/uhppoted/uhppoted-lib/uhppoted"
+	"github.com/uhppoted/uhppoted-mqtt/acl"
+	"github.com/uhppoted/uhppoted-mqtt/common"
+	"github.com/uhppoted/uhppoted-mqtt/device"
+)
+
+// asyncapi is an AsyncAPI 2.6 document describing the MQTT API.
+type asyncapi struct {
+	AsyncAPI           string                 `json:"asyncapi"`
+	Info               asyncapiInfo           `json:"info"`
+	Servers            map[string]interface{} `json:"servers,omitempty"`
+	DefaultContentType string                 `json:"defaultContentType"`
+	Channels           map[string]interface{} `json:"channels"`
+	Components         struct {
+		Messages map[string]interface{} `json:"messages"`
+	} `json:"components"`
+}
+
+type asyncapiInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description"`
+}
+
+type jsonSchema = map[string]interface{}
+
+// AsyncAPI returns an AsyncAPI 2.6 document for the MQTT API, generated from the dispatch
+// table topics, the request/reply schemas for each method and the event, system and status
+// message types. The topics are the topics configured for the MQTTD.
+func (mqttd *MQTTD) AsyncAPI(version string) ([]byte, error) {
+	d, err := newDispatcher(mqttd, &uhppoted.UHPPOTED{}, []uhppote.Device{}, &device.Device{}, &acl.ACL{}, log.New(io.Discard, "", 0))
+	if err != nil {
+		return nil, err
+	}
+
+	doc := asyncapi{
+		AsyncAPI: "2.6.0",
+		Info: asyncapiInfo{
+			Title:   "uhppoted-mqtt",
+			Version: version,
+			Description: "MQTT API for UHPPOTE access controllers. Requests may be signed (HMAC, RSA or HOTP) and " +
+				"encrypted - see documentation/messages.md for the authentication and encryption details.",
+		},
+		Servers:            map[string]interface{}{},
+		DefaultContentType: "application/json",
+		Channels:           map[string]interface{}{},
+	}
+
+	doc.Components.Messages = map[string]interface{}{}
+
+	for i, broker := range mqttd.Connection.Brokers {
+		name := "broker"
+		if i > 0 {
+			name = fmt.Sprintf("failover-%v", i)
+		}
+
+		protocol := "mqtt"
+		if strings.HasPrefix(broker.URL, "tls:") || strings.HasPrefix(broker.URL, "ssl:") || strings.HasPrefix(broker.URL, "mqtts:") {
+			protocol = "secure-mqtt"
+		}
+
+		protocolVersion := "3.1.1"
+		if mqttd.Connection.isV5() {
+			protocolVersion = "5.0"
+		}
+
+		doc.Servers[name] = map[string]interface{}{
+			"url":             broker.URL,
+			"protocol":        protocol,
+			"protocolVersion": protocolVersion,
+		}
+	}
+
+	// ... requests and replies
+	replies := []interface{}{}
+	methods := []string{}
+	for method := range d.methods {
+		methods = append(methods, method)
+	}
+
+	sort.Strings(methods)
+
+	for _, method := range methods {
+		topic := d.methods[method]
+		name := strings.ReplaceAll(method, ":", "-")
+		description := ""
+		request := jsonSchema{"type": "object"}
+		reply := jsonSchema{}
+
+		if s, ok := d.schemas[method]; ok {
+			description = s.Description
+			if err := json.Unmarshal(s.Request, &request); err != nil {
+				return nil, err
+			}
+
+			if err := json.Unmarshal(s.Reply, &reply); err != nil {
+				return nil, err
+			}
+		}
+
+		doc.Components.Messages[name+".request"] = map[string]interface{}{
+			"name":    name + ".request",
+			"title":   method + " request",
+			"summary": description,
+			"payload": envelope("request", withRequestMeta(request)),
+		}
+
+		doc.Components.Messages[name+".reply"] = map[string]interface{}{
+			"name":    name + ".reply",
+			"title":   method + " reply",
+			"summary": description,
+			"payload": envelope("reply", withReplyMeta(method, jsonSchema{"response": reply})),
+		}
+
+		doc.Channels[topic] = map[string]interface{}{
+			"description": description,
+			"publish": map[string]interface{}{
+				"operationId": name,
+				"summary":     description,
+				"message":     ref(name + ".request"),
+			},
+		}
+
+		replies = append(replies, ref(name+".reply"))
+	}
+
+	doc.Components.Messages["error"] = map[string]interface{}{
+		"name":    "error",
+		"title":   "error reply",
+		"summary": "Error reply to a request that failed or was refused",
+		"payload": envelope("error", withReplyMeta("", jsonSchema{"error": schemaOf(reflect.TypeOf(common.Error{}))})),
+	}
+
+	replies = append(replies, ref("error"))
+
+	doc.Channels[mqttd.Topics.Replies+"/{client-id}"] = map[string]interface{}{
+		"description": "Replies to requests from a client (unless the request specifies a 'reply-to' topic)",
+		"parameters": map[string]interface{}{
+			"client-id": map[string]interface{}{
+				"description": "Client ID of the requesting client",
+				"schema":      jsonSchema{"type": "string"},
+			},
+		},
+		"subscribe": map[string]interface{}{
+			"operationId": "replies",
+			"message":     map[string]interface{}{"oneOf": replies},
+		},
+	}
+
+	// ... JSON-RPC
+	if mqttd.Topics.RPC != "" {
+		doc.Components.Messages["jsonrpc.request"] = map[string]interface{}{
+			"name":    "jsonrpc.request",
+			"title":   "JSON-RPC 2.0 request",
+			"summary": "JSON-RPC 2.0 request for any of the request methods, with the request fields as the 'params'",
+			"payload": envelope("request", jsonSchema{
+				"type": "object",
+				"properties": jsonSchema{
+					"jsonrpc": jsonSchema{"type": "string", "enum": []string{"2.0"}},
+					"method":  jsonSchema{"type": "string", "enum": methods},
+					"params":  withRequestMeta(jsonSchema{"type": "object"}),
+					"id":      jsonSchema{"type": []string{"string", "integer", "null"}},
+				},
+				"required": []string{"jsonrpc", "method"},
+			}),
+		}
+
+		doc.Channels[mqttd.Topics.RPC] = map[string]interface{}{
+			"description": "JSON-RPC 2.0 requests",
+			"publish": map[string]interface{}{
+				"operationId": "jsonrpc",
+				"message":     ref("jsonrpc.request"),
+			},
+		}
+	}
+
+	// ... events
+	doc.Components.Messages["event"] = map[string]interface{}{
+		"name":    "event",
+		"title":   "controller event",
+		"summary": "Event received from an access controller",
+		"payload": envelope("event", jsonSchema{
+			"type":       "object",
+			"properties": jsonSchema{"event": schemaOf(reflect.TypeOf(device.Event{}))},
+		}),
+	}
+
+	doc.Channels[mqttd.Topics.Events] = map[string]interface{}{
+		"description": "Access controller events",
+		"subscribe": map[string]interface{}{
+			"operationId": "events",
+			"message":     ref("event"),
+		},
+	}
+
+	// ... system messages
+	doc.Components.Messages["alive"] = map[string]interface{}{
+		"name":    "alive",
+		"title":   "alive",
+		"summary": "Periodic health check message",
+		"payload": envelope("system", jsonSchema{
+			"type":       "object",
+			"properties": jsonSchema{"alive": schemaOf(reflect.TypeOf(aliveMessage{}))},
+		}),
+	}
+
+	doc.Components.Messages["alert"] = map[string]interface{}{
+		"name":    "alert",
+		"title":   "alert",
+		"summary": "Health check or watchdog alert",
+		"payload": envelope("system", jsonSchema{
+			"type":       "object",
+			"properties": jsonSchema{"alert": schemaOf(reflect.TypeOf(alertMessage{}))},
+		}),
+	}
+
+	doc.Components.Messages["status"] = map[string]interface{}{
+		"name":    "status",
+		"title":   "server status",
+		"summary": "Retained online/offline server status (the offline message is the MQTT last will and testament)",
+		"payload": envelope("system", jsonSchema{
+			"type":       "object",
+			"properties": jsonSchema{"status": schemaOf(reflect.TypeOf(statusMessage{}))},
+		}),
+	}
+
+	doc.Channels[mqttd.Topics.System] = map[string]interface{}{
+		"description": "System health check messages and alerts",
+		"subscribe": map[string]interface{}{
+			"operationId": "system",
+			"message":     map[string]interface{}{"oneOf": []interface{}{ref("alive"), ref("alert")}},
+		},
+	}
+
+	doc.Channels[mqttd.Topics.Status] = map[string]interface{}{
+		"description": "Server status",
+		"subscribe": map[string]interface{}{
+			"operationId": "status",
+			"message":     ref("status"),
+		},
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+func ref(message string) jsonSchema {
+	return jsonSchema{"$ref": "#/components/messages/" + message}
+}
+
+// Wraps a message body schema in the message envelope i.e. {"message": {"<key>": {...}}, "hmac": "..."}.
+// The optional 'signature' and 'key' fields are for signed and encrypted messages.
+func envelope(key string, body jsonSchema) jsonSchema {
+	return jsonSchema{
+		"type": "object",
+		"properties": jsonSchema{
+			"message": jsonSchema{
+				"type": "object",
+				"properties": jsonSchema{
+					"signature": jsonSchema{"type": "string"},
+					"key":       jsonSchema{"type": "string"},
+					key:         body,
+				},
+				"required": []string{key},
+			},
+			"hmac": jsonSchema{"type": "string"},
+		},
+		"required": []string{"message"},
+	}
+}
+
+// Adds the request meta-info fields to a request schema.
+func withRequestMeta(request jsonSchema) jsonSchema {
+	properties, _ := request["properties"].(map[string]interface{})
+	if properties == nil {
+		properties = jsonSchema{}
+	}
+
+	properties["request-id"] = jsonSchema{"type": "string"}
+	properties["client-id"] = jsonSchema{"type": "string"}
+	properties["reply-to"] = jsonSchema{"type": "string"}
+	properties["nonce"] = jsonSchema{"type": "integer"}
+	properties["timeout"] = jsonSchema{"type": []string{"integer", "string"}}
+
+	request["properties"] = properties
+
+	return request
+}
+
+// Returns a reply schema with the reply meta-info fields and the reply content.
+func withReplyMeta(method string, content jsonSchema) jsonSchema {
+	properties := jsonSchema{
+		"server-id":  jsonSchema{"type": "string"},
+		"client-id":  jsonSchema{"type": "string"},
+		"request-id": jsonSchema{"type": "string"},
+		"method":     jsonSchema{"type": "string"},
+		"nonce":      jsonSchema{"type": "integer"},
+		"duplicate":  jsonSchema{"type": "boolean"},
+	}
+
+	if method != "" {
+		properties["method"] = jsonSchema{"type": "string", "enum": []string{method}}
+	}
+
+	for k, v := range content {
+		properties[k] = v
+	}
+
+	return jsonSchema{
+		"type":       "object",
+		"properties": properties,
+	}
+}
+
+// Generates a JSON schema for a Go type from the type and the 'json' field tags. Types that
+// implement json.Marshaler (e.g. types.DateTime) are assumed to marshal to a string.
+func schemaOf(t reflect.Type) jsonSchema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	marshaler := reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	if t.Implements(marshaler) || reflect.PointerTo(t).Implements(marshaler) {
+		return jsonSchema{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer"}
+
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+
+	case reflect.Slice, reflect.Array:
+		return jsonSchema{"type": "array", "items": schemaOf(t.Elem())}
+
+	case reflect.Map:
+		return jsonSchema{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+
+	case reflect.Struct:
+		properties := jsonSchema{}
+		required := []string{}
+
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+
+			tag := strings.Split(field.Tag.Get("json"), ",")
+			name := tag[0]
+			if name == "-" {
+				continue
+			} else if name == "" {
+				name = field.Name
+			}
+
+			properties[name] = schemaOf(field.Type)
+
+			omitempty := false
+			for _, option := range tag[1:] {
+				omitempty = omitempty || option == "omitempty"
+			}
+
+			if !omitempty {
+				required = append(required, name)
+			}
+		}
+
+		schema := jsonSchema{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+
+		return schema
+
+	default:
+		return jsonSchema{}
+	}
+}
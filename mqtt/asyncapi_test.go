@@ -0,0 +1,65 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAsyncAPI(t *testing.T) {
+	mqttd := MQTTD{
+		ServerID: "uhppoted",
+		Connection: Connection{
+			Brokers: []Broker{{URL: "tcp://127.0.0.1:1883"}},
+		},
+		Topics: Topics{
+			Requests: "uhppoted/gateway/requests",
+			Replies:  "uhppoted/gateway/replies",
+			Events:   "uhppoted/gateway/events",
+			System:   "uhppoted/gateway/system",
+			Status:   "uhppoted/gateway/system/uhppoted/status",
+		},
+	}
+
+	bytes, err := mqttd.AsyncAPI("v0.8.x")
+	if err != nil {
+		t.Fatalf("Error generating AsyncAPI specification (%v)", err)
+	}
+
+	spec := struct {
+		AsyncAPI   string                     `json:"asyncapi"`
+		Channels   map[string]json.RawMessage `json:"channels"`
+		Components struct {
+			Messages map[string]json.RawMessage `json:"messages"`
+		} `json:"components"`
+	}{}
+
+	if err := json.Unmarshal(bytes, &spec); err != nil {
+		t.Fatalf("Invalid AsyncAPI specification (%v)", err)
+	}
+
+	if spec.AsyncAPI != "2.6.0" {
+		t.Errorf("Incorrect AsyncAPI version - expected:%v, got:%v", "2.6.0", spec.AsyncAPI)
+	}
+
+	for _, channel := range []string{
+		"uhppoted/gateway/requests/device:get",
+		"uhppoted/gateway/requests/device/door/lock:open",
+		"uhppoted/gateway/requests/acl/card:grant",
+		"uhppoted/gateway/requests/batch:exec",
+		"uhppoted/gateway/requests/api:get",
+		"uhppoted/gateway/replies/{client-id}",
+		"uhppoted/gateway/events",
+		"uhppoted/gateway/system",
+		"uhppoted/gateway/system/uhppoted/status",
+	} {
+		if _, ok := spec.Channels[channel]; !ok {
+			t.Errorf("Missing channel %v", channel)
+		}
+	}
+
+	for _, message := range []string{"get-device.request", "get-device.reply", "acl-grant.request", "error", "event", "alive", "alert", "status"} {
+		if _, ok := spec.Components.Messages[message]; !ok {
+			t.Errorf("Missing message %v", message)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/uhppoted/uhppoted-lib/uhppoted"
+	"github.com/uhppoted/uhppoted-mqtt/common"
+)
+
+type batchItem struct {
+	Method  string          `json:"method"`
+	Request json.RawMessage `json:"request"`
+}
+
+type batchResult struct {
+	Method   string      `json:"method"`
+	Response interface{} `json:"response,omitempty"`
+	Error    interface{} `json:"error,omitempty"`
+}
+
+// Executes an ordered list of requests as a single request, returning the response (or error)
+// for each item. Each item is authorised against the method request topic, the same as if the
+// request had been sent individually. Items for a method with a concurrency limit are executed
+// on the method queue, so the batch waits for the method limit. If 'stop-on-error' is set the
+// batch stops at the first item that fails, otherwise all the items are executed.
+func (d *dispatcher) batch(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+	body := struct {
+		ClientID    *string     `json:"client-id"`
+		StopOnError bool        `json:"stop-on-error"`
+		Requests    []batchItem `json:"requests"`
+	}{}
+
+	if err := json.Unmarshal(request, &body); err != nil {
+		return common.MakeError(uhppoted.StatusBadRequest, "Cannot parse request", err), err
+	}
+
+	if len(body.Requests) == 0 {
+		return common.MakeError(uhppoted.StatusBadRequest, "Invalid/missing batch requests", nil), fmt.Errorf("Invalid/missing batch requests")
+	}
+
+	results := []batchResult{}
+
+	for _, item := range body.Requests {
+		response, err := d.exec(ctx, impl, body.ClientID, item)
+		if err != nil {
+			d.log.Printf("WARN  %-12s %v", "batch", fmt.Errorf("%v: %v", item.Method, err))
+
+			if response == nil {
+				response = common.MakeError(uhppoted.StatusInternalServerError, "Internal error", err)
+			}
+
+			results = append(results, batchResult{Method: item.Method, Error: response})
+
+			if body.StopOnError {
+				break
+			}
+		} else {
+			results = append(results, batchResult{Method: item.Method, Response: response})
+		}
+	}
+
+	return struct {
+		Results []batchResult `json:"results"`
+	}{
+		Results: results,
+	}, nil
+}
+
+// Authorises and executes a single batch item.
+func (d *dispatcher) exec(ctx context.Context, impl uhppoted.IUHPPOTED, clientID *string, item batchItem) (interface{}, error) {
+	topic, ok := d.methods[item.Method]
+	if !ok || d.table[topic].method == "batch" {
+		return common.MakeError(StatusNotFound, "Unknown request", nil), fmt.Errorf("Invalid/unknown method '%v'", item.Method)
+	}
+
+	if err := d.mqttd.authorise(clientID, topic); err != nil {
+		return common.MakeError(StatusForbidden, "Request not authorised", nil), fmt.Errorf("Error authorising request (%v)", err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return common.MakeError(StatusGatewayTimeout, "Request timeout", err), err
+	}
+
+	request := []byte(item.Request)
+	if len(request) == 0 {
+		request = []byte("{}")
+	}
+
+	if err := d.validate(item.Method, request); err != nil {
+		return common.MakeError(StatusBadRequest, "Invalid request", err), err
+	}
+
+	fn := d.table[topic]
+	if d.mqttd.pool.limited(fn.method) {
+		return d.queued(ctx, impl, fn, request)
+	}
+
+	return fn.f(ctx, impl, request)
+}
+
+// Executes a batch item for a method with a concurrency limit on the method queue, waiting for
+// the item to complete.
+func (d *dispatcher) queued(ctx context.Context, impl uhppoted.IUHPPOTED, fn fdispatch, request []byte) (interface{}, error) {
+	type result struct {
+		response interface{}
+		err      error
+	}
+
+	executed := make(chan result, 1)
+
+	f := func() {
+		if err := ctx.Err(); err != nil {
+			executed <- result{common.MakeError(StatusGatewayTimeout, "Request timeout", err), err}
+		} else {
+			response, err := fn.f(ctx, impl, request)
+			executed <- result{response, err}
+		}
+	}
+
+	if !d.mqttd.pool.submit(fn.method, f) {
+		return common.MakeError(StatusServiceUnavailable, "Server busy - request queue full", nil), errors.New("Server busy - request queue full")
+	}
+
+	r := <-executed
+
+	return r.response, r.err
+}
@@ -0,0 +1,129 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/uhppoted/uhppoted-lib/uhppoted"
+	"github.com/uhppoted/uhppoted-mqtt/common"
+)
+
+func TestBatch(t *testing.T) {
+	ok := func(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+		return json.RawMessage(request), nil
+	}
+
+	fail := func(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+		return common.MakeError(404, "No such card", nil), errors.New("no such card")
+	}
+
+	d := dispatcher{
+		mqttd: &MQTTD{},
+		log:   log.New(io.Discard, "", 0),
+		table: map[string]fdispatch{
+			"requests/device/card:put": {"put-card", ok},
+			"requests/device/card:get": {"get-card", fail},
+		},
+		methods: map[string]string{},
+	}
+
+	d.table["requests/batch:exec"] = fdispatch{"batch", d.batch}
+	for topic, fn := range d.table {
+		d.methods[fn.method] = topic
+	}
+
+	tests := []struct {
+		request  string
+		expected string
+	}{
+		{
+			`{"requests":[{"method":"put-card","request":{"card":1}},{"method":"get-card"},{"method":"put-card","request":{"card":2}}]}`,
+			`{"results":[{"method":"put-card","response":{"card":1}},{"method":"get-card","error":{"code":404,"message":"No such card"}},{"method":"put-card","response":{"card":2}}]}`,
+		},
+		{
+			`{"stop-on-error":true,"requests":[{"method":"put-card","request":{"card":1}},{"method":"get-card"},{"method":"put-card","request":{"card":2}}]}`,
+			`{"results":[{"method":"put-card","response":{"card":1}},{"method":"get-card","error":{"code":404,"message":"No such card"}}]}`,
+		},
+		{
+			`{"requests":[{"method":"batch","request":{}},{"method":"delete-card"}]}`,
+			`{"results":[{"method":"batch","error":{"code":404,"message":"Unknown request"}},{"method":"delete-card","error":{"code":404,"message":"Unknown request"}}]}`,
+		},
+	}
+
+	for _, v := range tests {
+		response, err := d.batch(context.Background(), nil, []byte(v.request))
+		if err != nil {
+			t.Fatalf("Unexpected error executing batch (%v)", err)
+		}
+
+		if bytes, err := json.Marshal(response); err != nil {
+			t.Fatalf("Error marshaling batch response (%v)", err)
+		} else if string(bytes) != v.expected {
+			t.Errorf("Incorrect batch response\n   expected:%v\n   got:     %v", v.expected, string(bytes))
+		}
+	}
+}
+
+func TestBatchMethodLimits(t *testing.T) {
+	closed := make(chan struct{})
+	defer close(closed)
+
+	block := make(chan struct{})
+	started := make(chan struct{})
+
+	ok := func(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+		return json.RawMessage(request), nil
+	}
+
+	d := dispatcher{
+		mqttd: &MQTTD{
+			pool: newPool(Dispatch{Workers: 2, Queue: 4, Limits: map[string]int{"get-cards": 1}}, closed),
+		},
+		log: log.New(io.Discard, "", 0),
+		table: map[string]fdispatch{
+			"requests/device/cards:get": {"get-cards", ok},
+			"requests/device/card:put":  {"put-card", ok},
+		},
+		methods: map[string]string{},
+	}
+
+	d.table["requests/batch:exec"] = fdispatch{"batch", d.batch}
+	for topic, fn := range d.table {
+		d.methods[fn.method] = topic
+	}
+
+	d.mqttd.pool.submit("get-cards", func() { close(started); <-block })
+	<-started
+
+	executed := make(chan string, 1)
+	go func() {
+		response, _ := d.batch(context.Background(), nil, []byte(`{"requests":[{"method":"put-card","request":{"card":1}},{"method":"get-cards"}]}`))
+		bytes, _ := json.Marshal(response)
+		executed <- string(bytes)
+	}()
+
+	select {
+	case <-executed:
+		t.Fatalf("Batch get-cards item executed while get-cards method limit is saturated")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(block)
+
+	expected := `{"results":[{"method":"put-card","response":{"card":1}},{"method":"get-cards","response":{}}]}`
+
+	select {
+	case response := <-executed:
+		if response != expected {
+			t.Errorf("Incorrect batch response\n   expected:%v\n   got:     %v", expected, response)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting for batch to complete")
+	}
+}
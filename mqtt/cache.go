@@ -0,0 +1,299 @@
+package mqtt
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Cache holds the settings for the request reply cache. The replies to requests with both a
+// client-id and request-id are cached for TTL so that a duplicate request (e.g. a QoS 1 request
+// delivered twice by the broker) is answered with the cached reply rather than being executed
+// again. The oldest replies are discarded if the cache exceeds Size replies and the cache is
+// persisted to File (if set) periodically and on closing, so that duplicates are also detected
+// across a restart.
+type Cache struct {
+	Size int
+	TTL  time.Duration
+	File string
+}
+
+type cache struct {
+	Cache
+	entries map[string]*list.Element
+	order   *list.List
+	dirty   bool
+	log     *log.Logger
+	sync.Mutex
+}
+
+type cached struct {
+	Key     string          `json:"key"`
+	Type    msgType         `json:"type"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Expires time.Time       `json:"expires"`
+	pending bool
+}
+
+const defaultCacheTTL = 5 * time.Minute
+
+// Interval for writing the updated cache to the cache file.
+const cacheSaveInterval = 15 * time.Second
+
+// Maximum size of a cached reply. A duplicate of a request with a larger reply (e.g. a get-cards
+// request for a large card list) is ignored rather than answered from the cache.
+const maxCachedReply = 64 * 1024
+
+// Initialises the reply cache, loading the cached replies from a previous run (if persisted).
+// Returns nil if the cache is not enabled.
+func newCache(c Cache, log *log.Logger) (*cache, error) {
+	if c.Size <= 0 {
+		return nil, nil
+	}
+
+	if c.TTL <= 0 {
+		c.TTL = defaultCacheTTL
+	}
+
+	cc := cache{
+		Cache:   c,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+		log:     log,
+	}
+
+	if c.File != "" {
+		if err := cc.load(); err != nil {
+			return &cc, err
+		}
+	}
+
+	return &cc, nil
+}
+
+// Returns the cache key for a request, or "" if the request cannot be cached. The key includes
+// the method so that a request for a different method that reuses a request ID is not mistaken
+// for a duplicate.
+func (rq *request) key(method string) string {
+	if rq.ClientID == nil || rq.RequestID == nil {
+		return ""
+	}
+
+	return *rq.ClientID + "/" + *rq.RequestID + "/" + method
+}
+
+// Claims a request for execution. Returns the cached entry and true if the request is a duplicate
+// of a request that has already been executed (or is still executing).
+func (c *cache) claim(key string) (*cached, bool) {
+	if c == nil || key == "" {
+		return nil, false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*cached)
+		if entry.pending || now.Before(entry.Expires) {
+			v := *entry
+			return &v, true
+		}
+
+		c.order.Remove(e)
+		delete(c.entries, key)
+	}
+
+	c.entries[key] = c.order.PushBack(&cached{
+		Key:     key,
+		Expires: now.Add(c.TTL),
+		pending: true,
+	})
+
+	c.evict(now)
+
+	return nil, false
+}
+
+// Returns the cached entry for a request that has already been executed (or is still executing),
+// without claiming the request.
+func (c *cache) lookup(key string) (*cached, bool) {
+	if c == nil || key == "" {
+		return nil, false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		if entry := e.Value.(*cached); entry.pending || time.Now().Before(entry.Expires) {
+			v := *entry
+			return &v, true
+		}
+	}
+
+	return nil, false
+}
+
+// Records the reply to a claimed request.
+func (c *cache) put(key string, msgtype msgType, message interface{}) {
+	if c == nil || key == "" {
+		return
+	}
+
+	bytes, err := json.Marshal(message)
+	if err != nil {
+		c.log.Printf("WARN  %-12s %v", "mqttd", fmt.Errorf("Error caching reply (%v)", err))
+		return
+	}
+
+	if len(bytes) > maxCachedReply {
+		bytes = nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*cached)
+		if entry.pending {
+			entry.Type = msgtype
+			entry.Message = bytes
+		}
+	}
+}
+
+// Marks a claimed request as completed, starting the TTL for the cached reply.
+func (c *cache) done(key string) {
+	if c == nil || key == "" {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*cached)
+		entry.pending = false
+		entry.Expires = time.Now().Add(c.TTL)
+
+		c.order.MoveToBack(e)
+		c.dirty = true
+	}
+}
+
+// Periodically writes the updated cache to the cache file (if set) until closed.
+func (c *cache) persist(closed <-chan struct{}) {
+	if c == nil || c.File == "" {
+		return
+	}
+
+	tick := time.NewTicker(cacheSaveInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+
+		case <-tick.C:
+			c.flush()
+		}
+	}
+}
+
+// Writes the cache to the cache file (if set) if it has been updated since it was last saved.
+func (c *cache) flush() {
+	if c == nil || c.File == "" {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.dirty {
+		if err := c.save(); err != nil {
+			c.log.Printf("WARN  %-12s %v", "mqttd", fmt.Errorf("Error saving reply cache (%v)", err))
+		} else {
+			c.dirty = false
+		}
+	}
+}
+
+// Discards expired replies and, if the cache is full, the oldest replies. Pending requests are
+// only discarded if the cache is full of pending requests.
+func (c *cache) evict(now time.Time) {
+	for e := c.order.Front(); e != nil; {
+		next := e.Next()
+		if entry := e.Value.(*cached); !entry.pending && now.After(entry.Expires) {
+			c.order.Remove(e)
+			delete(c.entries, entry.Key)
+		}
+
+		e = next
+	}
+
+	for c.order.Len() > c.Size {
+		e := c.order.Front()
+		c.order.Remove(e)
+		delete(c.entries, e.Value.(*cached).Key)
+	}
+}
+
+func (c *cache) load() error {
+	bytes, err := os.ReadFile(c.File)
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	entries := []cached{}
+	if err := json.Unmarshal(bytes, &entries); err != nil {
+		return fmt.Errorf("Invalid reply cache file '%v' (%v)", c.File, err)
+	}
+
+	now := time.Now()
+	for i := range entries {
+		if entry := entries[i]; now.Before(entry.Expires) {
+			c.entries[entry.Key] = c.order.PushBack(&entry)
+		}
+	}
+
+	c.evict(now)
+
+	return nil
+}
+
+// Writes the completed replies to the cache file (via a temporary file so that the cache file
+// is never left partially written).
+func (c *cache) save() error {
+	entries := []cached{}
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		if entry := e.Value.(*cached); !entry.pending {
+			entries = append(entries, *entry)
+		}
+	}
+
+	bytes, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.File), 0700); err != nil {
+		return err
+	}
+
+	tmp := c.File + ".tmp"
+	if err := os.WriteFile(tmp, bytes, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, c.File)
+}
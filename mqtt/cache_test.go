@@ -0,0 +1,142 @@
+package mqtt
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheDuplicate(t *testing.T) {
+	c, _ := newCache(Cache{Size: 4, TTL: time.Minute}, log.New(io.Discard, "", 0))
+
+	if _, duplicate := c.claim("QWERTY/AH173635G3"); duplicate {
+		t.Fatalf("First request incorrectly identified as duplicate")
+	}
+
+	if entry, duplicate := c.claim("QWERTY/AH173635G3"); !duplicate || !entry.pending {
+		t.Errorf("Duplicate of executing request not identified as in progress - duplicate:%v", duplicate)
+	}
+
+	c.put("QWERTY/AH173635G3", msgReply, map[string]interface{}{"response": "ok"})
+	c.done("QWERTY/AH173635G3")
+
+	entry, duplicate := c.claim("QWERTY/AH173635G3")
+	if !duplicate {
+		t.Fatalf("Duplicate request not identified")
+	}
+
+	if entry.pending || entry.Type != msgReply || string(entry.Message) != `{"response":"ok"}` {
+		t.Errorf("Incorrect cached reply - got:%+v", entry)
+	}
+
+	if _, duplicate := c.claim("QWERTY/AH173635G4"); duplicate {
+		t.Errorf("Request with different request ID incorrectly identified as duplicate")
+	}
+
+	if _, duplicate := c.claim(""); duplicate {
+		t.Errorf("Request without request ID incorrectly identified as duplicate")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c, _ := newCache(Cache{Size: 2, TTL: time.Minute}, log.New(io.Discard, "", 0))
+
+	for _, key := range []string{"Q/1", "Q/2", "Q/3"} {
+		c.claim(key)
+		c.done(key)
+	}
+
+	if _, duplicate := c.claim("Q/1"); duplicate {
+		t.Errorf("Oldest reply not evicted from full cache")
+	}
+
+	if _, duplicate := c.claim("Q/3"); !duplicate {
+		t.Errorf("Most recent reply incorrectly evicted from cache")
+	}
+}
+
+func TestCacheReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "mqtt.cache")
+	c, _ := newCache(Cache{Size: 4, TTL: time.Minute, File: file}, log.New(io.Discard, "", 0))
+
+	c.claim("QWERTY/AH173635G3")
+	c.put("QWERTY/AH173635G3", msgError, map[string]interface{}{"error": "oops"})
+	c.done("QWERTY/AH173635G3")
+	c.flush()
+
+	reloaded, err := newCache(Cache{Size: 4, TTL: time.Minute, File: file}, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("Error reloading reply cache (%v)", err)
+	}
+
+	entry, duplicate := reloaded.claim("QWERTY/AH173635G3")
+	if !duplicate {
+		t.Fatalf("Duplicate request not identified after reload")
+	}
+
+	if entry.Type != msgError || string(entry.Message) != `{"error":"oops"}` {
+		t.Errorf("Incorrect reloaded reply - got:%+v", entry)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	clientID := "QWERTY"
+	requestID := "AH173635G3"
+	rq := request{ClientID: &clientID, RequestID: &requestID}
+
+	c, _ := newCache(Cache{Size: 4, TTL: time.Minute}, log.New(io.Discard, "", 0))
+
+	c.claim(rq.key("put-card"))
+	c.done(rq.key("put-card"))
+
+	if _, duplicate := c.claim(rq.key("put-card")); !duplicate {
+		t.Errorf("Duplicate request not identified")
+	}
+
+	if _, duplicate := c.claim(rq.key("delete-card")); duplicate {
+		t.Errorf("Request for a different method with the same request ID incorrectly identified as duplicate")
+	}
+
+	if key := (&request{ClientID: &clientID}).key("put-card"); key != "" {
+		t.Errorf("Expected no cache key for request without request ID, got %v", key)
+	}
+}
+
+func TestCacheOversizedReply(t *testing.T) {
+	c, _ := newCache(Cache{Size: 4, TTL: time.Minute}, log.New(io.Discard, "", 0))
+
+	c.claim("QWERTY/AH173635G3/get-cards")
+	c.put("QWERTY/AH173635G3/get-cards", msgReply, map[string]interface{}{"response": strings.Repeat("x", maxCachedReply)})
+	c.done("QWERTY/AH173635G3/get-cards")
+
+	entry, duplicate := c.claim("QWERTY/AH173635G3/get-cards")
+	if !duplicate {
+		t.Fatalf("Duplicate request not identified")
+	}
+
+	if entry.Message != nil {
+		t.Errorf("Expected oversized reply to be discarded, got %v bytes", len(entry.Message))
+	}
+}
+
+func TestCacheFlush(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "mqtt.cache")
+	c, _ := newCache(Cache{Size: 4, TTL: time.Minute, File: file}, log.New(io.Discard, "", 0))
+
+	c.claim("QWERTY/AH173635G3")
+	c.done("QWERTY/AH173635G3")
+
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("Expected cache file to only be written on flush (%v)", err)
+	}
+
+	c.flush()
+
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("Expected cache file to be written on flush (%v)", err)
+	}
+}
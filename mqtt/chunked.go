@@ -0,0 +1,75 @@
+package mqtt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Minimum chunk size for a chunked reply (in bytes).
+const minChunkSize = 256
+
+// chunk is a numbered part of a chunked reply. Data is the part of the encoded reply content,
+// base64 encoded.
+type chunk struct {
+	Index  int    `json:"index"`
+	Chunks int    `json:"chunks"`
+	Data   []byte `json:"data"`
+}
+
+// chunked is the completion message published after the last chunk of a chunked reply, with
+// the size and SHA-256 hash of the reassembled reply content.
+type chunked struct {
+	Chunks int    `json:"chunks"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Publishes a reply as a sequence of numbered chunks of at most 'chunk-size' bytes followed by a
+// completion message. Each chunk is a separate reply message (with its own nonce, signature, etc)
+// and the reassembled content is the reply (i.e. {"response": ...}) in the reply encoding.
+func (d *dispatcher) sendChunked(rq *request, replyTo string, meta *metainfo, reply interface{}) error {
+	content, err := meta.encoding.marshal(reply)
+	if err != nil {
+		return err
+	}
+
+	size := rq.ChunkSize
+	N := (len(content) + size - 1) / size
+	if N == 0 {
+		N = 1
+	}
+
+	for i := 0; i < N; i++ {
+		start := i * size
+		end := min(start+size, len(content))
+
+		message := struct {
+			Chunk chunk `json:"chunk"`
+		}{
+			Chunk: chunk{
+				Index:  i + 1,
+				Chunks: N,
+				Data:   content[start:end],
+			},
+		}
+
+		m := *meta
+		if err := d.mqttd.send(rq.ClientID, replyTo, &m, message, msgReply, false); err != nil {
+			return fmt.Errorf("Error publishing chunk %v of %v (%v)", i+1, N, err)
+		}
+	}
+
+	hash := sha256.Sum256(content)
+	message := struct {
+		Chunked chunked `json:"chunked"`
+	}{
+		Chunked: chunked{
+			Chunks: N,
+			Size:   len(content),
+			SHA256: hex.EncodeToString(hash[:]),
+		},
+	}
+
+	return d.mqttd.send(rq.ClientID, replyTo, meta, message, msgReply, false)
+}
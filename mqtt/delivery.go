@@ -0,0 +1,155 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Publish holds the delivery settings for published messages. Timeout is the maximum time to
+// wait for the broker to acknowledge a published message and Retries is the number of times
+// publishing a critical message (events and alerts) is retried before the message is re-queued
+// (or discarded if the outbound queue is not enabled).
+type Publish struct {
+	Timeout time.Duration
+	Retries int
+}
+
+// Delivery is the outcome of publishing a message, reported to the (optional) MQTTD OnDelivery
+// callback.
+type Delivery struct {
+	Topic     string
+	Type      string
+	Critical  bool
+	Attempts  int
+	Delivered bool
+	Queued    bool
+	Err       error
+}
+
+const defaultPublishTimeout = 10 * time.Second
+
+// Publishes a message, waiting for the broker to acknowledge receipt of critical messages and
+// retrying/re-queueing critical messages that could not be delivered. Non-critical messages are
+// tracked asynchronously. Messages are queued (if the outbound queue is enabled) if the connection
+// to the broker is down or there are queued messages waiting to be published.
+//
+// Returns nil if the message was delivered (critical messages), is being delivered (non-critical
+// messages) or was queued for delivery.
+func (mqttd *MQTTD) publish(msg queued, msgtype msgType, critical bool) error {
+	client := mqttd.current()
+	connected := client != nil && client.isConnected()
+	q := mqttd.queue
+
+	if !queueable(msgtype, critical) {
+		q = nil
+	}
+
+	delivery := Delivery{
+		Topic:    msg.Topic,
+		Type:     fmt.Sprintf("%v", msgtype),
+		Critical: critical,
+	}
+
+	if !connected || (q != nil && q.pending()) {
+		if q == nil {
+			return errors.New("No connection to MQTT broker")
+		}
+
+		return mqttd.requeue(q, msg, delivery, connected)
+	}
+
+	if !critical {
+		go func() {
+			delivery.Attempts = 1
+			if delivery.Err = client.publish(msg.Topic, msg.QoS, msg.Retained, msg.Payload, msg.Props); delivery.Err == nil {
+				delivery.Delivered = true
+			}
+
+			mqttd.delivered(delivery)
+		}()
+
+		return nil
+	}
+
+	for delivery.Attempts <= mqttd.Publish.Retries {
+		delivery.Attempts++
+		if delivery.Err = client.publish(msg.Topic, msg.QoS, msg.Retained, msg.Payload, msg.Props); delivery.Err == nil {
+			delivery.Delivered = true
+			mqttd.delivered(delivery)
+
+			return nil
+		}
+	}
+
+	if q != nil {
+		return mqttd.requeue(q, msg, delivery, false)
+	}
+
+	mqttd.delivered(delivery)
+
+	return delivery.Err
+}
+
+func (mqttd *MQTTD) requeue(q *queue, msg queued, delivery Delivery, drain bool) error {
+	if err := q.push(msg); err != nil {
+		delivery.Err = fmt.Errorf("Error queueing message for publishing (%v)", err)
+		mqttd.delivered(delivery)
+
+		return delivery.Err
+	}
+
+	delivery.Queued = true
+	mqttd.delivered(delivery)
+
+	if drain {
+		go mqttd.drain()
+	}
+
+	return nil
+}
+
+// Publishes any queued messages to the current broker connection.
+func (mqttd *MQTTD) drain() {
+	if q := mqttd.queue; q != nil {
+		q.drain(func(msg queued) error {
+			delivery := Delivery{
+				Topic:    msg.Topic,
+				Type:     msg.Type,
+				Critical: msg.Critical,
+				Attempts: 1,
+			}
+
+			client := mqttd.current()
+			if client == nil || !client.isConnected() {
+				delivery.Err = errors.New("No connection to MQTT broker")
+			} else {
+				delivery.Err = client.publish(msg.Topic, msg.QoS, msg.Retained, msg.Payload, msg.Props)
+			}
+
+			delivery.Delivered = delivery.Err == nil
+			delivery.Queued = delivery.Err != nil
+
+			mqttd.delivered(delivery)
+
+			return delivery.Err
+		})
+	}
+}
+
+// Logs failed deliveries and invokes the OnDelivery callback (if any).
+func (mqttd *MQTTD) delivered(delivery Delivery) {
+	if !delivery.Delivered && !delivery.Queued && delivery.Err != nil {
+		mqttd.log.Printf("WARN  %-12s %v", "mqttd", fmt.Errorf("Error publishing %v message to %v (%v)", delivery.Type, delivery.Topic, delivery.Err))
+	}
+
+	if mqttd.OnDelivery != nil {
+		mqttd.OnDelivery(delivery)
+	}
+}
+
+// Events, errors, replies and alerts are queued for publishing if the connection to the broker
+// is down. Non-critical system messages (e.g. 'alive') are not.
+func queueable(msgtype msgType, critical bool) bool {
+	return msgtype != msgSystem || critical
+}
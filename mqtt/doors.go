@@ -0,0 +1,288 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/uhppoted/uhppote-core/types"
+	"github.com/uhppoted/uhppoted-lib/locales"
+	"github.com/uhppoted/uhppoted-lib/uhppoted"
+)
+
+// doors tracks the state of each controller door and publishes it (retained) to the per-door
+// state topic <doors topic>/<device-id>/<door> whenever it changes. The state is derived from
+// the received events and from the controller status retrieved by 'get-status' requests (and
+// by the Home Assistant status polling).
+//
+// The door states include the last card number so, like events, they are wrapped (HMAC, signed and
+// encrypted with the events key if outgoing messages are signed and encrypted) as {"door": ...}.
+type doors struct {
+	mqttd  *MQTTD
+	topic  string
+	states map[doorKey]doorState
+	events map[uint32]uint32
+	log    *log.Logger
+	sync.Mutex
+}
+
+type doorKey struct {
+	deviceID uint32
+	door     uint8
+}
+
+// doorState is the retained door state message. Fields that are not (yet) known are omitted and
+// the timestamp is the controller date/time of the most recent change.
+type doorState struct {
+	DeviceID  uint32         `json:"device-id"`
+	Door      uint8          `json:"door"`
+	State     string         `json:"state,omitempty"`
+	Button    string         `json:"button,omitempty"`
+	Relay     string         `json:"relay,omitempty"`
+	Card      uint32         `json:"card,omitempty"`
+	Access    string         `json:"access,omitempty"`
+	Reason    string         `json:"reason,omitempty"`
+	Timestamp types.DateTime `json:"timestamp"`
+}
+
+// Event type and reasons used to update the door state.
+const (
+	eventDoor          uint8 = 2
+	reasonDoorOpened   uint8 = 23
+	reasonDoorClosed   uint8 = 24
+	reasonSupervisor   uint8 = 25
+	reasonForcedOpen   uint8 = 38
+	reasonForcedClosed uint8 = 40
+)
+
+func newDoors(mqttd *MQTTD, log *log.Logger) *doors {
+	return &doors{
+		mqttd:  mqttd,
+		topic:  mqttd.Topics.Doors,
+		states: map[doorKey]doorState{},
+		events: map[uint32]uint32{},
+		log:    log,
+	}
+}
+
+// Republishes the known door states on (re)connecting to the broker, in case the broker does
+// not persist retained messages.
+func (d *doors) connected(c client) {
+	d.Lock()
+	list := make([]doorState, 0, len(d.states))
+	for _, state := range d.states {
+		list = append(list, state)
+	}
+	d.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].DeviceID < list[j].DeviceID || (list[i].DeviceID == list[j].DeviceID && list[i].Door < list[j].Door)
+	})
+
+	for _, state := range list {
+		d.publish(c, state)
+	}
+}
+
+// Updates the door state from a received event.
+func (d *doors) event(e uhppoted.Event) {
+	d.Lock()
+	state, changed := d.apply(e)
+	d.Unlock()
+
+	if changed {
+		d.publish(d.mqttd.current(), state)
+	}
+}
+
+// Updates the door states from a controller status. The status event is applied too if it is
+// more recent than the last event received for the controller.
+func (d *doors) status(deviceID uint32, status *uhppoted.Status) {
+	if status == nil {
+		return
+	}
+
+	updated := []doorState{}
+
+	d.Lock()
+	for door, open := range status.DoorState {
+		if door < 1 || door > 4 {
+			continue
+		}
+
+		key := doorKey{deviceID, door}
+		state := d.get(key)
+
+		state.State = openclosed(open)
+		state.Button = pressed(status.DoorButton[door])
+		state.Relay = unlocked(status.RelayState&(1<<(door-1)) != 0)
+
+		if !d.same(key, state) {
+			state.Timestamp = status.SystemDateTime
+			d.states[key] = state
+			updated = append(updated, state)
+		}
+	}
+
+	if e := status.Event; e != nil && e.Index > 0 {
+		event := *e
+		event.DeviceID = deviceID
+
+		if state, changed := d.apply(event); changed {
+			updated = append(updated, state)
+		}
+	}
+	d.Unlock()
+
+	sort.Slice(updated, func(i, j int) bool { return updated[i].Door < updated[j].Door })
+
+	c := d.mqttd.current()
+	for _, state := range updated {
+		d.publish(c, state)
+	}
+}
+
+// Applies an event to the door state, ignoring events that are older than the last event
+// applied for the controller. Returns the updated state and true if the state has changed (card
+// swipes are always a change, since the timestamp is the time of the last swipe).
+//
+// NOTE: must be invoked with the lock held.
+func (d *doors) apply(e uhppoted.Event) (doorState, bool) {
+	if e.Door < 1 || e.Door > 4 || e.Index <= d.events[e.DeviceID] {
+		return doorState{}, false
+	}
+
+	d.events[e.DeviceID] = e.Index
+
+	key := doorKey{e.DeviceID, e.Door}
+	state := d.get(key)
+
+	switch {
+	case e.Type == swipe:
+		state.Card = e.CardNumber
+		state.Access = granted(e.Granted)
+		state.Reason = reason(e.Reason)
+
+	case e.Type == eventDoor && (e.Reason == reasonDoorOpened || e.Reason == reasonSupervisor || e.Reason == reasonForcedOpen):
+		state.State = openclosed(true)
+
+	case e.Type == eventDoor && (e.Reason == reasonDoorClosed || e.Reason == reasonForcedClosed):
+		state.State = openclosed(false)
+	}
+
+	if e.Type != swipe && d.same(key, state) {
+		return state, false
+	}
+
+	state.Timestamp = e.Timestamp
+	d.states[key] = state
+
+	return state, true
+}
+
+// Returns the current state of a door.
+//
+// NOTE: must be invoked with the lock held.
+func (d *doors) get(key doorKey) doorState {
+	if state, ok := d.states[key]; ok {
+		return state
+	}
+
+	return doorState{DeviceID: key.deviceID, Door: key.door}
+}
+
+// Returns true if the state (ignoring the timestamp) is unchanged from the current door state.
+//
+// NOTE: must be invoked with the lock held.
+func (d *doors) same(key doorKey, state doorState) bool {
+	current, ok := d.states[key]
+
+	current.Timestamp = state.Timestamp
+
+	return ok && current == state
+}
+
+func (d *doors) publish(c client, state doorState) {
+	if c == nil || !c.isConnected() {
+		return
+	}
+
+	topic := fmt.Sprintf("%v/%v/%v", d.topic, state.DeviceID, state.Door)
+
+	message := struct {
+		Door doorState `json:"door"`
+	}{
+		Door: state,
+	}
+
+	if payload, err := d.mqttd.wrap(msgEvent, message, &d.mqttd.Encryption.EventsKeyID); err != nil {
+		d.log.Printf("WARN  %-12s %v", "doors", err)
+	} else if err := c.publish(topic, d.mqttd.Topics.EventQoS.QoS, true, payload, nil); err != nil {
+		d.log.Printf("WARN  %-12s %v", "doors", fmt.Errorf("Error publishing %v (%v)", topic, err))
+	}
+}
+
+// Wraps a request handler to update the door states from the controller status retrieved by
+// the handler.
+func (d *doors) observe(f func(context.Context, uhppoted.IUHPPOTED, []byte) (interface{}, error)) func(context.Context, uhppoted.IUHPPOTED, []byte) (interface{}, error) {
+	return func(ctx context.Context, impl uhppoted.IUHPPOTED, request []byte) (interface{}, error) {
+		return f(ctx, observed{impl, d}, request)
+	}
+}
+
+// observed is an IUHPPOTED that updates the door states from the retrieved controller status.
+type observed struct {
+	uhppoted.IUHPPOTED
+	doors *doors
+}
+
+func (o observed) GetStatus(deviceID uint32) (*uhppoted.Status, error) {
+	status, err := o.IUHPPOTED.GetStatus(deviceID)
+	if err == nil {
+		o.doors.status(deviceID, status)
+	}
+
+	return status, err
+}
+
+func openclosed(open bool) string {
+	if open {
+		return "open"
+	}
+
+	return "closed"
+}
+
+func pressed(b bool) string {
+	if b {
+		return "pressed"
+	}
+
+	return "released"
+}
+
+func unlocked(b bool) string {
+	if b {
+		return "unlocked"
+	}
+
+	return "locked"
+}
+
+func granted(b bool) string {
+	if b {
+		return "granted"
+	}
+
+	return "denied"
+}
+
+func reason(r uint8) string {
+	if v, ok := locales.Lookup(fmt.Sprintf("event.reason.%v", r)); ok {
+		return v
+	}
+
+	return fmt.Sprintf("%v", r)
+}
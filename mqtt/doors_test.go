@@ -0,0 +1,134 @@
+package mqtt
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/uhppoted/uhppote-core/types"
+	"github.com/uhppoted/uhppoted-lib/uhppoted"
+	"github.com/uhppoted/uhppoted-mqtt/auth"
+)
+
+func TestDoorsUpdate(t *testing.T) {
+	mqttd := MQTTD{Topics: Topics{Doors: "uhppoted/gateway/doors"}}
+	d := newDoors(&mqttd, log.New(os.Stdout, "", 0))
+
+	t1 := types.DateTime(time.Date(2026, time.October, 17, 12, 34, 56, 0, time.Local))
+	t2 := types.DateTime(time.Date(2026, time.October, 17, 12, 35, 10, 0, time.Local))
+	t3 := types.DateTime(time.Date(2026, time.October, 17, 12, 36, 00, 0, time.Local))
+
+	d.status(405419896, &uhppoted.Status{
+		DoorState:      map[uint8]bool{1: false, 2: false, 3: true, 4: false},
+		DoorButton:     map[uint8]bool{1: false, 2: false, 3: false, 4: true},
+		RelayState:     0x04,
+		SystemDateTime: t1,
+		Event: &uhppoted.Event{
+			Index:      17,
+			Type:       1,
+			Granted:    true,
+			Door:       3,
+			CardNumber: 8165538,
+			Timestamp:  t1,
+			Reason:     1,
+		},
+	})
+
+	d.event(uhppoted.Event{DeviceID: 405419896, Index: 18, Type: 2, Door: 3, Reason: 24, Timestamp: t2})
+	d.event(uhppoted.Event{DeviceID: 405419896, Index: 12, Type: 1, Door: 3, CardNumber: 8165537, Timestamp: t3})
+
+	expected := doorState{
+		DeviceID:  405419896,
+		Door:      3,
+		State:     "closed",
+		Button:    "released",
+		Relay:     "unlocked",
+		Card:      8165538,
+		Access:    "granted",
+		Reason:    "swipe",
+		Timestamp: t2,
+	}
+
+	if state := d.states[doorKey{405419896, 3}]; state != expected {
+		t.Errorf("Incorrect door state\n   expected:%+v\n   got:     %+v", expected, state)
+	}
+
+	if state := d.states[doorKey{405419896, 4}]; state.Button != "pressed" || state.Relay != "locked" || state.Timestamp != t1 {
+		t.Errorf("Incorrect door state %+v", state)
+	}
+
+	// ... unchanged status should not update the timestamp
+	d.status(405419896, &uhppoted.Status{
+		DoorState:      map[uint8]bool{4: false},
+		DoorButton:     map[uint8]bool{4: true},
+		SystemDateTime: t3,
+	})
+
+	if state := d.states[doorKey{405419896, 4}]; state.Timestamp != t1 {
+		t.Errorf("Incorrect door state timestamp - expected:%v, got:%v", t1, state.Timestamp)
+	}
+}
+
+// published is a client that records the published messages.
+type published struct {
+	client
+	messages map[string][]byte
+}
+
+func (p *published) isConnected() bool {
+	return true
+}
+
+func (p *published) publish(topic string, qos byte, retained bool, payload []byte, props *properties) error {
+	p.messages[topic] = payload
+	return nil
+}
+
+func TestDoorsPublishWrapped(t *testing.T) {
+	hmac, _ := auth.NewHMAC(true, "secret")
+	mqttd := MQTTD{
+		Topics: Topics{Doors: "uhppoted/gateway/doors"},
+		HMAC:   *hmac,
+	}
+
+	d := newDoors(&mqttd, log.New(io.Discard, "", 0))
+	c := published{messages: map[string][]byte{}}
+
+	d.publish(&c, doorState{DeviceID: 405419896, Door: 3, State: "closed", Card: 8165538, Access: "granted"})
+
+	payload, ok := c.messages["uhppoted/gateway/doors/405419896/3"]
+	if !ok {
+		t.Fatalf("Door state not published")
+	}
+
+	envelope := struct {
+		Message json.RawMessage `json:"message"`
+		HMAC    string          `json:"hmac"`
+	}{}
+
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		t.Fatalf("Invalid door state message %s (%v)", payload, err)
+	}
+
+	if mac, err := hex.DecodeString(envelope.HMAC); err != nil || !hmac.Verify(envelope.Message, mac) {
+		t.Errorf("Invalid door state message HMAC")
+	}
+
+	message := struct {
+		Event struct {
+			Door doorState `json:"door"`
+		} `json:"event"`
+	}{}
+
+	if err := json.Unmarshal(envelope.Message, &message); err != nil {
+		t.Fatalf("Invalid door state message %s (%v)", envelope.Message, err)
+	}
+
+	if state := message.Event.Door; state.DeviceID != 405419896 || state.Door != 3 || state.Card != 8165538 {
+		t.Errorf("Incorrect door state %+v", state)
+	}
+}
@@ -0,0 +1,411 @@
+package mqtt
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/uhppoted/uhppoted-lib/kvs"
+)
+
+// Embedded holds the settings for the (optional) embedded MQTT broker. If enabled, MQTTD
+// connects to the embedded broker in-process rather than to the configured brokers and MQTT
+// clients connect to the embedded broker on the TCP, TLS and/or websocket listen addresses.
+//
+// Clients are authenticated with a username and password from the Users file, with a TLS client
+// certificate (if the TLS config requires or verifies client certificates) or, if Anonymous is
+// set, without credentials. If Bridge is set the requests published to the first configured
+// broker are forwarded to the embedded broker and the messages published by MQTTD are forwarded
+// to the configured broker.
+//
+// Clients may subscribe to any topic but may only publish to the request topics, the RPC topic,
+// the Home Assistant door lock command topics (if enabled) and the topic filters in Publish. The
+// reply, event, system and status topics can only be published to by MQTTD.
+type Embedded struct {
+	Enabled   bool
+	TCP       string
+	TLS       string
+	Websocket string
+	TLSConfig *tls.Config
+	Users     string
+	Anonymous bool
+	Bridge    bool
+	Publish   []string
+}
+
+type embedded struct {
+	mochi.HookBase
+	Embedded
+	mqttd    *MQTTD
+	server   *mochi.Server
+	users    *kvs.KeyValueStore
+	bridged  []Broker
+	upstream paho.Client
+	log      *log.Logger
+}
+
+// Client ID of the MQTTD in-process client.
+const embeddedClientID = "uhppoted-mqtt"
+
+// URL of the embedded broker in log messages and broker switch events.
+const embeddedURL = "embedded://"
+
+func newEmbedded(mqttd *MQTTD, log *log.Logger) (*embedded, error) {
+	e := embedded{
+		Embedded: mqttd.Embedded,
+		mqttd:    mqttd,
+		bridged:  mqttd.Connection.Brokers,
+		users:    kvs.NewKeyValueStore("embedded:users", func(v string) (interface{}, error) { return v, nil }),
+		log:      log,
+	}
+
+	if e.TCP == "" && e.TLS == "" && e.Websocket == "" {
+		return nil, errors.New("embedded broker has no TCP, TLS or websocket listen address")
+	}
+
+	if e.TLS != "" && e.TLSConfig == nil {
+		return nil, errors.New("embedded broker TLS listener requires a server certificate and key")
+	}
+
+	if e.Users != "" {
+		if err := e.users.LoadFromFile(e.Users); err != nil {
+			return nil, err
+		}
+
+		e.users.Watch(e.Users, log)
+	} else if !e.Anonymous && (e.TLSConfig == nil || e.TLSConfig.ClientAuth < tls.VerifyClientCertIfGiven) {
+		log.Printf("WARN  %-12s %v", "embedded", "No users file, anonymous connections disabled and no TLS client certificates - no MQTT client will be able to connect")
+	}
+
+	e.server = mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(log.Writer(), &slog.HandlerOptions{Level: slog.LevelError})),
+	})
+
+	if err := e.server.AddHook(&e, nil); err != nil {
+		return nil, err
+	}
+
+	if e.TCP != "" {
+		if err := e.server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: e.TCP})); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.TLS != "" {
+		if err := e.server.AddListener(listeners.NewTCP(listeners.Config{ID: "tls", Address: e.TLS, TLSConfig: e.TLSConfig})); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.Websocket != "" {
+		if err := e.server.AddListener(listeners.NewWebsocket(listeners.Config{ID: "websocket", Address: e.Websocket, TLSConfig: e.TLSConfig})); err != nil {
+			return nil, err
+		}
+	}
+
+	return &e, nil
+}
+
+// Starts the embedded broker listeners and the bridge to the configured broker (if enabled).
+func (e *embedded) serve() error {
+	if err := e.server.Serve(); err != nil {
+		return err
+	}
+
+	for _, l := range []struct{ protocol, address string }{{"TCP", e.TCP}, {"TLS", e.TLS}, {"websocket", e.Websocket}} {
+		if l.address != "" {
+			e.log.Printf("%-5s %-12s %v", "INFO", "embedded", fmt.Sprintf("Embedded MQTT broker listening on %v (%v)", l.address, l.protocol))
+		}
+	}
+
+	if e.Bridge && len(e.bridged) > 0 {
+		e.bridge(e.bridged[0])
+	}
+
+	return nil
+}
+
+func (e *embedded) close() {
+	if e.upstream != nil {
+		e.upstream.Disconnect(250)
+	}
+
+	if err := e.server.Close(); err != nil {
+		e.log.Printf("WARN  %-12s %v", "embedded", err)
+	}
+}
+
+// ID, Provides, OnConnectAuthenticate, OnACLCheck and OnPublished implement the embedded broker
+// hook for client authentication, publish permissions and for forwarding the messages published
+// by MQTTD to the bridged broker.
+func (e *embedded) ID() string {
+	return "uhppoted-mqtt"
+}
+
+func (e *embedded) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mochi.OnConnectAuthenticate,
+		mochi.OnACLCheck,
+		mochi.OnPublished,
+	}, []byte{b})
+}
+
+func (e *embedded) OnConnectAuthenticate(cl *mochi.Client, pk packets.Packet) bool {
+	if cl.ID == embeddedClientID {
+		e.log.Printf("WARN  %-12s %v", "embedded", fmt.Errorf("%v: connection refused (reserved client ID)", cl.ID))
+		return false
+	}
+
+	if conn, ok := cl.Net.Conn.(*tls.Conn); ok && len(conn.ConnectionState().VerifiedChains) > 0 {
+		return true
+	}
+
+	username := string(pk.Connect.Username)
+	if username == "" {
+		if !e.Anonymous {
+			e.log.Printf("WARN  %-12s %v", "embedded", fmt.Errorf("%v: anonymous connection refused", cl.ID))
+		}
+
+		return e.Anonymous
+	}
+
+	if v, ok := e.users.Get(username); ok {
+		if password, ok := v.(string); ok && subtle.ConstantTimeCompare([]byte(password), pk.Connect.Password) == 1 {
+			return true
+		}
+	}
+
+	e.log.Printf("WARN  %-12s %v", "embedded", fmt.Errorf("%v: invalid username or password for '%v'", cl.ID, username))
+
+	return false
+}
+
+// Allows clients to subscribe to any topic but only to publish to the request, RPC and Home
+// Assistant door lock command topics and the configured topic filters. The broker does not
+// check the messages published by MQTTD (and the bridge), which are published in-process.
+func (e *embedded) OnACLCheck(cl *mochi.Client, topic string, write bool) bool {
+	if !write || cl.Net.Inline {
+		return true
+	}
+
+	filters := []string{e.mqttd.Topics.Requests + "/#"}
+
+	if e.mqttd.Topics.RPC != "" {
+		filters = append(filters, e.mqttd.Topics.RPC)
+	}
+
+	if ha := e.mqttd.HomeAssistant; ha.Enabled && ha.locks() {
+		filters = append(filters, ha.Topic+"/+/door/+/lock/set")
+	}
+
+	filters = append(filters, e.Publish...)
+
+	for _, filter := range filters {
+		if matches(filter, topic) {
+			return true
+		}
+	}
+
+	e.log.Printf("WARN  %-12s %v", "embedded", fmt.Errorf("%v: publish to %v refused", cl.ID, topic))
+
+	return false
+}
+
+func (e *embedded) OnPublished(cl *mochi.Client, pk packets.Packet) {
+	if e.upstream != nil && cl.Net.Inline && cl.ID == embeddedClientID && e.upstream.IsConnected() {
+		e.upstream.Publish(pk.TopicName, pk.FixedHeader.Qos, pk.FixedHeader.Retain, pk.Payload)
+	}
+}
+
+// Connects to the bridged broker and forwards the requests published to the bridged broker to
+// the embedded broker. The connection is retried (and the requests topics resubscribed) by the
+// Paho client until the embedded broker is closed.
+func (e *embedded) bridge(broker Broker) {
+	topics := []string{e.mqttd.Topics.Requests + "/#"}
+	if rpc := e.mqttd.Topics.RPC; rpc != "" && !matches(topics[0], rpc) {
+		topics = append(topics, rpc)
+	}
+
+	forward := func(client paho.Client, msg paho.Message) {
+		if err := e.server.Publish(msg.Topic(), msg.Payload(), msg.Retained(), msg.Qos()); err != nil {
+			e.log.Printf("WARN  %-12s %v", "bridge", err)
+		}
+	}
+
+	connected := func(client paho.Client) {
+		e.log.Printf("%-5s %-12s %v", "INFO", "bridge", fmt.Sprintf("Connected to %v", broker.URL))
+
+		for _, topic := range topics {
+			if token := client.Subscribe(topic, e.mqttd.Topics.RequestQoS, forward); token.Wait() && token.Error() != nil {
+				e.log.Printf("ERROR unable to subscribe to %s on %s (%v)", topic, broker.URL, token.Error())
+			}
+		}
+	}
+
+	lost := func(client paho.Client, err error) {
+		e.log.Printf("WARN  %-12s %v", "bridge", fmt.Errorf("Connection to %v lost (%v)", broker.URL, err))
+	}
+
+	options := paho.
+		NewClientOptions().
+		AddBroker(broker.URL).
+		SetClientID(e.mqttd.Connection.ClientID).
+		SetTLSConfig(broker.TLS).
+		SetCleanSession(false).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(e.mqttd.Connection.Reconnect.MaxDelay).
+		SetOnConnectHandler(connected).
+		SetConnectionLostHandler(lost)
+
+	if broker.UserName != "" {
+		options.SetUsername(broker.UserName)
+		options.SetPassword(broker.Password)
+	}
+
+	e.upstream = paho.NewClient(options)
+	e.upstream.Connect()
+}
+
+// inline implements the client interface for the MQTTD in-process connection to the embedded
+// broker. Published messages are injected into the broker as MQTT v5 messages from the inline
+// client so that the message properties are delivered to MQTT v5 subscribers.
+type inline struct {
+	server        *mochi.Server
+	client        *mochi.Client
+	options       options
+	connected     atomic.Bool
+	subscriptions map[string]int
+	sync.Mutex
+}
+
+var subscriptionID atomic.Int32
+
+func (e *embedded) client(o options) client {
+	c := inline{
+		server:        e.server,
+		client:        e.server.NewClient(nil, mochi.LocalListener, embeddedClientID, true),
+		options:       o,
+		subscriptions: map[string]int{},
+	}
+
+	c.client.Properties.ProtocolVersion = 5
+
+	return &c
+}
+
+func (c *inline) connect() error {
+	c.connected.Store(true)
+
+	go c.options.connected(c)
+
+	return nil
+}
+
+func (c *inline) disconnect(quiesce uint) {
+	c.connected.Store(false)
+
+	c.Lock()
+	defer c.Unlock()
+
+	for filter, id := range c.subscriptions {
+		c.server.Unsubscribe(filter, id)
+	}
+
+	c.subscriptions = map[string]int{}
+}
+
+func (c *inline) isConnected() bool {
+	return c.connected.Load()
+}
+
+func (c *inline) subscribe(topic string, qos byte, handler func(incoming)) error {
+	h := func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		if c.connected.Load() {
+			handler(incoming{
+				topic:   pk.TopicName,
+				payload: pk.Payload,
+				props:   fromPacket(pk.Properties),
+			})
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if id, ok := c.subscriptions[topic]; ok {
+		c.server.Unsubscribe(topic, id)
+	}
+
+	id := int(subscriptionID.Add(1))
+	if err := c.server.Subscribe(unshare(topic), id, h); err != nil {
+		return err
+	}
+
+	c.subscriptions[topic] = id
+
+	return nil
+}
+
+func (c *inline) publish(topic string, qos byte, retained bool, payload []byte, props *properties) error {
+	if !c.connected.Load() {
+		return errors.New("not connected to embedded broker")
+	}
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    qos,
+			Retain: retained,
+		},
+		TopicName: topic,
+		Payload:   payload,
+		PacketID:  uint16(qos),
+		Created:   time.Now().Unix(),
+	}
+
+	if props != nil {
+		pk.Properties.ResponseTopic = props.ResponseTopic
+		pk.Properties.CorrelationData = props.CorrelationData
+		pk.Properties.ContentType = props.ContentType
+
+		for _, k := range props.User.keys() {
+			pk.Properties.User = append(pk.Properties.User, packets.UserProperty{Key: k, Val: props.User[k]})
+		}
+	}
+
+	return c.server.InjectPacket(c.client, pk)
+}
+
+// Returns the MQTT v5 message properties of a received message (nil if none).
+func fromPacket(p packets.Properties) *properties {
+	if p.ResponseTopic == "" && p.CorrelationData == nil && p.ContentType == "" && len(p.User) == 0 {
+		return nil
+	}
+
+	props := properties{
+		ResponseTopic:   p.ResponseTopic,
+		CorrelationData: p.CorrelationData,
+		ContentType:     p.ContentType,
+		User:            userProperties{},
+	}
+
+	for _, u := range p.User {
+		props.User[u.Key] = u.Val
+	}
+
+	return &props
+}
@@ -0,0 +1,170 @@
+package mqtt
+
+import (
+	"io"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/uhppoted/uhppoted-lib/kvs"
+)
+
+func TestEmbeddedClient(t *testing.T) {
+	mqttd := MQTTD{
+		Embedded: Embedded{Enabled: true, TCP: "127.0.0.1:0"},
+	}
+
+	e, err := newEmbedded(&mqttd, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("Unexpected error creating embedded broker (%v)", err)
+	}
+
+	defer e.close()
+
+	connected := make(chan client, 1)
+	c := e.client(options{connected: func(c client) { connected <- c }})
+
+	if err := c.connect(); err != nil {
+		t.Fatalf("Unexpected error connecting to embedded broker (%v)", err)
+	}
+
+	<-connected
+
+	received := make(chan incoming, 1)
+	if err := c.subscribe("uhppoted/gateway/replies/#", 1, func(msg incoming) { received <- msg }); err != nil {
+		t.Fatalf("Unexpected error subscribing (%v)", err)
+	}
+
+	props := properties{
+		ResponseTopic:   "uhppoted/gateway/replies/QWERTY",
+		CorrelationData: []byte("AH173635G3"),
+		ContentType:     "application/json",
+		User:            userProperties{"client-id": "QWERTY"},
+	}
+
+	if err := c.publish("uhppoted/gateway/replies/QWERTY", 1, false, []byte(`{"reply":{}}`), &props); err != nil {
+		t.Fatalf("Unexpected error publishing (%v)", err)
+	}
+
+	select {
+	case msg := <-received:
+		if msg.topic != "uhppoted/gateway/replies/QWERTY" || string(msg.payload) != `{"reply":{}}` {
+			t.Errorf("Incorrect message - expected:%v %v, got:%v %s", "uhppoted/gateway/replies/QWERTY", `{"reply":{}}`, msg.topic, msg.payload)
+		}
+
+		if !reflect.DeepEqual(msg.props, &props) {
+			t.Errorf("Incorrect message properties\n   expected:%+v\n   got:     %+v", &props, msg.props)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting for published message")
+	}
+
+	c.disconnect(0)
+
+	if err := c.publish("uhppoted/gateway/replies/QWERTY", 1, false, []byte(`{}`), nil); err == nil {
+		t.Errorf("Expected error publishing to disconnected embedded client")
+	}
+}
+
+func TestEmbeddedAuthenticate(t *testing.T) {
+	e := embedded{
+		users: kvs.NewKeyValueStore("embedded:users", func(v string) (interface{}, error) { return v, nil }),
+		log:   log.New(io.Discard, "", 0),
+	}
+
+	e.users.Put("alice", "s3cret")
+
+	tests := []struct {
+		username  string
+		password  string
+		anonymous bool
+		expected  bool
+	}{
+		{"alice", "s3cret", false, true},
+		{"alice", "secret", false, false},
+		{"bob", "s3cret", false, false},
+		{"", "", false, false},
+		{"", "", true, true},
+		{"bob", "", true, false},
+	}
+
+	if e.OnConnectAuthenticate(&mochi.Client{ID: embeddedClientID}, packets.Packet{}) {
+		t.Errorf("Connection with reserved client ID %v incorrectly authenticated", embeddedClientID)
+	}
+
+	for _, v := range tests {
+		e.Anonymous = v.anonymous
+
+		pk := packets.Packet{}
+		pk.Connect.Username = []byte(v.username)
+		pk.Connect.Password = []byte(v.password)
+
+		if ok := e.OnConnectAuthenticate(&mochi.Client{ID: "test"}, pk); ok != v.expected {
+			t.Errorf("%v/%v (anonymous:%v): incorrectly authenticated - expected:%v, got:%v", v.username, v.password, v.anonymous, v.expected, ok)
+		}
+	}
+}
+
+func TestEmbeddedACL(t *testing.T) {
+	e := embedded{
+		Embedded: Embedded{
+			Publish: []string{"homeassistant/status"},
+		},
+		mqttd: &MQTTD{
+			Topics: Topics{
+				Requests: "uhppoted/gateway/requests",
+				Replies:  "uhppoted/gateway/replies",
+				Events:   "uhppoted/gateway/events",
+				System:   "uhppoted/gateway/system",
+				Status:   "uhppoted/gateway/system/uhppoted/status",
+				RPC:      "uhppoted/gateway/rpc",
+			},
+			HomeAssistant: HomeAssistant{
+				Enabled: true,
+				Topic:   "uhppoted/gateway/homeassistant",
+				Locks:   true,
+				Card:    8165538,
+				Code:    "8E5B3K",
+			},
+		},
+		log: log.New(io.Discard, "", 0),
+	}
+
+	client := &mochi.Client{ID: "QWERTY"}
+	mqttd := &mochi.Client{ID: embeddedClientID}
+	mqttd.Net.Inline = true
+
+	tests := []struct {
+		client   *mochi.Client
+		topic    string
+		write    bool
+		expected bool
+	}{
+		{client, "uhppoted/gateway/requests/device:get", true, true},
+		{client, "uhppoted/gateway/requests/device/405419896/door/3/lock:open", true, true},
+		{client, "uhppoted/gateway/rpc", true, true},
+		{client, "uhppoted/gateway/homeassistant/405419896/door/1/lock/set", true, true},
+		{client, "homeassistant/status", true, true},
+		{client, "uhppoted/gateway/replies/QWERTY", true, false},
+		{client, "uhppoted/gateway/events", true, false},
+		{client, "uhppoted/gateway/system", true, false},
+		{client, "uhppoted/gateway/system/uhppoted/status", true, false},
+		{client, "uhppoted/gateway/homeassistant/405419896/door/1/lock", true, false},
+		{client, "uhppoted/gateway/replies/QWERTY", false, true},
+		{client, "uhppoted/gateway/events", false, true},
+		{mqttd, "uhppoted/gateway/replies/QWERTY", true, true},
+		{mqttd, "uhppoted/gateway/system/uhppoted/status", true, true},
+		{&mochi.Client{ID: embeddedClientID}, "uhppoted/gateway/replies/QWERTY", true, false},
+	}
+
+	for _, v := range tests {
+		if ok := e.OnACLCheck(v.client, v.topic, v.write); ok != v.expected {
+			t.Errorf("%v %v (write:%v): incorrect ACL check - expected:%v, got:%v", v.client.ID, v.topic, v.write, v.expected, ok)
+		}
+	}
+}
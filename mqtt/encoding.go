@@ -0,0 +1,350 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Encoding holds the payload encoding settings. Requests may be encoded as JSON, CBOR or
+// MessagePack and the reply is encoded the same as the request unless the request has an
+// 'encoding' field or the client has a configured reply encoding (Clients, keyed by client ID).
+// JSON-RPC requests, events and system messages are always JSON.
+type Encoding struct {
+	Clients map[string]string
+}
+
+type encoding int
+
+const (
+	encJSON encoding = iota
+	encCBOR
+	encMsgPack
+)
+
+func (e encoding) String() string {
+	switch e {
+	case encCBOR:
+		return "cbor"
+	case encMsgPack:
+		return "msgpack"
+	default:
+		return "json"
+	}
+}
+
+// Returns the MQTT v5 content type for the encoding.
+func (e encoding) contentType() string {
+	switch e {
+	case encCBOR:
+		return "application/cbor"
+	case encMsgPack:
+		return "application/msgpack"
+	default:
+		return "application/json"
+	}
+}
+
+var cborEncoder = func() cbor.EncMode {
+	mode, err := cbor.CoreDetEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+
+	return mode
+}()
+
+var cborDecoder = func() cbor.DecMode {
+	mode, err := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+
+	return mode
+}()
+
+// Parses an encoding name (json, cbor, msgpack) or MQTT v5 content type.
+func parseEncoding(s string) (encoding, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "json", "application/json":
+		return encJSON, nil
+
+	case "cbor", "application/cbor":
+		return encCBOR, nil
+
+	case "msgpack", "messagepack", "application/msgpack", "application/x-msgpack", "application/vnd.msgpack":
+		return encMsgPack, nil
+	}
+
+	return encJSON, fmt.Errorf("invalid encoding '%v'", s)
+}
+
+// Identifies the encoding of a message from the first byte of the payload. The messages are all
+// maps so the first byte is unambiguous: '{' for JSON, 0xa0-0xbb or 0xbf for a CBOR map and
+// 0x80-0x8f, 0xde or 0xdf for a MessagePack map.
+func sniff(payload []byte) encoding {
+	for _, b := range payload {
+		switch {
+		case b == ' ' || b == '\t' || b == '\r' || b == '\n':
+			continue
+
+		case (b >= 0xa0 && b <= 0xbb) || b == 0xbf:
+			return encCBOR
+
+		case (b >= 0x80 && b <= 0x8f) || b == 0xde || b == 0xdf:
+			return encMsgPack
+		}
+
+		break
+	}
+
+	return encJSON
+}
+
+// Returns the reply encoding for a request: the request 'encoding' field if present, otherwise
+// the configured client encoding (if any), otherwise the encoding of the request.
+func (e Encoding) reply(clientID *string, field *string, request encoding) (encoding, error) {
+	if field != nil {
+		return parseEncoding(*field)
+	}
+
+	if clientID != nil {
+		if s, ok := e.Clients[*clientID]; ok {
+			return parseEncoding(s)
+		}
+	}
+
+	return request, nil
+}
+
+// Returns the payload encoding for a message from the MQTT v5 content type property (which is
+// set for replies to CBOR and MessagePack requests).
+func (p *properties) encoding() encoding {
+	if p != nil && p.ContentType != "" {
+		if e, err := parseEncoding(p.ContentType); err == nil {
+			return e
+		}
+	}
+
+	return encJSON
+}
+
+// Encodes a value as JSON, CBOR or MessagePack. CBOR and MessagePack values are transcoded
+// from the JSON encoding so that the field names and formats (dates, etc.) are the same for
+// all encodings.
+func (e encoding) marshal(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil || e == encJSON {
+		return b, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	return e.encode(numbers(generic))
+}
+
+// Encodes a generic value (maps, slices, strings, numbers, byte strings) as CBOR or MessagePack.
+func (e encoding) encode(v interface{}) ([]byte, error) {
+	switch e {
+	case encCBOR:
+		return cborEncoder.Marshal(v)
+
+	case encMsgPack:
+		var b bytes.Buffer
+
+		encoder := msgpack.NewEncoder(&b)
+		encoder.SetSortMapKeys(true)
+		encoder.SetCustomStructTag("json")
+
+		if err := encoder.Encode(v); err != nil {
+			return nil, err
+		}
+
+		return b.Bytes(), nil
+
+	default:
+		return json.Marshal(v)
+	}
+}
+
+// Decodes a CBOR or MessagePack value. Struct fields are matched using the 'json' tags.
+func (e encoding) unmarshal(b []byte, v interface{}) error {
+	switch e {
+	case encCBOR:
+		return cborDecoder.Unmarshal(b, v)
+
+	case encMsgPack:
+		decoder := msgpack.NewDecoder(bytes.NewReader(b))
+		decoder.SetCustomStructTag("json")
+
+		return decoder.Decode(v)
+
+	default:
+		return json.Unmarshal(b, v)
+	}
+}
+
+// Transcodes a CBOR or MessagePack request to JSON for the request handlers.
+func (e encoding) toJSON(b []byte) ([]byte, error) {
+	if e == encJSON {
+		return b, nil
+	}
+
+	var v interface{}
+	if err := e.unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+
+	if _, ok := v.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("invalid %v request (expected map)", e)
+	}
+
+	return json.Marshal(v)
+}
+
+// Replaces the json.Number values in a decoded JSON value with int64, uint64 or float64 values.
+func numbers(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(vv.String(), 10, 64); err == nil {
+			return i
+		} else if u, err := strconv.ParseUint(vv.String(), 10, 64); err == nil {
+			return u
+		} else if f, err := vv.Float64(); err == nil {
+			return f
+		}
+
+		return vv.String()
+
+	case map[string]interface{}:
+		for k, value := range vv {
+			vv[k] = numbers(value)
+		}
+
+	case []interface{}:
+		for i, value := range vv {
+			vv[i] = numbers(value)
+		}
+	}
+
+	return v
+}
+
+// Unwraps a CBOR or MessagePack request. The envelope is the same as for JSON except that the
+// 'message' and 'request' fields are byte strings holding the encoded message and request (or
+// the raw ciphertext for an encrypted request). The HMAC is calculated over the 'message' bytes
+// and the signature over the (decrypted) 'request' bytes, the same as for a JSON request.
+func (mqttd *MQTTD) unwrapBinary(payload []byte, enc encoding) (*request, error) {
+	message := struct {
+		Message []byte  `json:"message"`
+		HMAC    *string `json:"hmac"`
+	}{}
+
+	if err := enc.unmarshal(payload, &message); err != nil {
+		return nil, badRequest(nil, fmt.Errorf("Error unmarshaling %v message (%v)", enc, err))
+	}
+
+	if err := mqttd.verify(message.Message, message.HMAC); err != nil {
+		return nil, unauthenticated(nil, fmt.Errorf("Invalid message (%v)", err))
+	}
+
+	body := struct {
+		Signature *string `json:"signature"`
+		Key       *string `json:"key"`
+		IV        string  `json:"iv"`
+		Request   []byte  `json:"request"`
+	}{}
+
+	if err := enc.unmarshal(message.Message, &body); err != nil {
+		return nil, badRequest(nil, fmt.Errorf("Error unmarshaling %v message body (%v)", enc, err))
+	}
+
+	signed := body.Request
+
+	if body.Key != nil {
+		plaintext, err := mqttd.unseal(body.Request, body.IV, *body.Key)
+		if err != nil || plaintext == nil {
+			return nil, unauthenticated(nil, fmt.Errorf("Error decrypting message (%v::%v)", err, plaintext))
+		}
+
+		signed = plaintext
+	}
+
+	request, err := enc.toJSON(signed)
+	if err != nil {
+		return nil, badRequest(nil, fmt.Errorf("Error unmarshaling %v request (%v)", enc, err))
+	}
+
+	rq, err := mqttd.authenticated(enc, signed, request, body.Signature)
+	if err != nil {
+		var r *refused
+		if errors.As(err, &r) && r.rq != nil {
+			r.rq.Encoding = enc
+		}
+
+		return nil, err
+	}
+
+	return rq, nil
+}
+
+// Wraps (signs and encrypts) a CBOR or MessagePack message, using the same envelope as
+// unwrapBinary.
+func (mqttd *MQTTD) wrapBinary(enc encoding, msgtype msgType, content interface{}, destID *string) ([]byte, error) {
+	b, err := enc.marshal(content)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := mqttd.sign(b)
+	if err != nil {
+		return nil, err
+	}
+
+	body, key, err := mqttd.seal(b, destID, msgtype)
+	if err != nil {
+		return nil, err
+	}
+
+	message := map[string]interface{}{
+		msgtype.String(): body,
+	}
+
+	if len(signature) > 0 {
+		message["signature"] = base64.StdEncoding.EncodeToString(signature)
+	}
+
+	if len(key) > 0 {
+		message["key"] = base64.StdEncoding.EncodeToString(key)
+	}
+
+	b, err = enc.encode(message)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := map[string]interface{}{
+		"message": b,
+	}
+
+	if mac := mqttd.HMAC.MAC(b); len(mac) > 0 {
+		payload["hmac"] = hex.EncodeToString(mac)
+	}
+
+	return enc.encode(payload)
+}
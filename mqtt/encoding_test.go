@@ -0,0 +1,143 @@
+package mqtt
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/uhppoted/uhppoted-mqtt/auth"
+)
+
+func TestSniff(t *testing.T) {
+	tests := []struct {
+		payload  []byte
+		expected encoding
+	}{
+		{[]byte(`{"message":{}}`), encJSON},
+		{[]byte("\n  {\"message\":{}}"), encJSON},
+		{[]byte{0xa2, 0x67}, encCBOR},
+		{[]byte{0xb9, 0x00, 0x20}, encCBOR},
+		{[]byte{0x82, 0xa7}, encMsgPack},
+		{[]byte{0xde, 0x00, 0x20}, encMsgPack},
+		{[]byte{}, encJSON},
+	}
+
+	for _, v := range tests {
+		if enc := sniff(v.payload); enc != v.expected {
+			t.Errorf("Incorrect encoding for %x - expected:%v, got:%v", v.payload, v.expected, enc)
+		}
+	}
+}
+
+func TestUnwrapBinary(t *testing.T) {
+	hmac, _ := auth.NewHMAC(true, "secret")
+	mqttd := MQTTD{
+		Authentication: "NONE",
+		HMAC:           *hmac,
+		Encoding: Encoding{
+			Clients: map[string]string{"UIOP": "json"},
+		},
+	}
+
+	tests := []struct {
+		enc      encoding
+		request  map[string]interface{}
+		expected encoding
+	}{
+		{encCBOR, map[string]interface{}{"client-id": "QWERTY", "device-id": 405419896, "door": 3}, encCBOR},
+		{encMsgPack, map[string]interface{}{"client-id": "QWERTY", "device-id": 405419896, "door": 3}, encMsgPack},
+		{encCBOR, map[string]interface{}{"client-id": "QWERTY", "device-id": 405419896, "door": 3, "encoding": "msgpack"}, encMsgPack},
+		{encMsgPack, map[string]interface{}{"client-id": "UIOP", "device-id": 405419896, "door": 3}, encJSON},
+	}
+
+	for _, v := range tests {
+		request, _ := v.enc.encode(v.request)
+		message, _ := v.enc.encode(map[string]interface{}{"request": request})
+		payload, _ := v.enc.encode(map[string]interface{}{
+			"message": message,
+			"hmac":    hex.EncodeToString(hmac.MAC(message)),
+		})
+
+		rq, err := mqttd.unwrap(payload)
+		if err != nil {
+			t.Fatalf("%v: unexpected error unwrapping request (%v)", v.enc, err)
+		}
+
+		body := struct {
+			DeviceID uint32 `json:"device-id"`
+			Door     uint8  `json:"door"`
+		}{}
+
+		if err := json.Unmarshal(rq.Request, &body); err != nil {
+			t.Errorf("%v: request not transcoded to JSON (%v)", v.enc, err)
+		} else if body.DeviceID != 405419896 || body.Door != 3 {
+			t.Errorf("%v: incorrectly transcoded request %s", v.enc, rq.Request)
+		}
+
+		if rq.Encoding != v.expected {
+			t.Errorf("%v: incorrect reply encoding - expected:%v, got:%v", v.enc, v.expected, rq.Encoding)
+		}
+	}
+}
+
+func TestWrapBinary(t *testing.T) {
+	hmac, _ := auth.NewHMAC(true, "secret")
+	mqttd := MQTTD{HMAC: *hmac}
+
+	content := map[string]interface{}{
+		"server-id": "uhppoted",
+		"response": map[string]interface{}{
+			"device-id": uint32(405419896),
+			"door":      3,
+			"delay":     7.5,
+		},
+	}
+
+	for _, enc := range []encoding{encCBOR, encMsgPack} {
+		payload, err := mqttd.wrapBinary(enc, msgReply, content, nil)
+		if err != nil {
+			t.Fatalf("%v: unexpected error wrapping reply (%v)", enc, err)
+		}
+
+		message := struct {
+			Message []byte `json:"message"`
+			HMAC    string `json:"hmac"`
+		}{}
+
+		if err := enc.unmarshal(payload, &message); err != nil {
+			t.Fatalf("%v: error unmarshaling reply (%v)", enc, err)
+		}
+
+		if mac, _ := hex.DecodeString(message.HMAC); !hmac.Verify(message.Message, mac) {
+			t.Errorf("%v: invalid HMAC", enc)
+		}
+
+		body := struct {
+			Reply []byte `json:"reply"`
+		}{}
+
+		if err := enc.unmarshal(message.Message, &body); err != nil {
+			t.Fatalf("%v: error unmarshaling reply body (%v)", enc, err)
+		}
+
+		var reply interface{}
+		if err := enc.unmarshal(body.Reply, &reply); err != nil {
+			t.Fatalf("%v: error unmarshaling reply content (%v)", enc, err)
+		}
+
+		if b, _ := json.Marshal(reply); !reflect.DeepEqual(normalise(reply), normalise(content)) {
+			t.Errorf("%v: incorrect reply content\n   expected:%v\n   got:     %s", enc, content, b)
+		}
+	}
+}
+
+// Normalises the decoded integer types (CBOR and MessagePack decode to the smallest type).
+func normalise(v interface{}) interface{} {
+	b, _ := json.Marshal(v)
+
+	var w interface{}
+	json.Unmarshal(b, &w)
+
+	return w
+}
@@ -0,0 +1,177 @@
+package mqtt
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Connects to the first available broker (in order of preference), retrying according to the
+// reconnect policy until connected or the MQTTD is closed.
+func (m *MQTTD) connect(newClient func(Broker) client, log *log.Logger) {
+	if m.try(newClient, log) {
+		return
+	}
+
+	m.retry(newClient, log)
+}
+
+// Reconnects to the first available broker after the connection has been lost, retrying
+// according to the reconnect policy until connected or the MQTTD is closed.
+func (m *MQTTD) reconnect(newClient func(Broker) client, log *log.Logger) {
+	m.retry(newClient, log)
+}
+
+func (m *MQTTD) retry(newClient func(Broker) client, log *log.Logger) {
+	for retry := 0; ; retry++ {
+		delay := m.Connection.Reconnect.delay(retry)
+
+		select {
+		case <-m.closed:
+			return
+		case <-time.After(delay):
+		}
+
+		attempts := m.attempts.Add(1)
+
+		log.Printf("INFO  %-12s %v", "mqttd", fmt.Sprintf("Retrying connection to MQTT broker (attempt %v, delay %v)", attempts, delay))
+
+		if m.try(newClient, log) {
+			return
+		}
+	}
+}
+
+// Tries each broker in order of preference. Returns true if a connection was established or the
+// MQTTD has been closed i.e. if no further retries are required.
+func (m *MQTTD) try(newClient func(Broker) client, log *log.Logger) bool {
+	for i, broker := range m.Connection.Brokers {
+		select {
+		case <-m.closed:
+			return true
+		default:
+		}
+
+		c := newClient(broker)
+		if err := c.connect(); err != nil {
+			log.Printf("WARN  %-12s %v", "mqttd", fmt.Errorf("Error connecting to %v (%v)", broker.URL, err))
+			continue
+		}
+
+		m.switchTo(c, i, newClient, log)
+		return true
+	}
+
+	return false
+}
+
+// Makes the client the active connection, closing the previously active client (if any) and
+// reporting a broker switch as a system event. Publishes any queued messages and starts a
+// background 'failback' task if the client is not connected to the preferred broker.
+func (m *MQTTD) switchTo(c client, broker int, newClient func(Broker) client, log *log.Logger) {
+	m.guard.Lock()
+	previous := m.broker
+	old := m.client
+	m.client = c
+	m.broker = broker
+	m.guard.Unlock()
+
+	if old != nil && old != c {
+		if err := m.publishStatus(old, offline); err != nil {
+			log.Printf("WARN  %-12s %v", "mqttd", err)
+		}
+
+		old.disconnect(250)
+	}
+
+	if previous >= 0 && previous != broker {
+		from := m.Connection.Brokers[previous].URL
+		to := m.Connection.Brokers[broker].URL
+		reason := "failover"
+		if broker < previous {
+			reason = "failback"
+		}
+
+		log.Printf("WARN  %-12s %v", "mqttd", fmt.Sprintf("Switched MQTT broker from %v to %v (%v)", from, to, reason))
+
+		event := struct {
+			Broker struct {
+				Previous string `json:"previous"`
+				Current  string `json:"current"`
+				Reason   string `json:"reason"`
+			} `json:"broker"`
+		}{
+			Broker: struct {
+				Previous string `json:"previous"`
+				Current  string `json:"current"`
+				Reason   string `json:"reason"`
+			}{
+				Previous: from,
+				Current:  to,
+				Reason:   reason,
+			},
+		}
+
+		if err := m.send(&m.Encryption.SystemKeyID, m.Topics.System, nil, event, msgSystem, false); err != nil {
+			log.Printf("WARN  %-12s %v", "mqttd", err)
+		}
+	}
+
+	go m.drain()
+
+	if broker > 0 {
+		go m.failback(c, newClient, log)
+	}
+}
+
+// Periodically retries the preferred broker while connected to a failover broker, switching
+// back to the preferred broker once it is available again.
+func (m *MQTTD) failback(c client, newClient func(Broker) client, log *log.Logger) {
+	interval := m.Connection.Failback
+	if interval <= 0 {
+		interval = 60 * time.Second
+	}
+
+	for {
+		select {
+		case <-m.closed:
+			return
+		case <-time.After(interval):
+		}
+
+		if m.current() != c {
+			return
+		}
+
+		preferred := newClient(m.Connection.Brokers[0])
+		if err := preferred.connect(); err != nil {
+			log.Printf("INFO  %-12s %v", "mqttd", fmt.Sprintf("Preferred MQTT broker %v not available (%v)", m.Connection.Brokers[0].URL, err))
+			continue
+		}
+
+		m.switchTo(preferred, 0, newClient, log)
+		return
+	}
+}
+
+// Clears the active connection if it is the client that lost the connection. Returns false
+// if the client is not the active connection (e.g. a superseded failover connection).
+func (m *MQTTD) lost(c client) bool {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+
+	if m.client != c {
+		return false
+	}
+
+	m.client = nil
+
+	return true
+}
+
+func (m *MQTTD) current() client {
+	m.guard.RLock()
+	defer m.guard.RUnlock()
+
+	return m.client
+}
@@ -0,0 +1,591 @@
+package mqtt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+
+	"github.com/uhppoted/uhppote-core/types"
+	"github.com/uhppoted/uhppote-core/uhppote"
+
+	lib "github.com/uhppoted/uhppoted-mqtt/auth"
+	"github.com/uhppoted/uhppoted-mqtt/simulator"
+)
+
+// harness runs MQTTD end-to-end against an in-process MQTT broker and simulated controllers,
+// with a test client that sends signed, encrypted and HMAC'd requests and decrypts and
+// verifies the replies and events.
+type harness struct {
+	t         *testing.T
+	dir       string
+	mqttd     *MQTTD
+	simulator *simulator.Simulator
+	broker    *mochi.Server
+	client    paho.Client
+	keys      *lib.RSA
+	hmac      *lib.HMAC
+	replies   chan message
+	events    chan message
+	requestID int
+	nonces    map[string]uint64
+	log       *log.Logger
+	sync.Mutex
+}
+
+// message is a received reply, error, event or system message after the HMAC has been
+// verified, the content decrypted and the signature validated.
+type message struct {
+	topic string
+	kind  string
+	body  map[string]any
+	err   error
+}
+
+const (
+	harnessServerID = "uhppoted"
+	harnessRoot     = "uhppoted/gateway"
+	harnessHMAC     = "integration-secret"
+	harnessTimeout  = 5 * time.Second
+)
+
+var harnessDevices = []uhppote.Device{
+	*uhppote.NewDevice("Alpha", 405419896, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 100), Port: 60000}, []string{"Front Door", "Side Door", "Garage", "Workshop"}),
+	*uhppote.NewDevice("Beta", 303986753, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 101), Port: 60000}, []string{"Lobby", "Gym", "Pool", "Sauna"}),
+}
+
+// Permissions for the 'alice' (unrestricted) and 'bob' (restricted) test clients.
+const (
+	harnessUsers = `alice  admin
+bob    visitors
+`
+	harnessGroups = `admin     *:*
+visitors  devices:get, device:get, status:get, time-profile:get, lock:open@303986753
+`
+)
+
+// Starts an in-process MQTT broker, MQTTD with simulated controllers and the test client.
+// Everything is shut down when the test completes.
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+
+	dir := t.TempDir()
+	h := harness{
+		t:       t,
+		dir:     dir,
+		replies: make(chan message, 64),
+		events:  make(chan message, 64),
+		nonces:  map[string]uint64{},
+		log:     log.New(io.Discard, "", 0),
+	}
+
+	if testing.Verbose() {
+		h.log = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	server, client := h.genkeys()
+	address := h.serve()
+
+	rsa, err := lib.NewRSA(server, h.log)
+	if err != nil {
+		t.Fatalf("Error loading server keys (%v)", err)
+	}
+
+	if h.keys, err = lib.NewRSA(client, h.log); err != nil {
+		t.Fatalf("Error loading client keys (%v)", err)
+	}
+
+	if h.hmac, err = lib.NewHMAC(true, harnessHMAC); err != nil {
+		t.Fatalf("Error creating HMAC (%v)", err)
+	}
+
+	nonce, err := lib.NewNonce(true, h.write("mqttd.nonce", ""), h.write("mqttd.nonce.counters", ""), h.log)
+	if err != nil {
+		t.Fatalf("Error creating nonce store (%v)", err)
+	}
+
+	users := h.write("users", harnessUsers)
+	groups := h.write("groups", harnessGroups)
+	permissions, err := lib.NewPermissions(true, users, groups, h.log)
+	if err != nil {
+		t.Fatalf("Error loading permissions (%v)", err)
+	}
+
+	h.mqttd = &MQTTD{
+		ServerID: harnessServerID,
+		Connection: Connection{
+			Brokers:  []Broker{{URL: "tcp://" + address}},
+			ClientID: "uhppoted-mqttd",
+		},
+		Topics: Topics{
+			Requests:   harnessRoot + "/requests",
+			RPC:        harnessRoot + "/rpc",
+			Replies:    harnessRoot + "/replies",
+			Events:     harnessRoot + "/events",
+			System:     harnessRoot + "/system",
+			Status:     harnessRoot + "/status",
+			RequestQoS: 1,
+			ReplyQoS:   QoS{QoS: 1},
+			EventQoS:   QoS{QoS: 1},
+			SystemQoS:  QoS{QoS: 1},
+		},
+		Alerts: Alerts{QOS: 1},
+		HMAC:   *h.hmac,
+		Encryption: Encryption{
+			SignOutgoing:    true,
+			EncryptOutgoing: true,
+			EventsKeyID:     "events",
+			SystemKeyID:     "system",
+			RSA:             rsa,
+			Nonce:           *nonce,
+		},
+		Authentication: "RSA",
+		Permissions:    *permissions,
+		Cache:          Cache{Size: 64, TTL: time.Minute},
+		EventMap:       filepath.Join(dir, "events.map"),
+	}
+
+	listen := types.ListenAddr(net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 60001})
+	h.simulator = simulator.NewSimulator(harnessDevices, listen, 0)
+
+	if err := h.mqttd.Run(h.simulator, harnessDevices, []string{"8165538"}, h.log); err != nil {
+		t.Fatalf("Error starting MQTTD (%v)", err)
+	}
+
+	h.connect(address)
+
+	t.Cleanup(func() {
+		h.client.Disconnect(250)
+		h.mqttd.Close(h.log)
+		h.broker.Close()
+	})
+
+	h.ready()
+
+	return &h
+}
+
+// Generates the server and client RSA keys and writes them to the server and client key
+// directories, using the same layout as the MQTTD key directory. The client key directory
+// holds the client private key as 'mqttd.key' and the server public keys as 'uhppoted.pub'
+// so that the client can use auth.RSA to sign and encrypt requests and to decrypt and
+// validate replies.
+func (h *harness) genkeys() (string, string) {
+	server := h.genkey()
+	client := h.genkey()
+
+	serverdir := filepath.Join(h.dir, "server")
+	clientdir := filepath.Join(h.dir, "client")
+
+	for _, d := range []string{"signing", "encryption"} {
+		h.writeKey(filepath.Join(serverdir, d, "mqttd.key"), server)
+		h.writeKey(filepath.Join(clientdir, d, "mqttd.key"), client)
+		h.writePublicKey(filepath.Join(clientdir, d, harnessServerID+".pub"), &server.PublicKey)
+
+		for _, id := range []string{"alice", "bob"} {
+			h.writePublicKey(filepath.Join(serverdir, d, id+".pub"), &client.PublicKey)
+		}
+	}
+
+	// ... ACL files are signed by (and verified against) 'uhppoted'
+	h.writePublicKey(filepath.Join(serverdir, "signing", harnessServerID+".pub"), &server.PublicKey)
+
+	// ... events and system messages are encrypted for the client
+	h.writePublicKey(filepath.Join(serverdir, "encryption", "events.pub"), &client.PublicKey)
+	h.writePublicKey(filepath.Join(serverdir, "encryption", "system.pub"), &client.PublicKey)
+
+	return serverdir, clientdir
+}
+
+func (h *harness) genkey() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		h.t.Fatalf("Error generating RSA key (%v)", err)
+	}
+
+	return key
+}
+
+func (h *harness) writeKey(file string, key *rsa.PrivateKey) {
+	bytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		h.t.Fatalf("Error encoding RSA private key (%v)", err)
+	}
+
+	h.writePEM(file, "PRIVATE KEY", bytes)
+}
+
+func (h *harness) writePublicKey(file string, key *rsa.PublicKey) {
+	bytes, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		h.t.Fatalf("Error encoding RSA public key (%v)", err)
+	}
+
+	h.writePEM(file, "PUBLIC KEY", bytes)
+}
+
+func (h *harness) writePEM(file, blocktype string, bytes []byte) {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		h.t.Fatalf("Error creating key directory (%v)", err)
+	}
+
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blocktype, Bytes: bytes}), 0600); err != nil {
+		h.t.Fatalf("Error writing %v (%v)", file, err)
+	}
+}
+
+func (h *harness) write(file, content string) string {
+	path := filepath.Join(h.dir, file)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		h.t.Fatalf("Error writing %v (%v)", path, err)
+	}
+
+	return path
+}
+
+// Starts an in-process MQTT broker on a free localhost port, returning the broker address.
+func (h *harness) serve() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		h.t.Fatalf("Error allocating broker port (%v)", err)
+	}
+
+	address := l.Addr().String()
+	l.Close()
+
+	h.broker = mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(h.log.Writer(), &slog.HandlerOptions{Level: slog.LevelError})),
+	})
+
+	if err := h.broker.AddHook(new(auth.AllowHook), nil); err != nil {
+		h.t.Fatalf("Error adding broker auth hook (%v)", err)
+	}
+
+	if err := h.broker.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: address})); err != nil {
+		h.t.Fatalf("Error adding broker listener (%v)", err)
+	}
+
+	if err := h.broker.Serve(); err != nil {
+		h.t.Fatalf("Error starting broker (%v)", err)
+	}
+
+	return address
+}
+
+// Connects the test client to the broker and subscribes to the reply and event topics.
+func (h *harness) connect(address string) {
+	options := paho.NewClientOptions().
+		AddBroker("tcp://" + address).
+		SetClientID("uhppoted-integration").
+		SetOrderMatters(false)
+
+	h.client = paho.NewClient(options)
+
+	h.await(h.client.Connect(), "connecting test client")
+
+	for topic, ch := range map[string]chan message{
+		h.mqttd.Topics.Replies + "/#": h.replies,
+		h.mqttd.Topics.Events:         h.events,
+	} {
+		handler := func(_ paho.Client, msg paho.Message) {
+			ch <- h.open(msg.Topic(), msg.Payload())
+		}
+
+		h.await(h.client.Subscribe(topic, 1, handler), "subscribing to "+topic)
+	}
+}
+
+// Waits for MQTTD to subscribe to the request topic, retrying a 'get-devices' request until
+// it is answered.
+func (h *harness) ready() {
+	deadline := time.Now().Add(harnessTimeout)
+
+	for time.Now().Before(deadline) {
+		rq := h.request("alice", nil)
+		h.publish("devices:get", h.wrap(rq))
+
+		if _, ok := h.wait(rq["request-id"].(string), 250*time.Millisecond); ok {
+			return
+		}
+	}
+
+	h.t.Fatalf("Timeout waiting for MQTTD to subscribe to %v", h.mqttd.Topics.Requests)
+}
+
+// Returns a request with the client ID, a unique request ID and the next client nonce.
+func (h *harness) request(clientID string, fields map[string]any) map[string]any {
+	h.Lock()
+	defer h.Unlock()
+
+	h.requestID++
+	h.nonces[clientID]++
+
+	rq := map[string]any{
+		"client-id":  clientID,
+		"request-id": fmt.Sprintf("IT%05d", h.requestID),
+		"nonce":      h.nonces[clientID],
+	}
+
+	for k, v := range fields {
+		rq[k] = v
+	}
+
+	return rq
+}
+
+// Signs, encrypts and HMACs a request.
+func (h *harness) wrap(rq any) []byte {
+	plaintext := h.marshal(rq)
+
+	signature, err := h.keys.Sign(plaintext)
+	if err != nil {
+		h.t.Fatalf("Error signing request (%v)", err)
+	}
+
+	ciphertext, key, err := h.keys.Encrypt(plaintext, harnessServerID, "request")
+	if err != nil {
+		h.t.Fatalf("Error encrypting request (%v)", err)
+	}
+
+	return h.envelope(map[string]any{
+		"signature": base64.StdEncoding.EncodeToString(signature),
+		"key":       base64.StdEncoding.EncodeToString(key),
+		"iv":        hex.EncodeToString(ciphertext[:16]),
+		"request":   base64.StdEncoding.EncodeToString(ciphertext[16:]),
+	}, nil)
+}
+
+// Returns the message wrapped in the HMAC'd outer envelope. The HMAC is calculated from the
+// message if mac is nil.
+func (h *harness) envelope(msg map[string]any, mac []byte) []byte {
+	bytes := h.marshal(msg)
+	if mac == nil {
+		mac = h.hmac.MAC(bytes)
+	}
+
+	return h.marshal(map[string]any{
+		"message": json.RawMessage(bytes),
+		"hmac":    hex.EncodeToString(mac),
+	})
+}
+
+func (h *harness) marshal(v any) []byte {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		h.t.Fatalf("Error marshalling %v (%v)", v, err)
+	}
+
+	return bytes
+}
+
+// Publishes a request to the request topic for the resource:action (e.g. device/door:open).
+func (h *harness) publish(topic string, payload []byte) {
+	t := h.mqttd.Topics.Requests + "/" + topic
+
+	h.await(h.client.Publish(t, 1, false, payload), "publishing to "+t)
+}
+
+func (h *harness) await(token paho.Token, action string) {
+	if !token.WaitTimeout(harnessTimeout) {
+		h.t.Fatalf("Timeout %v", action)
+	} else if err := token.Error(); err != nil {
+		h.t.Fatalf("Error %v (%v)", action, err)
+	}
+}
+
+// Sends a signed, encrypted and HMAC'd request and returns the reply.
+func (h *harness) call(clientID, topic string, fields map[string]any) message {
+	h.t.Helper()
+
+	rq := h.request(clientID, fields)
+	h.publish(topic, h.wrap(rq))
+
+	return h.receive(rq["request-id"].(string))
+}
+
+// Publishes a JSON-RPC request to the RPC topic and returns the reply.
+func (h *harness) rpc(clientID, method string, params map[string]any) message {
+	h.t.Helper()
+
+	rq := h.request(clientID, params)
+	id := rq["request-id"].(string)
+
+	envelope := map[string]any{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  rq,
+		"id":      id,
+	}
+
+	h.await(h.client.Publish(h.mqttd.Topics.RPC, 1, false, h.wrap(envelope)), "publishing to "+h.mqttd.Topics.RPC)
+
+	timer := time.NewTimer(harnessTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case msg := <-h.replies:
+			if msg.err != nil {
+				h.t.Errorf("Invalid reply on %v (%v)", msg.topic, msg.err)
+			} else if msg.body["id"] == id {
+				return msg
+			}
+
+		case <-timer.C:
+			h.t.Fatalf("Timeout waiting for reply to JSON-RPC request %v", id)
+			return message{}
+		}
+	}
+}
+
+// Returns the reply to the request, failing the test if there is no reply.
+func (h *harness) receive(requestID string) message {
+	h.t.Helper()
+
+	msg, ok := h.wait(requestID, harnessTimeout)
+	if !ok {
+		h.t.Fatalf("Timeout waiting for reply to %v", requestID)
+	}
+
+	return msg
+}
+
+// Waits for the reply to the request, discarding any other replies.
+func (h *harness) wait(requestID string, timeout time.Duration) (message, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case msg := <-h.replies:
+			if msg.err != nil {
+				h.t.Errorf("Invalid reply on %v (%v)", msg.topic, msg.err)
+			} else if msg.body["request-id"] == requestID {
+				return msg, true
+			}
+
+		case <-timer.C:
+			return message{}, false
+		}
+	}
+}
+
+// Verifies the HMAC of a received message, decrypts the content and validates the server
+// signature.
+func (h *harness) open(topic string, payload []byte) message {
+	envelope := struct {
+		Message json.RawMessage `json:"message"`
+		HMAC    string          `json:"hmac"`
+	}{}
+
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return message{topic: topic, err: err}
+	}
+
+	if mac, err := hex.DecodeString(envelope.HMAC); err != nil || !h.hmac.Verify(envelope.Message, mac) {
+		return message{topic: topic, err: fmt.Errorf("invalid HMAC")}
+	}
+
+	msg := map[string]json.RawMessage{}
+	if err := json.Unmarshal(envelope.Message, &msg); err != nil {
+		return message{topic: topic, err: err}
+	}
+
+	var signature, key string
+	if err := json.Unmarshal(msg["signature"], &signature); err != nil {
+		return message{topic: topic, err: fmt.Errorf("missing signature (%v)", err)}
+	} else if err := json.Unmarshal(msg["key"], &key); err != nil {
+		return message{topic: topic, err: fmt.Errorf("missing key (%v)", err)}
+	}
+
+	for _, kind := range []string{"reply", "error", "event", "system"} {
+		if content, ok := msg[kind]; ok {
+			label := "request"
+			if kind == "event" || kind == "system" {
+				label = kind
+			}
+
+			body, err := h.decrypt(content, key, signature, label)
+
+			return message{topic: topic, kind: kind, body: body, err: err}
+		}
+	}
+
+	return message{topic: topic, err: fmt.Errorf("unrecognised message %s", envelope.Message)}
+}
+
+func (h *harness) decrypt(content json.RawMessage, key, signature, label string) (map[string]any, error) {
+	var crypttext string
+	if err := json.Unmarshal(content, &crypttext); err != nil {
+		return nil, fmt.Errorf("content is not encrypted (%v)", err)
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(crypttext)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := h.keys.Decrypt(ciphertext, k, label)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting content (%v)", err)
+	}
+
+	if err := h.keys.Validate(harnessServerID, plaintext, s); err != nil {
+		return nil, err
+	}
+
+	body := map[string]any{}
+	if err := json.Unmarshal(plaintext, &body); err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// Returns the error code of an error reply (or 0 if the message is not an error reply).
+func (m message) code() int {
+	if e, ok := m.body["error"].(map[string]any); ok && m.kind == "error" {
+		if code, ok := e["code"].(float64); ok {
+			return int(code)
+		}
+	}
+
+	return 0
+}
+
+func (m message) response() map[string]any {
+	if r, ok := m.body["response"].(map[string]any); ok {
+		return r
+	}
+
+	return nil
+}
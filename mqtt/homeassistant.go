@@ -0,0 +1,598 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/uhppoted/uhppote-core/uhppote"
+	"github.com/uhppoted/uhppoted-lib/uhppoted"
+
+	"github.com/uhppoted/uhppoted-mqtt/auth"
+	"github.com/uhppoted/uhppoted-mqtt/device"
+)
+
+// HomeAssistant holds the settings for Home Assistant MQTT discovery. If enabled, a retained
+// discovery config is published for each controller and door on connecting to the broker and
+// the entity states are published (retained) to the state topics under Topic, from the received
+// events and from periodically polling the controller status.
+//
+// The door lock entities are disabled by default and are only published if Locks is set and
+// both the Card (since 'open-door' requires a card with access to the door) and the lock Code
+// are configured. Door lock commands must include the lock Code and, if permissions are enabled,
+// ClientID must have the 'lock:open' permission for the controller and door.
+//
+// The entity availability is taken from the (retained) server status messages, which Home Assistant
+// cannot decrypt if outgoing messages are encrypted. In which case the availability is published as
+// a plain 'online' or 'offline' to Topic/availability instead - the broker will message is the (encrypted)
+// status message, so an unexpected disconnect is not reported as unavailable.
+type HomeAssistant struct {
+	Enabled   bool
+	Discovery string
+	Topic     string
+	Locks     bool
+	Card      uint32
+	Code      string
+	ClientID  string
+	Interval  time.Duration
+}
+
+type homeassistant struct {
+	HomeAssistant
+	mqttd   *MQTTD
+	d       *dispatcher
+	devices []uhppote.Device
+	pending map[uint32]*atomic.Int32
+	log     *log.Logger
+}
+
+// haConfig is a Home Assistant MQTT discovery config. The lock, binary_sensor and sensor
+// entities use the Home Assistant default payloads (LOCK/UNLOCK/LOCKED/UNLOCKED and ON/OFF).
+type haConfig struct {
+	Name            string           `json:"name"`
+	UniqueID        string           `json:"unique_id"`
+	DeviceClass     string           `json:"device_class,omitempty"`
+	Icon            string           `json:"icon,omitempty"`
+	StateTopic      string           `json:"state_topic"`
+	ValueTemplate   string           `json:"value_template,omitempty"`
+	AttributesTopic string           `json:"json_attributes_topic,omitempty"`
+	CommandTopic    string           `json:"command_topic,omitempty"`
+	CommandTemplate string           `json:"command_template,omitempty"`
+	CodeFormat      string           `json:"code_format,omitempty"`
+	PayloadOpen     string           `json:"payload_open,omitempty"`
+	Availability    []haAvailability `json:"availability"`
+	Device          haDevice         `json:"device"`
+}
+
+type haAvailability struct {
+	Topic         string `json:"topic"`
+	ValueTemplate string `json:"value_template,omitempty"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+type haEntity struct {
+	component string
+	object    string
+	config    haConfig
+}
+
+// haStatus is the controller status published to the controller status topic. State is 'ok' if
+// the controller responded and is not reporting a system error, 'error' otherwise.
+type haStatus struct {
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+	*uhppoted.Status
+}
+
+const (
+	haLocked   = "LOCKED"
+	haUnlocked = "UNLOCKED"
+	haOn       = "ON"
+	haOff      = "OFF"
+)
+
+// Event type for a card swipe.
+const swipe uint8 = 1
+
+// Door lock command payload published by the Home Assistant lock entities.
+const haCommandTemplate = `{"command":"{{ value }}","code":"{{ code }}"}`
+
+// Controller status refresh states for coalescing the status refreshes triggered by events.
+const (
+	haIdle int32 = iota
+	haRefreshing
+	haRefreshPending
+)
+
+func newHomeAssistant(mqttd *MQTTD, d *dispatcher, devices []uhppote.Device, log *log.Logger) *homeassistant {
+	list := make([]uhppote.Device, len(devices))
+
+	copy(list, devices)
+	sort.Slice(list, func(i, j int) bool { return list[i].DeviceID < list[j].DeviceID })
+
+	ha := homeassistant{
+		HomeAssistant: mqttd.HomeAssistant,
+		mqttd:         mqttd,
+		d:             d,
+		devices:       list,
+		pending:       map[uint32]*atomic.Int32{},
+		log:           log,
+	}
+
+	for _, d := range list {
+		ha.pending[d.DeviceID] = &atomic.Int32{}
+	}
+
+	if ha.Locks && (ha.Card == 0 || ha.Code == "") {
+		log.Printf("WARN  %-12s %v", "homeassistant", "Door locks disabled - the door locks require a card and a lock code")
+	} else if ha.locks() {
+		log.Printf("WARN  %-12s %v", "homeassistant", fmt.Sprintf("Door locks enabled - restrict access to %v/+/door/+/lock/set with the broker ACLs", ha.Topic))
+	}
+
+	if topic := ha.availability(); topic != "" {
+		log.Printf("WARN  %-12s %v", "homeassistant", fmt.Sprintf("Outgoing messages are encrypted - publishing entity availability to %v (an unexpected disconnect is not reported)", topic))
+	}
+
+	return &ha
+}
+
+// Returns the plain availability topic if outgoing messages are encrypted (Home Assistant cannot
+// decrypt the server status messages) and "" otherwise.
+func (ha *homeassistant) availability() string {
+	if ha.mqttd.Encryption.EncryptOutgoing {
+		return ha.Topic + "/availability"
+	}
+
+	return ""
+}
+
+// Returns true if the door lock entities and commands are enabled.
+func (ha HomeAssistant) locks() bool {
+	return ha.Locks && ha.Card != 0 && ha.Code != ""
+}
+
+// Publishes the retained discovery configs, subscribes to the door lock command topic and
+// refreshes the controller states. Invoked on (re)connecting to the broker.
+func (ha *homeassistant) connected(c client) {
+	for _, entity := range ha.entities() {
+		topic := fmt.Sprintf("%v/%v/%v/%v/config", ha.Discovery, entity.component, entity.config.Device.Identifiers[0], entity.object)
+
+		if bytes, err := json.Marshal(entity.config); err != nil {
+			ha.log.Printf("WARN  %-12s %v", "homeassistant", err)
+		} else if err := c.publish(topic, ha.mqttd.Topics.EventQoS.QoS, true, bytes, nil); err != nil {
+			ha.log.Printf("WARN  %-12s %v", "homeassistant", fmt.Errorf("Error publishing discovery config %v (%v)", topic, err))
+		}
+	}
+
+	ha.log.Printf("%-5s %-12s %v", "INFO", "homeassistant", fmt.Sprintf("Published discovery configs to %s", ha.Discovery))
+
+	ha.available(c, online)
+
+	if ha.locks() {
+		topic := ha.Topic + "/+/door/+/lock/set"
+		if err := c.subscribe(topic, ha.mqttd.Topics.RequestQoS, ha.command); err != nil {
+			ha.log.Printf("ERROR unable to subscribe to %s (%v)", topic, err)
+		} else {
+			ha.log.Printf("%-5s %-12s %v", "INFO", "homeassistant", fmt.Sprintf("Subscribed to %s", topic))
+		}
+	}
+
+	go ha.refresh()
+}
+
+// Publishes the retained plain availability (if outgoing messages are encrypted).
+func (ha *homeassistant) available(c client, status string) {
+	if topic := ha.availability(); topic != "" {
+		if err := c.publish(topic, ha.mqttd.Topics.SystemQoS.QoS, true, []byte(status), nil); err != nil {
+			ha.log.Printf("WARN  %-12s %v", "homeassistant", fmt.Errorf("Error publishing %v (%v)", topic, err))
+		}
+	}
+}
+
+// Periodically polls the controller status until the MQTT daemon is closed.
+func (ha *homeassistant) poll() {
+	interval := ha.Interval
+	if interval <= 0 {
+		interval = 60 * time.Second
+	}
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ha.mqttd.closed:
+			return
+
+		case <-tick.C:
+			ha.refresh()
+		}
+	}
+}
+
+// Updates the controller 'last swipe' sensor for card swipes and refreshes the controller
+// status for all events. The status is refreshed asynchronously so as not to delay the
+// event listener.
+func (ha *homeassistant) event(e uhppoted.Event) {
+	if !ha.known(e.DeviceID) {
+		return
+	}
+
+	if e.Type == swipe {
+		ha.publish(ha.topic(e.DeviceID, "swipe"), device.Transmogrify(e))
+	}
+
+	ha.schedule(e.DeviceID)
+}
+
+// Refreshes the controller status asynchronously. A refresh requested while a refresh is in
+// progress is deferred until the current refresh completes and multiple deferred refreshes are
+// coalesced into a single refresh, so there is at most one status request per controller in
+// progress for a burst of events.
+func (ha *homeassistant) schedule(deviceID uint32) {
+	state, ok := ha.pending[deviceID]
+	if !ok {
+		return
+	}
+
+	for {
+		switch state.Load() {
+		case haIdle:
+			if state.CompareAndSwap(haIdle, haRefreshing) {
+				go ha.refreshing(deviceID, state)
+				return
+			}
+
+		case haRefreshing:
+			if state.CompareAndSwap(haRefreshing, haRefreshPending) {
+				return
+			}
+
+		default:
+			return
+		}
+	}
+}
+
+func (ha *homeassistant) refreshing(deviceID uint32, state *atomic.Int32) {
+	for {
+		ha.update(deviceID)
+
+		if state.CompareAndSwap(haRefreshing, haIdle) {
+			return
+		}
+
+		state.Store(haRefreshing)
+	}
+}
+
+func (ha *homeassistant) refresh() {
+	for _, d := range ha.devices {
+		ha.update(d.DeviceID)
+	}
+}
+
+// Retrieves the controller status and publishes the controller and door states.
+func (ha *homeassistant) update(deviceID uint32) {
+	status, err := ha.d.uhppoted.GetStatus(deviceID)
+	if err != nil {
+		ha.log.Printf("WARN  %-12s %v", "homeassistant", fmt.Errorf("%v: error retrieving status (%v)", deviceID, err))
+		ha.publish(ha.topic(deviceID, "status"), haStatus{State: "error", Error: err.Error()})
+		return
+	}
+
+	if ha.mqttd.doors != nil {
+		ha.mqttd.doors.status(deviceID, status)
+	}
+
+	state := "ok"
+	if status.SystemError != 0 {
+		state = "error"
+	}
+
+	ha.publish(ha.topic(deviceID, "status"), haStatus{State: state, Status: status})
+
+	for door := uint8(1); door <= 4; door++ {
+		lock := haLocked
+		if status.RelayState&(1<<(door-1)) != 0 {
+			lock = haUnlocked
+		}
+
+		if ha.locks() {
+			ha.publish(ha.topic(deviceID, fmt.Sprintf("door/%v/lock", door)), lock)
+		}
+
+		ha.publish(ha.topic(deviceID, fmt.Sprintf("door/%v/open", door)), onoff(status.DoorState[door]))
+		ha.publish(ha.topic(deviceID, fmt.Sprintf("door/%v/button", door)), onoff(status.DoorButton[door]))
+	}
+}
+
+// Handler for the door lock command topic. UNLOCK and OPEN invoke 'open-door' for the door with
+// the configured card if the command is authorised. LOCK is ignored since the door relay is
+// released by the controller after the configured door delay.
+func (ha *homeassistant) command(msg incoming) {
+	if msg.ack != nil {
+		defer msg.ack()
+	}
+
+	// ... <topic>/<device-id>/door/<door>/lock/set
+	fields := strings.Split(strings.TrimPrefix(msg.topic, ha.Topic+"/"), "/")
+	if len(fields) != 5 {
+		ha.log.Printf("WARN  %-12s %v", "homeassistant", fmt.Errorf("Invalid command topic %v", msg.topic))
+		return
+	}
+
+	deviceID, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil || !ha.known(uint32(deviceID)) {
+		ha.log.Printf("WARN  %-12s %v", "homeassistant", fmt.Errorf("Invalid/unknown controller in command topic %v", msg.topic))
+		return
+	}
+
+	door, err := strconv.ParseUint(fields[2], 10, 8)
+	if err != nil || door < 1 || door > 4 {
+		ha.log.Printf("WARN  %-12s %v", "homeassistant", fmt.Errorf("Invalid door in command topic %v", msg.topic))
+		return
+	}
+
+	cmd, err := ha.authorise(uint32(deviceID), uint8(door), msg.payload)
+	if err != nil {
+		ha.log.Printf("WARN  %-12s %v", "homeassistant", fmt.Errorf("%v: door %v: command refused (%v)", deviceID, door, err))
+		return
+	}
+
+	switch cmd {
+	case "UNLOCK", "OPEN":
+		f := func() {
+			ha.open(uint32(deviceID), uint8(door))
+		}
+
+		if !ha.mqttd.pool.submit("open-door", f) {
+			ha.log.Printf("WARN  %-12s %v", "homeassistant", fmt.Errorf("%v: door %v: request queue full", deviceID, door))
+		}
+
+	case "LOCK":
+		ha.log.Printf("%-5s %-12s %v", "INFO", "homeassistant", fmt.Sprintf("%v: door %v: ignoring LOCK command", deviceID, door))
+
+	default:
+		ha.log.Printf("WARN  %-12s %v", "homeassistant", fmt.Errorf("%v: door %v: invalid command '%v'", deviceID, door, cmd))
+	}
+}
+
+// Unpacks a door lock command ({"command":"<command>","code":"<code>"}), returning the command
+// if the lock code matches and the Home Assistant client ID has the 'lock:open' permission for
+// the controller and door (if permissions are enabled).
+func (ha *homeassistant) authorise(deviceID uint32, door uint8, payload []byte) (string, error) {
+	if !ha.locks() {
+		return "", errors.New("door locks not enabled")
+	}
+
+	command := struct {
+		Command string `json:"command"`
+		Code    string `json:"code"`
+	}{}
+
+	if err := json.Unmarshal(payload, &command); err != nil {
+		return "", fmt.Errorf("invalid command (%v)", err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(command.Code), []byte(ha.Code)) != 1 {
+		return "", errors.New("invalid lock code")
+	}
+
+	if ha.mqttd.Permissions.Enabled {
+		if err := ha.mqttd.Permissions.ValidateScope(ha.ClientID, "lock", "open", &auth.Scope{DeviceID: deviceID, Door: door}); err != nil {
+			return "", err
+		}
+	}
+
+	return strings.TrimSpace(command.Command), nil
+}
+
+// Opens a door using the dispatch table 'open-door' handler and refreshes the controller state.
+func (ha *homeassistant) open(deviceID uint32, door uint8) {
+	fn, ok := ha.d.table[ha.d.methods["open-door"]]
+	if !ok {
+		return
+	}
+
+	request, err := json.Marshal(struct {
+		DeviceID uint32 `json:"device-id"`
+		Door     uint8  `json:"door"`
+		Card     uint32 `json:"card-number"`
+	}{
+		DeviceID: deviceID,
+		Door:     door,
+		Card:     ha.Card,
+	})
+
+	if err != nil {
+		ha.log.Printf("WARN  %-12s %v", "homeassistant", err)
+		return
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), ha.mqttd.Dispatch.deadline(time.Now(), 0))
+	defer cancel()
+
+	if _, err := fn.f(ctx, ha.d.uhppoted, request); err != nil {
+		ha.log.Printf("WARN  %-12s %v", "homeassistant", fmt.Errorf("%v: door %v: %v", deviceID, door, err))
+	} else {
+		ha.log.Printf("%-5s %-12s %v", "INFO", "homeassistant", fmt.Sprintf("%v: door %v: opened", deviceID, door))
+	}
+
+	ha.update(deviceID)
+}
+
+// Returns the discovery entities for the configured controllers and doors.
+func (ha *homeassistant) entities() []haEntity {
+	entities := []haEntity{}
+
+	availability := []haAvailability{
+		{
+			Topic:         ha.mqttd.Topics.Status,
+			ValueTemplate: "{{ value_json.message.system.status.status }}",
+		},
+	}
+
+	if topic := ha.availability(); topic != "" {
+		availability = []haAvailability{
+			{Topic: topic},
+		}
+	}
+
+	for _, d := range ha.devices {
+		id := d.DeviceID
+		uid := fmt.Sprintf("uhppoted_%v", id)
+		dev := haDevice{
+			Identifiers:  []string{uid},
+			Name:         d.Name,
+			Manufacturer: "UHPPOTE",
+			Model:        "access controller",
+		}
+
+		if dev.Name == "" {
+			dev.Name = fmt.Sprintf("UHPPOTE %v", id)
+		}
+
+		for door := 1; door <= 4; door++ {
+			name := fmt.Sprintf("%v door %v", dev.Name, door)
+			if door <= len(d.Doors) && strings.TrimSpace(d.Doors[door-1]) != "" {
+				name = strings.TrimSpace(d.Doors[door-1])
+			}
+
+			if ha.locks() {
+				entities = append(entities, haEntity{
+					component: "lock",
+					object:    fmt.Sprintf("door_%v_lock", door),
+					config: haConfig{
+						Name:            name,
+						UniqueID:        fmt.Sprintf("%v_door_%v_lock", uid, door),
+						StateTopic:      ha.topic(id, fmt.Sprintf("door/%v/lock", door)),
+						CommandTopic:    ha.topic(id, fmt.Sprintf("door/%v/lock/set", door)),
+						CommandTemplate: haCommandTemplate,
+						CodeFormat:      ".+",
+						PayloadOpen:     "OPEN",
+						Availability:    availability,
+						Device:          dev,
+					},
+				})
+			}
+
+			entities = append(entities, haEntity{
+				component: "binary_sensor",
+				object:    fmt.Sprintf("door_%v_open", door),
+				config: haConfig{
+					Name:         name + " open",
+					UniqueID:     fmt.Sprintf("%v_door_%v_open", uid, door),
+					DeviceClass:  "door",
+					StateTopic:   ha.topic(id, fmt.Sprintf("door/%v/open", door)),
+					Availability: availability,
+					Device:       dev,
+				},
+			})
+
+			entities = append(entities, haEntity{
+				component: "binary_sensor",
+				object:    fmt.Sprintf("door_%v_button", door),
+				config: haConfig{
+					Name:         name + " button",
+					UniqueID:     fmt.Sprintf("%v_door_%v_button", uid, door),
+					Icon:         "mdi:gesture-tap-button",
+					StateTopic:   ha.topic(id, fmt.Sprintf("door/%v/button", door)),
+					Availability: availability,
+					Device:       dev,
+				},
+			})
+		}
+
+		entities = append(entities, haEntity{
+			component: "sensor",
+			object:    "status",
+			config: haConfig{
+				Name:            dev.Name + " status",
+				UniqueID:        uid + "_status",
+				Icon:            "mdi:lan-connect",
+				StateTopic:      ha.topic(id, "status"),
+				ValueTemplate:   "{{ value_json.state }}",
+				AttributesTopic: ha.topic(id, "status"),
+				Availability:    availability,
+				Device:          dev,
+			},
+		})
+
+		entities = append(entities, haEntity{
+			component: "sensor",
+			object:    "last_swipe",
+			config: haConfig{
+				Name:            dev.Name + " last swipe",
+				UniqueID:        uid + "_last_swipe",
+				Icon:            "mdi:card-account-details",
+				StateTopic:      ha.topic(id, "swipe"),
+				ValueTemplate:   "{{ value_json['card-number'] }}",
+				AttributesTopic: ha.topic(id, "swipe"),
+				Availability:    availability,
+				Device:          dev,
+			},
+		})
+	}
+
+	return entities
+}
+
+// Publishes a retained entity state. Strings are published as is, anything else as JSON.
+func (ha *homeassistant) publish(topic string, state any) {
+	var payload []byte
+
+	if s, ok := state.(string); ok {
+		payload = []byte(s)
+	} else if bytes, err := json.Marshal(state); err != nil {
+		ha.log.Printf("WARN  %-12s %v", "homeassistant", err)
+		return
+	} else {
+		payload = bytes
+	}
+
+	c := ha.mqttd.current()
+	if c == nil || !c.isConnected() {
+		return
+	}
+
+	if err := c.publish(topic, ha.mqttd.Topics.EventQoS.QoS, true, payload, nil); err != nil {
+		ha.log.Printf("WARN  %-12s %v", "homeassistant", fmt.Errorf("Error publishing %v (%v)", topic, err))
+	}
+}
+
+func (ha *homeassistant) topic(deviceID uint32, subtopic string) string {
+	return fmt.Sprintf("%v/%v/%v", ha.Topic, deviceID, subtopic)
+}
+
+func (ha *homeassistant) known(deviceID uint32) bool {
+	for _, d := range ha.devices {
+		if d.DeviceID == deviceID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func onoff(b bool) string {
+	if b {
+		return haOn
+	}
+
+	return haOff
+}
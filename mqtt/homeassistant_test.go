@@ -0,0 +1,194 @@
+package mqtt
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/uhppoted/uhppote-core/uhppote"
+
+	"github.com/uhppoted/uhppoted-mqtt/auth"
+)
+
+func TestHomeAssistantEntities(t *testing.T) {
+	devices := []uhppote.Device{
+		uhppote.Device{Name: "Alpha", DeviceID: 405419896, Doors: []string{"Front", "Back", "", ""}},
+		uhppote.Device{Name: "", DeviceID: 303986753},
+	}
+
+	tests := []struct {
+		locks    bool
+		card     uint32
+		code     string
+		entities int
+	}{
+		{false, 0, "", 2 * (4*2 + 2)},
+		{false, 8165538, "8E5B3K", 2 * (4*2 + 2)},
+		{true, 0, "8E5B3K", 2 * (4*2 + 2)},
+		{true, 8165538, "", 2 * (4*2 + 2)},
+		{true, 8165538, "8E5B3K", 2 * (4*3 + 2)},
+	}
+
+	for _, v := range tests {
+		mqttd := MQTTD{
+			Topics: Topics{Status: "uhppoted/gateway/system/uhppoted/status"},
+			HomeAssistant: HomeAssistant{
+				Enabled:   true,
+				Discovery: "homeassistant",
+				Topic:     "uhppoted/gateway/homeassistant",
+				Locks:     v.locks,
+				Card:      v.card,
+				Code:      v.code,
+			},
+		}
+
+		ha := newHomeAssistant(&mqttd, &dispatcher{}, devices, log.New(os.Stdout, "", 0))
+		entities := ha.entities()
+
+		if len(entities) != v.entities {
+			t.Fatalf("Incorrect number of entities for locks:%v card:%v code:%q - expected:%v, got:%v", v.locks, v.card, v.code, v.entities, len(entities))
+		}
+
+		if entities[0].config.Device.Name != "UHPPOTE 303986753" {
+			t.Errorf("Expected controllers sorted by device ID with default name, got:%v", entities[0].config.Device.Name)
+		}
+
+		if ha.locks() {
+			lock := entities[len(entities)/2]
+			expected := haConfig{
+				Name:            "Front",
+				UniqueID:        "uhppoted_405419896_door_1_lock",
+				StateTopic:      "uhppoted/gateway/homeassistant/405419896/door/1/lock",
+				CommandTopic:    "uhppoted/gateway/homeassistant/405419896/door/1/lock/set",
+				CommandTemplate: `{"command":"{{ value }}","code":"{{ code }}"}`,
+				CodeFormat:      ".+",
+				PayloadOpen:     "OPEN",
+				Availability: []haAvailability{
+					{Topic: "uhppoted/gateway/system/uhppoted/status", ValueTemplate: "{{ value_json.message.system.status.status }}"},
+				},
+				Device: haDevice{
+					Identifiers:  []string{"uhppoted_405419896"},
+					Name:         "Alpha",
+					Manufacturer: "UHPPOTE",
+					Model:        "access controller",
+				},
+			}
+
+			if lock.component != "lock" || !reflect.DeepEqual(lock.config, expected) {
+				t.Errorf("Incorrect lock entity\n   expected:%+v\n   got:     %+v", expected, lock.config)
+			}
+		}
+	}
+}
+
+func TestHomeAssistantEncryptedAvailability(t *testing.T) {
+	devices := []uhppote.Device{
+		uhppote.Device{Name: "Alpha", DeviceID: 405419896},
+	}
+
+	for _, encrypted := range []bool{false, true} {
+		mqttd := MQTTD{
+			Topics:     Topics{Status: "uhppoted/gateway/system/uhppoted/status"},
+			Encryption: Encryption{EncryptOutgoing: encrypted},
+			HomeAssistant: HomeAssistant{
+				Enabled:   true,
+				Discovery: "homeassistant",
+				Topic:     "uhppoted/gateway/homeassistant",
+			},
+		}
+
+		ha := newHomeAssistant(&mqttd, &dispatcher{}, devices, log.New(io.Discard, "", 0))
+
+		expected := []haAvailability{
+			{Topic: "uhppoted/gateway/system/uhppoted/status", ValueTemplate: "{{ value_json.message.system.status.status }}"},
+		}
+
+		if encrypted {
+			expected = []haAvailability{
+				{Topic: "uhppoted/gateway/homeassistant/availability"},
+			}
+		}
+
+		for _, entity := range ha.entities() {
+			if !reflect.DeepEqual(entity.config.Availability, expected) {
+				t.Fatalf("Incorrect availability (encrypted:%v)\n   expected:%+v\n   got:     %+v", encrypted, expected, entity.config.Availability)
+			}
+		}
+
+		c := published{messages: map[string][]byte{}}
+		ha.available(&c, online)
+
+		if payload, ok := c.messages["uhppoted/gateway/homeassistant/availability"]; encrypted && string(payload) != "online" {
+			t.Errorf("Incorrect availability - expected:%v, got:%s", "online", payload)
+		} else if !encrypted && (ok || len(c.messages) > 0) {
+			t.Errorf("Unexpected availability message %s", payload)
+		}
+	}
+}
+
+func TestHomeAssistantCommandAuthorisation(t *testing.T) {
+	dir := t.TempDir()
+	users := filepath.Join(dir, "users")
+	groups := filepath.Join(dir, "groups")
+
+	if err := os.WriteFile(users, []byte("homeassistant  frontdesk\n"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if err := os.WriteFile(groups, []byte("frontdesk  lock:open@405419896/1\n"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	permissions, err := auth.NewPermissions(true, users, groups, log.New(os.Stdout, "", 0))
+	if err != nil {
+		t.Fatalf("Error loading permissions (%v)", err)
+	}
+
+	tests := []struct {
+		locks    bool
+		clientID string
+		deviceID uint32
+		door     uint8
+		payload  string
+		command  string
+		refused  bool
+	}{
+		{true, "homeassistant", 405419896, 1, `{"command":"OPEN","code":"8E5B3K"}`, "OPEN", false},
+		{true, "homeassistant", 405419896, 1, `{"command":"UNLOCK","code":"8E5B3K"}`, "UNLOCK", false},
+		{false, "homeassistant", 405419896, 1, `{"command":"OPEN","code":"8E5B3K"}`, "", true},
+		{true, "homeassistant", 405419896, 1, `OPEN`, "", true},
+		{true, "homeassistant", 405419896, 1, `{"command":"OPEN"}`, "", true},
+		{true, "homeassistant", 405419896, 1, `{"command":"OPEN","code":"8E5B3"}`, "", true},
+		{true, "homeassistant", 405419896, 2, `{"command":"OPEN","code":"8E5B3K"}`, "", true},
+		{true, "homeassistant", 303986753, 1, `{"command":"OPEN","code":"8E5B3K"}`, "", true},
+		{true, "intruder", 405419896, 1, `{"command":"OPEN","code":"8E5B3K"}`, "", true},
+	}
+
+	for _, v := range tests {
+		mqttd := MQTTD{
+			HomeAssistant: HomeAssistant{
+				Enabled:  true,
+				Topic:    "uhppoted/gateway/homeassistant",
+				Locks:    v.locks,
+				Card:     8165538,
+				Code:     "8E5B3K",
+				ClientID: v.clientID,
+			},
+			Permissions: *permissions,
+		}
+
+		ha := newHomeAssistant(&mqttd, &dispatcher{}, nil, log.New(os.Stdout, "", 0))
+		command, err := ha.authorise(v.deviceID, v.door, []byte(v.payload))
+
+		if v.refused && err == nil {
+			t.Errorf("Expected %v:%v %v from %v to be refused", v.deviceID, v.door, v.payload, v.clientID)
+		} else if !v.refused && err != nil {
+			t.Errorf("Unexpected error for %v:%v %v from %v (%v)", v.deviceID, v.door, v.payload, v.clientID, err)
+		} else if command != v.command {
+			t.Errorf("Incorrect command for %v:%v %v - expected:%q, got:%q", v.deviceID, v.door, v.payload, v.command, command)
+		}
+	}
+}
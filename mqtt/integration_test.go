@@ -0,0 +1,488 @@
+package mqtt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/uhppoted/uhppoted-mqtt/acl"
+	"github.com/uhppoted/uhppoted-mqtt/device"
+)
+
+func TestIntegrationDispatchTable(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	h := newHarness(t)
+
+	upload := "file://" + filepath.Join(h.dir, "uhppoted.tar.gz")
+	report := "file://" + filepath.Join(h.dir, "report.txt")
+
+	profile := map[string]any{
+		"id":         29,
+		"start-date": "2022-01-01",
+		"end-date":   "2099-12-31",
+		"weekdays":   "Monday,Wednesday,Friday",
+		"segments":   []any{map[string]any{"start": "08:30", "end": "17:00"}},
+	}
+
+	card := map[string]any{
+		"card-number": 8165538,
+		"start-date":  "2022-01-01",
+		"end-date":    "2099-12-31",
+		"doors":       map[string]any{"1": true, "2": 29},
+	}
+
+	task := map[string]any{
+		"task":       1,
+		"door":       1,
+		"start-date": "2022-01-01",
+		"end-date":   "2099-12-31",
+		"weekdays":   "Monday,Tuesday",
+		"start":      "08:30",
+	}
+
+	// ... executed in order against the simulated controllers i.e. later requests depend on the
+	//     controller state set by earlier requests
+	tests := []struct {
+		method   string
+		request  map[string]any
+		expected map[string]any
+	}{
+		{"get-api", nil, nil},
+		{"get-devices", nil, nil},
+		{"get-device", map[string]any{"device-id": 405419896}, map[string]any{"device-id": 405419896}},
+		{"get-status", map[string]any{"device-id": 405419896}, map[string]any{"device-id": 405419896}},
+		{"get-time", map[string]any{"device-id": 405419896}, map[string]any{"device-id": 405419896}},
+		{"set-time", map[string]any{"device-id": 405419896, "date-time": "2025-01-01 12:34:56"}, map[string]any{"device-id": 405419896}},
+		{"set-door-delay", map[string]any{"device-id": 405419896, "door": 3, "delay": 7}, map[string]any{"delay": 7}},
+		{"get-door-delay", map[string]any{"device-id": 405419896, "door": 3}, map[string]any{"delay": 7}},
+		{"set-door-control", map[string]any{"device-id": 405419896, "door": 3, "control": "normally closed"}, map[string]any{"control": "normally closed"}},
+		{"get-door-control", map[string]any{"device-id": 405419896, "door": 3}, map[string]any{"control": "normally closed"}},
+		{"record-special-events", map[string]any{"device-id": 405419896, "enabled": true}, nil},
+		{"set-time-profile", map[string]any{"device-id": 405419896, "profile": profile}, nil},
+		{"get-time-profile", map[string]any{"device-id": 405419896, "profile-id": 29}, nil},
+		{"set-time-profiles", map[string]any{"device-id": 303986753, "profiles": []any{profile}}, nil},
+		{"get-time-profiles", map[string]any{"device-id": 303986753}, nil},
+		{"put-card", map[string]any{"device-id": 405419896, "card": card}, nil},
+		{"get-card", map[string]any{"device-id": 405419896, "card-number": 8165538}, nil},
+		{"get-cards", map[string]any{"device-id": 405419896}, map[string]any{"cards": []any{8165538}}},
+		{"set-task-list", map[string]any{"device-id": 405419896, "tasks": []any{task}}, nil},
+		{"open-door", map[string]any{"device-id": 405419896, "door": 1, "card-number": 8165538}, nil},
+		{"get-events", map[string]any{"device-id": 405419896}, nil},
+		{"get-event", map[string]any{"device-id": 405419896, "event-index": "last"}, nil},
+		{"acl:grant", map[string]any{"card-number": 6154410, "start-date": "2022-01-01", "end-date": "2099-12-31", "doors": []any{"Front Door", "Lobby"}}, nil},
+		{"acl:show", map[string]any{"card-number": 6154410}, nil},
+		{"acl:revoke", map[string]any{"card-number": 6154410, "doors": []any{"Lobby"}}, nil},
+		{"acl:upload", map[string]any{"url": upload}, map[string]any{"uploaded": upload}},
+		{"acl:compare", map[string]any{"url": map[string]any{"acl": upload, "report": report}}, nil},
+		{"acl:download", map[string]any{"url": upload}, nil},
+		{"batch", map[string]any{"requests": []any{map[string]any{"method": "get-device", "request": map[string]any{"device-id": 303986753}}}}, nil},
+		{"delete-card", map[string]any{"device-id": 405419896, "card-number": 8165538}, nil},
+		{"delete-cards", map[string]any{"device-id": 405419896}, nil},
+		{"clear-time-profiles", map[string]any{"device-id": 303986753}, nil},
+	}
+
+	// ... every dispatch table method must have a test request
+	d, err := newDispatcher(h.mqttd, nil, nil, &device.Device{}, &acl.ACL{}, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("Error creating dispatcher (%v)", err)
+	}
+
+	tested := map[string]bool{}
+	for _, v := range tests {
+		tested[v.method] = true
+	}
+
+	for _, fn := range d.table {
+		if !tested[fn.method] {
+			t.Errorf("No integration test request for '%v'", fn.method)
+		}
+	}
+
+	var nonce float64
+
+	for _, v := range tests {
+		topic := d.methods[v.method][len(h.mqttd.Topics.Requests)+1:]
+		reply := h.call("alice", topic, v.request)
+
+		if reply.kind != "reply" {
+			t.Errorf("%v: expected 'reply', got '%v' (%v)", v.method, reply.kind, reply.body)
+			continue
+		}
+
+		if reply.body["method"] != v.method {
+			t.Errorf("%v: incorrect reply method - expected:%v, got:%v", v.method, v.method, reply.body["method"])
+		}
+
+		if reply.body["server-id"] != harnessServerID || reply.body["client-id"] != "alice" {
+			t.Errorf("%v: incorrect reply server-id/client-id - got:%v/%v", v.method, reply.body["server-id"], reply.body["client-id"])
+		}
+
+		if n, ok := reply.body["nonce"].(float64); !ok || n <= nonce {
+			t.Errorf("%v: invalid reply nonce - expected > %v, got:%v", v.method, nonce, reply.body["nonce"])
+		} else {
+			nonce = n
+		}
+
+		response := reply.response()
+		if response == nil {
+			t.Errorf("%v: missing response (%v)", v.method, reply.body)
+			continue
+		}
+
+		for k, expected := range v.expected {
+			if fmt.Sprintf("%s", h.marshal(response[k])) != fmt.Sprintf("%s", h.marshal(expected)) {
+				t.Errorf("%v: incorrect '%v' - expected:%v, got:%v", v.method, k, expected, response[k])
+			}
+		}
+
+		if err := conforms(d.schemas[v.method], h.marshal(response)); err != nil {
+			t.Errorf("%v: reply does not match the schemas.json reply schema (%v)", v.method, err)
+		}
+	}
+}
+
+// Validates a reply against the method reply schema and checks that the reply does not include
+// any fields that are not described by the schema, so that schemas.json (and the AsyncAPI
+// specification and api:get reply generated from it) cannot drift from the handler replies.
+func conforms(s *methodSchema, response []byte) error {
+	if s == nil {
+		return fmt.Errorf("no schema")
+	}
+
+	reply := schema{}
+	if err := json.Unmarshal(s.Reply, &reply); err != nil {
+		return err
+	}
+
+	var v any
+
+	decoder := json.NewDecoder(bytes.NewReader(response))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&v); err != nil {
+		return err
+	}
+
+	if err := reply.validate("response", v); err != nil {
+		return err
+	}
+
+	return undeclared(&reply, "response", v)
+}
+
+// Returns an error for the first field in a reply that is not described by the schema. Objects
+// without any declared properties are not checked.
+func undeclared(s *schema, path string, v any) error {
+	switch value := v.(type) {
+	case map[string]any:
+		keys := []string{}
+		for k := range value {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			p := path + "." + k
+			if property, ok := s.Properties[k]; ok {
+				if err := undeclared(property, p, value[k]); err != nil {
+					return err
+				}
+			} else if s.AdditionalProperties != nil {
+				if err := undeclared(s.AdditionalProperties, p, value[k]); err != nil {
+					return err
+				}
+			} else if len(s.Properties) > 0 {
+				return fmt.Errorf("%v: not in schema", p)
+			}
+		}
+
+	case []any:
+		if s.Items != nil {
+			for i, item := range value {
+				if err := undeclared(s.Items, fmt.Sprintf("%v[%v]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func TestIntegrationEvents(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	h := newHarness(t)
+
+	card := map[string]any{
+		"card-number": 8165538,
+		"start-date":  "2022-01-01",
+		"end-date":    "2099-12-31",
+		"doors":       map[string]any{"2": true},
+	}
+
+	if reply := h.call("alice", "device/card:put", map[string]any{"device-id": 405419896, "card": card}); reply.kind != "reply" {
+		t.Fatalf("Error adding card (%v)", reply.body)
+	}
+
+	if reply := h.call("alice", "device/door/lock:open", map[string]any{"device-id": 405419896, "door": 2, "card-number": 8165538}); reply.kind != "reply" {
+		t.Fatalf("Error opening door (%v)", reply.body)
+	}
+
+	timeout := time.After(harnessTimeout)
+	for {
+		select {
+		case msg := <-h.events:
+			if msg.err != nil {
+				t.Fatalf("Invalid event message (%v)", msg.err)
+			}
+
+			event, _ := msg.body["event"].(map[string]any)
+			if msg.kind != "event" || event == nil {
+				t.Fatalf("Invalid event message (%v %v)", msg.kind, msg.body)
+			}
+
+			if event["device-id"] == float64(405419896) && event["door-id"] == float64(2) && event["event-reason"] == float64(44) {
+				return
+			}
+
+		case <-timeout:
+			t.Fatalf("Timeout waiting for 'remote open door' event")
+		}
+	}
+}
+
+func TestIntegrationErrors(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	h := newHarness(t)
+
+	// ... 400 Bad Request
+	if reply := h.call("alice", "device:get", nil); reply.code() != StatusBadRequest {
+		t.Errorf("Invalid request: expected error %v, got %v %v", StatusBadRequest, reply.kind, reply.body)
+	}
+
+	// ... 401 Unauthorized: incorrect HMAC
+	rq := h.request("alice", map[string]any{"device-id": 405419896})
+	signature, _ := h.keys.Sign(h.marshal(rq))
+	h.publish("device:get", h.envelope(map[string]any{
+		"signature": base64.StdEncoding.EncodeToString(signature),
+		"request":   rq,
+	}, []byte("not the HMAC")))
+
+	if reply := h.receive(rq["request-id"].(string)); reply.code() != StatusUnauthorized {
+		t.Errorf("Incorrect HMAC: expected error %v, got %v %v", StatusUnauthorized, reply.kind, reply.body)
+	}
+
+	// ... 401 Unauthorized: incorrect signature
+	rq = h.request("alice", map[string]any{"device-id": 405419896})
+	h.publish("device:get", h.envelope(map[string]any{
+		"signature": base64.StdEncoding.EncodeToString(signature),
+		"request":   rq,
+	}, nil))
+
+	if reply := h.receive(rq["request-id"].(string)); reply.code() != StatusUnauthorized {
+		t.Errorf("Incorrect signature: expected error %v, got %v %v", StatusUnauthorized, reply.kind, reply.body)
+	}
+
+	// ... 403 Forbidden
+	permissions := []struct {
+		clientID  string
+		topic     string
+		request   map[string]any
+		permitted bool
+	}{
+		{"bob", "device:get", map[string]any{"device-id": 405419896}, true},
+		{"bob", "device/405419896:get", map[string]any{}, true},
+		{"bob", "device/405419896/card:get", map[string]any{"card-number": 8165538}, false},
+		{"bob", "device/time-profile:get", map[string]any{"device-id": 405419896, "profile-id": 29}, true},
+		{"bob", "device/card:get", map[string]any{"device-id": 405419896, "card-number": 8165538}, false},
+		{"bob", "device/405419896/door/1/lock:open", map[string]any{"card-number": 8165538}, false},
+		{"bob", "device/303986753/door/1/lock:open", map[string]any{"card-number": 8165538}, true},
+		{"alice", "device/time-profile:get", map[string]any{"device-id": 405419896, "profile-id": 29}, true},
+	}
+
+	for _, v := range permissions {
+		reply := h.call(v.clientID, v.topic, v.request)
+		if forbidden := reply.code() == StatusForbidden; forbidden == v.permitted {
+			t.Errorf("%v %v: incorrect authorisation - expected permitted:%v, got %v %v", v.clientID, v.topic, v.permitted, reply.kind, reply.body)
+		}
+	}
+
+	// ... 404 Not Found
+	if reply := h.call("alice", "device/frobnicator:get", map[string]any{"device-id": 405419896}); reply.code() != StatusNotFound {
+		t.Errorf("Unknown request: expected error %v, got %v %v", StatusNotFound, reply.kind, reply.body)
+	}
+
+	// ... 409 Conflict: replayed nonce
+	rq = h.request("alice", map[string]any{"device-id": 405419896})
+	h.publish("device:get", h.wrap(rq))
+
+	if reply := h.receive(rq["request-id"].(string)); reply.kind != "reply" {
+		t.Fatalf("Expected reply, got %v %v", reply.kind, reply.body)
+	}
+
+	h.publish("device:get", h.wrap(rq))
+
+	if reply := h.receive(rq["request-id"].(string)); reply.kind != "reply" || reply.body["duplicate"] != true {
+		t.Errorf("Redelivered request: expected cached reply, got %v %v", reply.kind, reply.body)
+	}
+
+	rq["request-id"] = "REPLAYED"
+	h.publish("device:get", h.wrap(rq))
+
+	if reply := h.receive("REPLAYED"); reply.code() != StatusConflict {
+		t.Errorf("Replayed nonce: expected error %v, got %v %v", StatusConflict, reply.kind, reply.body)
+	}
+
+	// ... 504 Gateway Timeout
+	if reply := h.call("alice", "device:get", map[string]any{"device-id": 405419896, "timeout": "1ns"}); reply.code() != StatusGatewayTimeout {
+		t.Errorf("Request timeout: expected error %v, got %v %v", StatusGatewayTimeout, reply.kind, reply.body)
+	}
+
+	// ... unsigned requests are not authenticated and malformed messages are not answered
+	rq = h.request("alice", map[string]any{"device-id": 405419896})
+	h.publish("device:get", []byte(`{"message": {"request": `+string(h.marshal(rq))+`}`))
+
+	if reply, ok := h.wait(rq["request-id"].(string), time.Second); ok {
+		t.Errorf("Malformed message: expected no reply, got %v %v", reply.kind, reply.body)
+	}
+
+	rq = h.request("alice", map[string]any{"device-id": 405419896})
+	h.publish("device:get", h.envelope(map[string]any{"request": rq}, nil))
+
+	if reply := h.receive(rq["request-id"].(string)); reply.code() != StatusUnauthorized {
+		t.Errorf("Unsigned request: expected error %v, got %v %v", StatusUnauthorized, reply.kind, reply.body)
+	}
+}
+
+func TestIntegrationRPC(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	h := newHarness(t)
+
+	reply := h.rpc("alice", "get-device", map[string]any{"device-id": 405419896})
+	if result, ok := reply.body["result"].(map[string]any); !ok || result["device-id"] != float64(405419896) {
+		t.Errorf("get-device: incorrect JSON-RPC result - got %v %v", reply.kind, reply.body)
+	}
+
+	reply = h.rpc("alice", "get-frobnicator", map[string]any{"device-id": 405419896})
+	if fault, ok := reply.body["error"].(map[string]any); !ok || fault["code"] != float64(rpcMethodNotFound) {
+		t.Errorf("get-frobnicator: expected JSON-RPC 'method not found' error - got %v %v", reply.kind, reply.body)
+	}
+}
+
+func TestIntegrationChunkedReply(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	h := newHarness(t)
+
+	expected := h.call("alice", "api:get", nil)
+	if expected.kind != "reply" {
+		t.Fatalf("api:get: expected 'reply', got '%v' (%v)", expected.kind, expected.body)
+	}
+
+	size := minChunkSize
+	rq := h.request("alice", map[string]any{"chunk-size": size})
+	requestID := rq["request-id"].(string)
+
+	h.publish("api:get", h.wrap(rq))
+
+	parts := map[int][]byte{}
+	N := 0
+	var completed map[string]any
+
+	// NTS: the harness does not preserve the message order so the chunks are reassembled by index
+	for completed == nil || len(parts) < N {
+		reply := h.receive(requestID)
+		if reply.kind != "reply" {
+			t.Fatalf("expected chunked 'reply', got '%v' (%v)", reply.kind, reply.body)
+		}
+
+		if c, ok := reply.body["chunk"].(map[string]any); ok {
+			index := int(c["index"].(float64))
+			N = int(c["chunks"].(float64))
+
+			data, err := base64.StdEncoding.DecodeString(c["data"].(string))
+			if err != nil {
+				t.Fatalf("chunk %v: invalid data (%v)", index, err)
+			}
+
+			if index < 1 || index > N {
+				t.Fatalf("chunk %v: invalid chunk index (%v chunks)", index, N)
+			} else if _, ok := parts[index]; ok {
+				t.Fatalf("chunk %v: duplicate chunk", index)
+			}
+
+			if len(data) == 0 || len(data) > size {
+				t.Errorf("chunk %v: invalid chunk size %v (chunk size %v)", index, len(data), size)
+			} else if index < N && len(data) != size {
+				t.Errorf("chunk %v of %v: expected %v bytes, got %v", index, N, size, len(data))
+			}
+
+			parts[index] = data
+			continue
+		}
+
+		if c, ok := reply.body["chunked"].(map[string]any); !ok {
+			t.Fatalf("expected 'chunk' or 'chunked' reply, got %v", reply.body)
+		} else {
+			completed = c
+			N = int(c["chunks"].(float64))
+		}
+	}
+
+	content := []byte{}
+	for i := 1; i <= N; i++ {
+		content = append(content, parts[i]...)
+	}
+
+	hash := sha256.Sum256(content)
+
+	if N != (len(content)+size-1)/size {
+		t.Errorf("incorrect number of chunks - expected:%v, got:%v (%v bytes)", (len(content)+size-1)/size, N, len(content))
+	}
+
+	if n := int(completed["size"].(float64)); n != len(content) {
+		t.Errorf("incorrect reassembled size - expected:%v, got:%v", len(content), n)
+	}
+
+	if completed["sha256"] != hex.EncodeToString(hash[:]) {
+		t.Errorf("incorrect SHA-256 - expected:%v, got:%v", hex.EncodeToString(hash[:]), completed["sha256"])
+	}
+
+	if N < 2 {
+		t.Fatalf("expected chunked reply, got %v chunks", N)
+	}
+
+	reassembled := map[string]any{}
+	if err := json.Unmarshal(content, &reassembled); err != nil {
+		t.Fatalf("invalid reassembled reply (%v)", err)
+	}
+
+	if !reflect.DeepEqual(reassembled["response"], expected.response()) {
+		t.Errorf("reassembled reply does not match unchunked reply")
+	}
+}
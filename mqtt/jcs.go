@@ -0,0 +1,192 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+)
+
+// Canonicalises a JSON message as per RFC 8785 (JSON Canonicalization Scheme): no whitespace,
+// object members sorted by the UTF-16 code units of the member names, strings with the minimal
+// escaping of ECMAScript JSON.stringify and numbers formatted as ECMAScript doubles. Numbers
+// are IEEE 754 doubles so integers larger than 2^53 lose precision (the same as JavaScript).
+func canonical(b []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("invalid JSON (trailing data)")
+	}
+
+	var buffer bytes.Buffer
+	if err := jcs(&buffer, v); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// Marshals a message as JSON, canonicalised if canonical JSON is enabled.
+func (m *MQTTD) marshal(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil || !m.Canonical {
+		return b, err
+	}
+
+	return canonical(b)
+}
+
+// Returns the canonical form of a received JSON message for verifying an HMAC or signature
+// calculated over the canonical JSON rather than the message as sent. Returns false if canonical
+// JSON is not enabled, the message is not JSON or the message is already canonical.
+func (m *MQTTD) canonicalised(b []byte) ([]byte, bool) {
+	if !m.Canonical {
+		return nil, false
+	}
+
+	c, err := canonical(b)
+	if err != nil || bytes.Equal(b, c) {
+		return nil, false
+	}
+
+	return c, true
+}
+
+func jcs(w *bytes.Buffer, v interface{}) error {
+	switch vv := v.(type) {
+	case nil:
+		w.WriteString("null")
+
+	case bool:
+		w.WriteString(strconv.FormatBool(vv))
+
+	case json.Number:
+		f, err := strconv.ParseFloat(vv.String(), 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %v (%v)", vv, err)
+		}
+
+		w.WriteString(es6(f))
+
+	case string:
+		quote(w, vv)
+
+	case []interface{}:
+		w.WriteByte('[')
+		for i, item := range vv {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+
+			if err := jcs(w, item); err != nil {
+				return err
+			}
+		}
+		w.WriteByte(']')
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(vv))
+		for k := range vv {
+			keys = append(keys, k)
+		}
+
+		sort.Slice(keys, func(i, j int) bool {
+			return utf16less(keys[i], keys[j])
+		})
+
+		w.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+
+			quote(w, k)
+			w.WriteByte(':')
+
+			if err := jcs(w, vv[k]); err != nil {
+				return err
+			}
+		}
+		w.WriteByte('}')
+
+	default:
+		return fmt.Errorf("unsupported JSON value %T", v)
+	}
+
+	return nil
+}
+
+// Formats a number the same as the ECMAScript Number.prototype.toString i.e. as an integer or
+// decimal for 1e-6 <= |f| < 1e21 and in exponential notation (with no leading zeroes in the
+// exponent) otherwise.
+func es6(f float64) string {
+	if f == 0 {
+		return "0"
+	}
+
+	if abs := math.Abs(f); abs >= 1e-6 && abs < 1e21 {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+
+	s := strconv.FormatFloat(f, 'e', -1, 64)
+	if n := len(s); n > 3 && s[n-2] == '0' && (s[n-3] == '-' || s[n-3] == '+') {
+		s = s[:n-2] + s[n-1:]
+	}
+
+	return s
+}
+
+func quote(w *bytes.Buffer, s string) {
+	w.WriteByte('"')
+
+	for _, r := range s {
+		switch r {
+		case '"':
+			w.WriteString(`\"`)
+		case '\\':
+			w.WriteString(`\\`)
+		case '\b':
+			w.WriteString(`\b`)
+		case '\f':
+			w.WriteString(`\f`)
+		case '\n':
+			w.WriteString(`\n`)
+		case '\r':
+			w.WriteString(`\r`)
+		case '\t':
+			w.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(w, `\u%04x`, r)
+			} else {
+				w.WriteRune(r)
+			}
+		}
+	}
+
+	w.WriteByte('"')
+}
+
+func utf16less(p, q string) bool {
+	u := utf16.Encode([]rune(p))
+	v := utf16.Encode([]rune(q))
+
+	for i := 0; i < len(u) && i < len(v); i++ {
+		if u[i] != v[i] {
+			return u[i] < v[i]
+		}
+	}
+
+	return len(u) < len(v)
+}
@@ -0,0 +1,59 @@
+package mqtt
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/uhppoted/uhppoted-mqtt/auth"
+)
+
+func TestCanonical(t *testing.T) {
+	tests := []struct {
+		json     string
+		expected string
+	}{
+		{
+			`{ "numbers": [333333333.33333329, 1E30, 4.50, 2e-3, 0.000000000000000000000000001], "string": "\u20ac$\u000F\u000aA'\u0042\u0022\u005c\\\"\/", "literals": [null, true, false] }`,
+			`{"literals":[null,true,false],"numbers":[333333333.3333333,1e+30,4.5,0.002,1e-27],"string":"€$\u000f\nA'B\"\\\\\"/"}`,
+		},
+		{
+			`{"\u20ac": "Euro Sign", "\r": "Carriage Return", "\ufb33": "Hebrew Letter Dalet With Dagesh", "1": "One", "\ud83d\ude00": "Emoji: Grinning Face", "\u0080": "Control", "\u00f6": "Latin Small Letter O With Diaeresis"}`,
+			"{\"\\r\":\"Carriage Return\",\"1\":\"One\",\"\u0080\":\"Control\",\"ö\":\"Latin Small Letter O With Diaeresis\",\"€\":\"Euro Sign\",\"😀\":\"Emoji: Grinning Face\",\"\ufb33\":\"Hebrew Letter Dalet With Dagesh\"}",
+		},
+		{
+			`{"device-id": 405419896, "door": 3, "delay": 7.0, "name": "<front>", "nested": {"b": 1e-7, "a": -0}}`,
+			`{"delay":7,"device-id":405419896,"door":3,"name":"<front>","nested":{"a":0,"b":1e-7}}`,
+		},
+	}
+
+	for _, v := range tests {
+		b, err := canonical([]byte(v.json))
+		if err != nil {
+			t.Fatalf("Unexpected error canonicalising %v (%v)", v.json, err)
+		}
+
+		if string(b) != v.expected {
+			t.Errorf("Incorrect canonical JSON\n   expected:%v\n   got:     %v", v.expected, string(b))
+		}
+	}
+
+	if _, err := canonical([]byte(`{"a":1} {"b":2}`)); err == nil {
+		t.Errorf("Expected error canonicalising JSON with trailing data")
+	}
+}
+
+func TestCanonicalHMAC(t *testing.T) {
+	hmac, _ := auth.NewHMAC(true, "secret")
+	mac := hex.EncodeToString(hmac.MAC([]byte(`{"request":{"client-id":"QWERTY","device-id":405419896,"request-id":"AH173635G3"}}`)))
+	message := []byte(`{ "request": { "request-id": "AH173635G3", "client-id": "QWERTY", "device-id": 405419896 } }`)
+
+	mqttd := MQTTD{HMAC: *hmac}
+	if err := mqttd.verify(message, &mac); err == nil {
+		t.Errorf("Expected 'incorrect HMAC' error for non-canonical message")
+	}
+
+	mqttd.Canonical = true
+	if err := mqttd.verify(message, &mac); err != nil {
+		t.Errorf("Unexpected error verifying canonical HMAC (%v)", err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 )
 
 type msgType int
@@ -18,8 +19,23 @@ const (
 	msgSystem
 )
 
+func (t msgType) String() string {
+	switch t {
+	case msgReply:
+		return "reply"
+	case msgError:
+		return "error"
+	case msgEvent:
+		return "event"
+	case msgSystem:
+		return "system"
+	default:
+		return "unknown"
+	}
+}
+
 func (mqttd *MQTTD) wrap(msgtype msgType, content interface{}, destID *string) ([]byte, error) {
-	bytes, err := json.Marshal(content)
+	bytes, err := mqttd.marshal(content)
 	if err != nil {
 		return nil, err
 	}
@@ -57,7 +73,7 @@ func (mqttd *MQTTD) wrap(msgtype msgType, content interface{}, destID *string) (
 		message.System = body
 	}
 
-	bytes, err = json.Marshal(message)
+	bytes, err = mqttd.marshal(message)
 	if err != nil {
 		return nil, err
 	}
@@ -70,7 +86,7 @@ func (mqttd *MQTTD) wrap(msgtype msgType, content interface{}, destID *string) (
 		HMAC:    hex.EncodeToString(mqttd.HMAC.MAC(bytes)),
 	}
 
-	bytes, err = json.Marshal(payload)
+	bytes, err = mqttd.marshal(payload)
 	if err != nil {
 		return nil, err
 	}
@@ -79,17 +95,32 @@ func (mqttd *MQTTD) wrap(msgtype msgType, content interface{}, destID *string) (
 }
 
 func (mqttd *MQTTD) unwrap(payload []byte) (*request, error) {
+	if enc := sniff(payload); enc != encJSON {
+		return mqttd.unwrapBinary(payload, enc)
+	}
+
+	bytes, signature, err := mqttd.open(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return mqttd.authenticated(encJSON, bytes, bytes, signature)
+}
+
+// Verifies the HMAC of a received message and decrypts the request (if encrypted), returning
+// the request and the request signature (if any).
+func (mqttd *MQTTD) open(payload []byte) ([]byte, *string, error) {
 	message := struct {
 		Message json.RawMessage `json:"message"`
 		HMAC    *string         `json:"hmac"`
 	}{}
 
 	if err := json.Unmarshal(payload, &message); err != nil {
-		return nil, fmt.Errorf("Error unmarshaling message (%v)", err)
+		return nil, nil, badRequest(nil, fmt.Errorf("Error unmarshaling message (%v)", err))
 	}
 
 	if err := mqttd.verify(message.Message, message.HMAC); err != nil {
-		return nil, fmt.Errorf("Invalid message (%v)", err)
+		return nil, nil, unauthenticated(peek(message.Message), fmt.Errorf("Invalid message (%v)", err))
 	}
 
 	body := struct {
@@ -100,7 +131,7 @@ func (mqttd *MQTTD) unwrap(payload []byte) (*request, error) {
 	}{}
 
 	if err := json.Unmarshal(message.Message, &body); err != nil {
-		return nil, fmt.Errorf("Error unmarshaling message body (%v)", err)
+		return nil, nil, badRequest(nil, fmt.Errorf("Error unmarshaling message body (%v)", err))
 	}
 
 	bytes := []byte(body.Request)
@@ -108,42 +139,134 @@ func (mqttd *MQTTD) unwrap(payload []byte) (*request, error) {
 	if body.Key != nil && isBase64(body.Request) {
 		plaintext, err := mqttd.decrypt(bytes, body.IV, *body.Key)
 		if err != nil || plaintext == nil {
-			return nil, fmt.Errorf("Error decrypting message (%v::%v)", err, plaintext)
+			return nil, nil, unauthenticated(nil, fmt.Errorf("Error decrypting message (%v::%v)", err, plaintext))
 		}
 
 		bytes = plaintext
 	}
 
+	return bytes, body.Signature, nil
+}
+
+// Unpacks and authenticates the request meta-info. 'signed' is the signed content of the
+// message, which for a JSON-RPC request is the whole envelope rather than just the 'params'
+// and for a CBOR or MessagePack request is the request before it was transcoded to JSON.
+func (mqttd *MQTTD) authenticated(enc encoding, signed, bytes []byte, signature *string) (*request, error) {
 	misc := struct {
 		ClientID  *string `json:"client-id"`
 		RequestID *string `json:"request-id"`
 		ReplyTo   *string `json:"reply-to"`
 		Nonce     *uint64 `json:"nonce"`
+		Timeout   timeout `json:"timeout"`
+		Encoding  *string `json:"encoding"`
+		ChunkSize *int    `json:"chunk-size"`
 	}{}
 
 	if err := json.Unmarshal(bytes, &misc); err != nil {
-		return nil, fmt.Errorf("Error unmarshaling request meta-info (%v)", err)
+		client := struct {
+			ClientID  *string `json:"client-id"`
+			RequestID *string `json:"request-id"`
+		}{}
+
+		if json.Unmarshal(bytes, &client) != nil {
+			return nil, badRequest(nil, fmt.Errorf("Error unmarshaling request meta-info (%v)", err))
+		}
+
+		return nil, badRequest(&request{ClientID: client.ClientID, RequestID: client.RequestID}, fmt.Errorf("Error unmarshaling request meta-info (%v)", err))
 	}
 
-	authenticated, err := mqttd.authenticate(misc.ClientID, bytes, body.Signature)
+	// NOTE: the reply-to topic is only used for authenticated requests
+	client := request{
+		ClientID:  misc.ClientID,
+		RequestID: misc.RequestID,
+		Encoding:  enc,
+	}
+
+	authenticated, err := mqttd.authenticate(misc.ClientID, signed, bytes, signature)
 	if err != nil {
-		return nil, err
+		return nil, unauthenticated(&client, err)
 	}
 
+	// NOTE: a request with a reused nonce is only refused if there is no cached reply, so that a
+	//       request redelivered by the broker (QoS 1) is answered with the cached reply. The
+	//       request ID may be set later from the MQTT v5 correlation data or the JSON-RPC ID so
+	//       the cache lookup is deferred to 'execute'.
+	var replay error
 	if authenticated {
 		if err := mqttd.Encryption.Nonce.Validate(misc.ClientID, misc.Nonce); err != nil {
-			return nil, fmt.Errorf("Message cannot be authenticated (%v)", err)
+			if mqttd.cache == nil {
+				return nil, replayed(&client, fmt.Errorf("Message cannot be authenticated (%v)", err))
+			}
+
+			replay = fmt.Errorf("Message cannot be authenticated (%v)", err)
 		}
 	}
 
+	reply, err := mqttd.Encoding.reply(misc.ClientID, misc.Encoding, enc)
+	if err != nil {
+		return nil, badRequest(&client, err)
+	}
+
+	chunkSize := 0
+	if misc.ChunkSize != nil {
+		if *misc.ChunkSize < minChunkSize {
+			return nil, badRequest(&client, fmt.Errorf("invalid chunk size %v (minimum is %v)", *misc.ChunkSize, minChunkSize))
+		}
+
+		chunkSize = *misc.ChunkSize
+	}
+
 	return &request{
 		ClientID:  misc.ClientID,
 		RequestID: misc.RequestID,
 		ReplyTo:   misc.ReplyTo,
+		Timeout:   time.Duration(misc.Timeout),
 		Request:   bytes,
+		Encoding:  reply,
+		ChunkSize: chunkSize,
+		replayed:  replay,
 	}, nil
 }
 
+// timeout is the optional 'timeout' field of a request, either as a number of seconds or as a
+// duration string (e.g. "2m30s").
+type timeout time.Duration
+
+func (t *timeout) UnmarshalJSON(bytes []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(bytes, &v); err != nil {
+		return err
+	}
+
+	var d time.Duration
+
+	switch vv := v.(type) {
+	case float64:
+		d = time.Duration(vv * float64(time.Second))
+
+	case string:
+		dd, err := time.ParseDuration(vv)
+		if err != nil {
+			return fmt.Errorf("invalid timeout (%v)", err)
+		}
+
+		d = dd
+
+	case nil:
+
+	default:
+		return fmt.Errorf("invalid timeout (%v)", string(bytes))
+	}
+
+	if d < 0 {
+		return fmt.Errorf("invalid timeout (%v)", d)
+	}
+
+	*t = timeout(d)
+
+	return nil
+}
+
 func (m *MQTTD) verify(message []byte, mac *string) error {
 	if m.HMAC.Required && mac == nil {
 		return errors.New("HMAC required but not present")
@@ -156,7 +279,9 @@ func (m *MQTTD) verify(message []byte, mac *string) error {
 		}
 
 		if !m.HMAC.Verify(message, hmac) {
-			return errors.New("incorrect HMAC")
+			if c, ok := m.canonicalised(message); !ok || !m.HMAC.Verify(c, hmac) {
+				return errors.New("incorrect HMAC")
+			}
 		}
 	}
 
@@ -164,6 +289,22 @@ func (m *MQTTD) verify(message []byte, mac *string) error {
 }
 
 func (m *MQTTD) encrypt(plaintext []byte, clientID *string, msgtype msgType) ([]byte, []byte, error) {
+	ciphertext, key, err := m.seal(plaintext, clientID, msgtype)
+	if err != nil || key == nil {
+		return ciphertext, key, err
+	}
+
+	crypttext, err := json.Marshal(base64.StdEncoding.EncodeToString(ciphertext))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return crypttext, key, nil
+}
+
+// Encrypts a message if outgoing messages are encrypted, returning the raw ciphertext and the
+// encrypted key. Returns the plaintext and a nil key if outgoing messages are not encrypted.
+func (m *MQTTD) seal(plaintext []byte, clientID *string, msgtype msgType) ([]byte, []byte, error) {
 	keytype := "request"
 	switch msgtype {
 	case msgEvent:
@@ -177,17 +318,7 @@ func (m *MQTTD) encrypt(plaintext []byte, clientID *string, msgtype msgType) ([]
 			return nil, nil, fmt.Errorf("Missing client ID")
 		}
 
-		ciphertext, key, err := m.Encryption.RSA.Encrypt(plaintext, *clientID, keytype)
-		if err != nil {
-			return nil, nil, err
-		}
-
-		crypttext, err := json.Marshal(base64.StdEncoding.EncodeToString(ciphertext))
-		if err != nil {
-			return nil, nil, err
-		}
-
-		return crypttext, key, nil
+		return m.Encryption.RSA.Encrypt(plaintext, *clientID, keytype)
 	}
 
 	return plaintext, nil, nil
@@ -206,6 +337,11 @@ func (m *MQTTD) decrypt(request []byte, iv string, key string) ([]byte, error) {
 		return nil, fmt.Errorf("Invalid ciphertext (%v)", err)
 	}
 
+	return m.unseal(ciphertext, iv, key)
+}
+
+// Decrypts a raw ciphertext with the (base64 encoded) encrypted key and (hex encoded) IV.
+func (m *MQTTD) unseal(ciphertext []byte, iv string, key string) ([]byte, error) {
 	keyv, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(key, " ", ""))
 	if err != nil {
 		return nil, fmt.Errorf("Invalid key (%v)", err)
@@ -219,15 +355,17 @@ func (m *MQTTD) decrypt(request []byte, iv string, key string) ([]byte, error) {
 	return m.Encryption.RSA.Decrypt(append(ivv, ciphertext...), keyv, "request")
 }
 
-func (m *MQTTD) authenticate(clientID *string, request []byte, signature *string) (bool, error) {
+func (m *MQTTD) authenticate(clientID *string, signed []byte, request []byte, signature *string) (bool, error) {
 	if (strings.Contains(m.Authentication, "ANY") || strings.Contains(m.Authentication, "RSA")) && clientID != nil && signature != nil {
 		s, err := base64.StdEncoding.DecodeString(*signature)
 		if err != nil {
 			return false, fmt.Errorf("Invalid request: undecodable RSA signature (%v)", err)
 		}
 
-		if err := m.Encryption.RSA.Validate(*clientID, request, s); err != nil {
-			return false, err
+		if err := m.Encryption.RSA.Validate(*clientID, signed, s); err != nil {
+			if c, ok := m.canonicalised(signed); !ok || m.Encryption.RSA.Validate(*clientID, c, s) != nil {
+				return false, err
+			}
 		}
 
 		return true, nil
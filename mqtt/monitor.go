@@ -12,6 +12,39 @@ type SystemMonitor struct {
 	log   *log.Logger
 }
 
+// queueStats is the outbound queue status reported in the 'alive' system messages.
+type queueStats struct {
+	Depth   int    `json:"depth"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// dispatchStats is the request worker pool status reported in the 'alive' system messages. The
+// wait times are in milliseconds.
+type dispatchStats struct {
+	Queued   int    `json:"queued"`
+	Rejected uint64 `json:"rejected"`
+	Dropped  uint64 `json:"dropped"`
+	Wait     struct {
+		Average int64 `json:"average"`
+		Max     int64 `json:"max"`
+	} `json:"wait"`
+}
+
+// aliveMessage is the 'alive' system message published periodically by the system monitor.
+type aliveMessage struct {
+	SubSystem  string         `json:"subsystem"`
+	Message    string         `json:"message"`
+	Reconnects uint64         `json:"reconnects"`
+	Queue      *queueStats    `json:"queue,omitempty"`
+	Dispatch   *dispatchStats `json:"dispatch,omitempty"`
+}
+
+// alertMessage is the 'alert' system message published by the system monitor.
+type alertMessage struct {
+	SubSystem string `json:"subsystem"`
+	Message   string `json:"message"`
+}
+
 var alive = sync.Map{}
 
 func NewSystemMonitor(mqttd *MQTTD, log *log.Logger) *SystemMonitor {
@@ -23,20 +56,35 @@ func NewSystemMonitor(mqttd *MQTTD, log *log.Logger) *SystemMonitor {
 
 func (m *SystemMonitor) Alive(monitor monitoring.Monitor, msg string) error {
 	event := struct {
-		Alive struct {
-			SubSystem string `json:"subsystem"`
-			Message   string `json:"message"`
-		} `json:"alive"`
+		Alive aliveMessage `json:"alive"`
 	}{
-		Alive: struct {
-			SubSystem string `json:"subsystem"`
-			Message   string `json:"message"`
-		}{
-			SubSystem: monitor.ID(),
-			Message:   msg,
+		Alive: aliveMessage{
+			SubSystem:  monitor.ID(),
+			Message:    msg,
+			Reconnects: m.mqttd.reconnects(),
 		},
 	}
 
+	if q := m.mqttd.queue; q != nil {
+		event.Alive.Queue = &queueStats{
+			Depth:   q.depth(),
+			Dropped: q.dropped.Load(),
+		}
+	}
+
+	if p := m.mqttd.pool; p != nil {
+		queued, rejected, dropped, average, max := p.stats()
+
+		event.Alive.Dispatch = &dispatchStats{
+			Queued:   queued,
+			Rejected: rejected,
+			Dropped:  dropped,
+		}
+
+		event.Alive.Dispatch.Wait.Average = average.Milliseconds()
+		event.Alive.Dispatch.Wait.Max = max.Milliseconds()
+	}
+
 	now := time.Now()
 	last, ok := alive.Load(monitor.ID())
 	interval := 60 * time.Second
@@ -57,15 +105,9 @@ func (m *SystemMonitor) Alive(monitor monitoring.Monitor, msg string) error {
 
 func (m *SystemMonitor) Alert(monitor monitoring.Monitor, msg string) error {
 	event := struct {
-		Alert struct {
-			SubSystem string `json:"subsystem"`
-			Message   string `json:"message"`
-		} `json:"alert"`
+		Alert alertMessage `json:"alert"`
 	}{
-		Alert: struct {
-			SubSystem string `json:"subsystem"`
-			Message   string `json:"message"`
-		}{
+		Alert: alertMessage{
 			SubSystem: monitor.ID(),
 			Message:   msg,
 		},
@@ -1,6 +1,7 @@
 package mqtt
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/json"
@@ -9,6 +10,10 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	aws "github.com/aws/aws-sdk-go/aws/credentials"
@@ -18,40 +23,92 @@ import (
 	"github.com/uhppoted/uhppoted-lib/uhppoted"
 	"github.com/uhppoted/uhppoted-mqtt/acl"
 	"github.com/uhppoted/uhppoted-mqtt/auth"
+	"github.com/uhppoted/uhppoted-mqtt/common"
 	"github.com/uhppoted/uhppoted-mqtt/device"
 )
 
 type MQTTD struct {
 	ServerID       string
 	Connection     Connection
-	TLS            *tls.Config
 	Topics         Topics
 	Alerts         Alerts
 	HMAC           auth.HMAC
+	Canonical      bool
 	Encryption     Encryption
 	Authentication string
 	Permissions    auth.Permissions
 	AWS            AWS
 	EventMap       string
 	Protocol       string
+	Queue          Queue
+	Publish        Publish
+	Shared         Shared
+	Dispatch       Dispatch
+	Cache          Cache
+	Encoding       Encoding
+	HomeAssistant  HomeAssistant
+	Embedded       Embedded
+	OnDelivery     func(Delivery)
 	Debug          bool
 
-	client    paho.Client
+	client    client
+	broker    int
+	attempts  atomic.Uint64
+	queue     *queue
+	cache     *cache
+	election  *election
+	pool      *pool
+	ha        *homeassistant
+	doors     *doors
+	embedded  *embedded
+	listening func(chan os.Signal)
+	log       *log.Logger
+	closed    chan struct{}
 	interrupt chan os.Signal
+	guard     sync.RWMutex
 }
 
+// Connection holds the MQTT client connection settings. The brokers are listed in order
+// of preference, with the first broker being the preferred broker.
 type Connection struct {
-	Broker   string
-	ClientID string
+	Brokers   []Broker
+	ClientID  string
+	Version   string
+	Failback  time.Duration
+	Reconnect Reconnect
+}
+
+type Broker struct {
+	URL      string
 	UserName string
 	Password string
+	TLS      *tls.Config
 }
 
+// Topics holds the MQTT topics and the per-topic QoS and retained settings. Critical system
+// messages (alerts) and the server status messages are published with the Alerts settings.
+// RPC is the (optional) topic for JSON-RPC 2.0 requests and Doors is the (optional) root topic
+// for the retained per-door state messages.
 type Topics struct {
 	Requests string
 	Replies  string
 	Events   string
 	System   string
+	Status   string
+	RPC      string
+	Doors    string
+
+	RequestQoS byte
+	ReplyQoS   QoS
+	EventQoS   QoS
+	SystemQoS  QoS
+}
+
+// QoS holds the MQTT quality of service level and retained flag for the messages published
+// to a topic.
+type QoS struct {
+	QoS      byte
+	Retained bool
 }
 
 type Alerts struct {
@@ -74,9 +131,53 @@ type AWS struct {
 	Region      string
 }
 
+// client abstracts the MQTT v3.1.1 and MQTT v5.0 transports
+type client interface {
+	connect() error
+	disconnect(quiesce uint)
+	isConnected() bool
+	subscribe(topic string, qos byte, handler func(incoming)) error
+	publish(topic string, qos byte, retained bool, payload []byte, props *properties) error
+}
+
+// NOTE: client.publish waits (up to the options timeout) for the broker to acknowledge QoS 1 and
+//       QoS 2 messages and for QoS 0 messages to be sent.
+
+type options struct {
+	broker       string
+	clientID     string
+	username     string
+	password     string
+	TLS          *tls.Config
+	timeout      time.Duration
+	will         func() *will
+	connected    func(client)
+	disconnected func(client, error)
+}
+
+// incoming is a transport independent received MQTT message. 'props' is only
+// set for messages received over an MQTT v5 connection.
+type incoming struct {
+	topic   string
+	payload []byte
+	props   *properties
+	ack     func()
+}
+
+// properties holds the MQTT v5 message properties used to correlate requests and replies. The
+// content type is also used to select the encoding for a published message.
+type properties struct {
+	ResponseTopic   string
+	CorrelationData []byte
+	ContentType     string
+	User            userProperties
+}
+
+type userProperties map[string]string
+
 type fdispatch struct {
 	method string
-	f      func(uhppoted.IUHPPOTED, []byte) (interface{}, error)
+	f      func(context.Context, uhppoted.IUHPPOTED, []byte) (interface{}, error)
 }
 
 type dispatcher struct {
@@ -85,21 +186,31 @@ type dispatcher struct {
 	devices  []uhppote.Device
 	log      *log.Logger
 	table    map[string]fdispatch
+	methods  map[string]string
+	schemas  map[string]*methodSchema
 }
 
 type request struct {
-	ClientID  *string
-	RequestID *string
-	ReplyTo   *string
-	Request   []byte
+	ClientID        *string
+	RequestID       *string
+	ReplyTo         *string
+	CorrelationData []byte
+	Timeout         time.Duration
+	Request         []byte
+	RPC             *jsonrpc
+	Encoding        encoding
+	ChunkSize       int
+	replayed        error
 }
 
 type metainfo struct {
-	RequestID *string `json:"request-id,omitempty"`
-	ClientID  *string `json:"client-id,omitempty"`
-	ServerID  string  `json:"server-id,omitempty"`
-	Method    string  `json:"method,omitempty"`
-	Nonce     fnonce  `json:"nonce,omitempty"`
+	RequestID       *string `json:"request-id,omitempty"`
+	ClientID        *string `json:"client-id,omitempty"`
+	ServerID        string  `json:"server-id,omitempty"`
+	Method          string  `json:"method,omitempty"`
+	Nonce           fnonce  `json:"nonce,omitempty"`
+	correlationData []byte
+	encoding        encoding
 }
 
 type fnonce func() uint64
@@ -108,6 +219,17 @@ func (f fnonce) MarshalJSON() ([]byte, error) {
 	return json.Marshal(f())
 }
 
+func (u userProperties) keys() []string {
+	keys := []string{}
+	for k := range u {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
 var regex = struct {
 	clean  *regexp.Regexp
 	base64 *regexp.Regexp
@@ -123,10 +245,25 @@ func (mqttd *MQTTD) Run(u uhppote.IUHPPOTE, devices []uhppote.Device, authorized
 
 	device.SetProtocol(mqttd.Protocol)
 
+	mqttd.log = log
+
 	if mqttd.Debug {
 		paho.DEBUG = log
 	}
 
+	if q, err := newQueue(mqttd.Queue, log); err != nil {
+		log.Printf("WARN  %-12s %v", "mqttd", fmt.Errorf("Outbound queue disabled (%v)", err))
+	} else {
+		mqttd.queue = q
+	}
+
+	cache, err := newCache(mqttd.Cache, log)
+	if err != nil {
+		log.Printf("WARN  %-12s %v", "mqttd", fmt.Errorf("Error loading reply cache (%v)", err))
+	}
+
+	mqttd.cache = cache
+
 	api := uhppoted.UHPPOTED{
 		UHPPOTE:         u,
 		ListenBatchSize: 32,
@@ -148,9 +285,88 @@ func (mqttd *MQTTD) Run(u uhppote.IUHPPOTE, devices []uhppote.Device, authorized
 		NoVerify:    false,
 	}
 
+	if mqttd.Topics.Doors != "" {
+		mqttd.doors = newDoors(mqttd, log)
+	}
+
+	d, err := newDispatcher(mqttd, &api, devices, &dev, &acl, log)
+	if err != nil {
+		return err
+	}
+
+	if len(mqttd.Connection.Brokers) == 0 && !mqttd.Embedded.Enabled {
+		return fmt.Errorf("ERROR: No MQTT broker configured")
+	}
+
+	for topic, qos := range map[string]byte{
+		"requests": mqttd.Topics.RequestQoS,
+		"replies":  mqttd.Topics.ReplyQoS.QoS,
+		"events":   mqttd.Topics.EventQoS.QoS,
+		"system":   mqttd.Topics.SystemQoS.QoS,
+	} {
+		if qos > 2 {
+			return fmt.Errorf("ERROR: Invalid %v QoS (%v)", topic, qos)
+		}
+	}
+
+	for clientID, e := range mqttd.Encoding.Clients {
+		if _, err := parseEncoding(e); err != nil {
+			return fmt.Errorf("ERROR: Invalid reply encoding for client '%v' (%v)", clientID, e)
+		}
+	}
+
+	if mqttd.Shared.enabled() {
+		if mqttd.Shared.Instance == "" {
+			return fmt.Errorf("ERROR: Missing instance ID for shared subscription group '%v'", mqttd.Shared.Group)
+		}
+
+		mqttd.election = &election{
+			topic: mqttd.Topics.System + "/" + mqttd.Shared.Group + "/listener",
+		}
+	}
+
+	if mqttd.Embedded.Enabled {
+		e, err := newEmbedded(mqttd, log)
+		if err != nil {
+			return fmt.Errorf("ERROR: %v", err)
+		} else if err := e.serve(); err != nil {
+			return fmt.Errorf("ERROR: Failed to start embedded MQTT broker (%v)", err)
+		}
+
+		mqttd.embedded = e
+		mqttd.Connection.Brokers = []Broker{{URL: embeddedURL}}
+	}
+
+	mqttd.closed = make(chan struct{})
+	mqttd.pool = newPool(mqttd.Dispatch, mqttd.closed)
+
+	go mqttd.cache.persist(mqttd.closed)
+
+	if mqttd.HomeAssistant.Enabled {
+		mqttd.ha = newHomeAssistant(mqttd, d, devices, log)
+
+		go mqttd.ha.poll()
+	}
+
+	mqttd.subscribeAndServe(d, log)
+
+	if err := mqttd.listen(&api, u, log); err != nil {
+		return fmt.Errorf("ERROR: Failed to bind to listen port '%d': %v", 12345, err)
+	}
+
+	return nil
+}
+
+// Initialises the dispatcher with the dispatch table of request topics and handlers.
+func newDispatcher(mqttd *MQTTD, api *uhppoted.UHPPOTED, devices []uhppote.Device, dev *device.Device, acl *acl.ACL, log *log.Logger) (*dispatcher, error) {
+	schemas, err := loadSchemas()
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: %v", err)
+	}
+
 	d := dispatcher{
 		mqttd:    mqttd,
-		uhppoted: &api,
+		uhppoted: api,
 		devices:  devices,
 		log:      log,
 
@@ -174,7 +390,7 @@ func (mqttd *MQTTD) Run(u uhppote.IUHPPOTE, devices []uhppote.Device, authorized
 			mqttd.Topics.Requests + "/device/time-profile:get":     fdispatch{"get-time-profile", dev.GetTimeProfile},
 			mqttd.Topics.Requests + "/device/time-profile:set":     fdispatch{"set-time-profile", dev.PutTimeProfile},
 			mqttd.Topics.Requests + "/device/time-profiles:get":    fdispatch{"get-time-profiles", dev.GetTimeProfiles},
-			mqttd.Topics.Requests + "/device/time-profiles:set":    fdispatch{"get-time-profiles", dev.PutTimeProfiles},
+			mqttd.Topics.Requests + "/device/time-profiles:set":    fdispatch{"set-time-profiles", dev.PutTimeProfiles},
 			mqttd.Topics.Requests + "/device/time-profiles:delete": fdispatch{"clear-time-profiles", dev.ClearTimeProfiles},
 			mqttd.Topics.Requests + "/device/tasklist:set":         fdispatch{"set-task-list", dev.PutTaskList},
 			mqttd.Topics.Requests + "/device/events:get":           fdispatch{"get-events", dev.GetEvents},
@@ -187,115 +403,174 @@ func (mqttd *MQTTD) Run(u uhppote.IUHPPOTE, devices []uhppote.Device, authorized
 			mqttd.Topics.Requests + "/acl/acl:download": fdispatch{"acl:download", acl.Download},
 			mqttd.Topics.Requests + "/acl/acl:compare":  fdispatch{"acl:compare", acl.Compare},
 		},
+
+		methods: map[string]string{},
+		schemas: schemas,
 	}
 
-	if client, err := mqttd.subscribeAndServe(&d, log); err != nil {
-		return fmt.Errorf("ERROR: Error connecting to '%s': %v", mqttd.Connection.Broker, err)
-	} else {
-		mqttd.client = client
+	d.table[mqttd.Topics.Requests+"/batch:exec"] = fdispatch{"batch", d.batch}
+	d.table[mqttd.Topics.Requests+"/api:get"] = fdispatch{"get-api", d.api}
+
+	if mqttd.doors != nil {
+		topic := mqttd.Topics.Requests + "/device/status:get"
+		d.table[topic] = fdispatch{"get-status", mqttd.doors.observe(d.table[topic].f)}
 	}
 
-	if err := mqttd.listen(&api, u, log); err != nil {
-		return fmt.Errorf("ERROR: Failed to bind to listen port '%d': %v", 12345, err)
+	for topic, fn := range d.table {
+		d.methods[fn.method] = topic
 	}
 
-	return nil
+	return &d, nil
 }
 
 func (m *MQTTD) Close(log *log.Logger) {
-	if m.interrupt != nil {
-		close(m.interrupt)
+	if m.closed != nil {
+		close(m.closed)
 	}
 
-	if m.client != nil {
-		log.Printf("INFO  closing connection to %s", m.Connection.Broker)
-		m.client.Disconnect(250)
-		log.Printf("INFO  closed connection to %s", m.Connection.Broker)
-	}
+	m.stopListener()
 
+	m.guard.Lock()
+	c := m.client
+	broker := m.broker
 	m.client = nil
+	m.guard.Unlock()
+
+	if c != nil {
+		broker := m.Connection.Brokers[broker].URL
+
+		m.resign(c)
+
+		if m.ha != nil {
+			m.ha.available(c, offline)
+		}
+
+		if err := m.publishStatus(c, offline); err != nil {
+			log.Printf("WARN  %-12s %v", "mqttd", err)
+		}
+
+		log.Printf("INFO  closing connection to %s", broker)
+		c.disconnect(250)
+		log.Printf("INFO  closed connection to %s", broker)
+	}
+
+	if m.embedded != nil {
+		m.embedded.close()
+	}
+
+	m.cache.flush()
 }
 
-func (m *MQTTD) subscribeAndServe(d *dispatcher, log *log.Logger) (paho.Client, error) {
-	var handler paho.MessageHandler = func(client paho.Client, msg paho.Message) {
-		d.dispatch(client, msg)
+func (m *MQTTD) subscribeAndServe(d *dispatcher, log *log.Logger) {
+	var newClient func(Broker) client
+
+	var handler = func(msg incoming) {
+		d.dispatch(msg)
 	}
 
-	var connected paho.OnConnectHandler = func(client paho.Client) {
-		options := client.OptionsReader()
-		servers := options.Servers()
-		for _, url := range servers {
-			log.Printf("%-5s %-12s %v", "INFO", "mqttd", fmt.Sprintf("Connected to %s", url))
+	var connected = func(c client, broker Broker) {
+		log.Printf("%-5s %-12s %v", "INFO", "mqttd", fmt.Sprintf("Connected to %s", broker.URL))
+
+		if err := m.publishStatus(c, online); err != nil {
+			log.Printf("WARN  %-12s %v", "mqttd", err)
 		}
 
-		token := m.client.Subscribe(m.Topics.Requests+"/#", 0, handler)
-		if err := token.Error(); err != nil {
-			log.Printf("ERROR unable to subscribe to %s (%v)", m.Topics.Requests, err)
+		if err := c.subscribe(m.requests(), m.Topics.RequestQoS, handler); err != nil {
+			log.Printf("ERROR unable to subscribe to %s (%v)", m.requests(), err)
 			return
 		}
 
-		log.Printf("%-5s %-12s %v", "INFO", "mqttd", fmt.Sprintf("Subscribed to %s", m.Topics.Requests))
+		log.Printf("%-5s %-12s %v", "INFO", "mqttd", fmt.Sprintf("Subscribed to %s", m.requests()))
+
+		if rpc := m.rpc(); rpc != "" {
+			if err := c.subscribe(rpc, m.Topics.RequestQoS, handler); err != nil {
+				log.Printf("ERROR unable to subscribe to %s (%v)", rpc, err)
+			} else {
+				log.Printf("%-5s %-12s %v", "INFO", "mqttd", fmt.Sprintf("Subscribed to %s", rpc))
+			}
+		}
+
+		if e := m.election; e != nil {
+			if err := c.subscribe(e.topic, 1, func(msg incoming) { m.claimed(msg, log) }); err != nil {
+				log.Printf("ERROR unable to subscribe to %s (%v)", e.topic, err)
+			}
+		}
+
+		if m.ha != nil {
+			m.ha.connected(c)
+		}
+
+		if m.doors != nil {
+			m.doors.connected(c)
+		}
 	}
 
-	var disconnected paho.ConnectionLostHandler = func(client paho.Client, err error) {
+	var disconnected = func(c client, err error) {
+		if !m.lost(c) {
+			return
+		}
+
 		log.Printf("ERROR connection to MQTT broker lost (%v)", err)
-		go func() {
-			time.Sleep(10 * time.Second)
-			log.Printf("INFO  retrying connection to MQTT broker %v", m.Connection.Broker)
-			token := client.Connect()
-			if err := token.Error(); err != nil {
-				log.Printf("ERROR failed to reconnect to MQTT broker (%v)", err)
-			}
-		}()
-	}
-
-	// NOTE: Paho auto-reconnect causes a retry storm if two MQTT clients are using the same client ID.
-	//       'Theoretically' (à la Terminator Genesys) the lockfile should prevent this but careful
-	//       misconfiguration is always a possibility.
-	options := paho.
-		NewClientOptions().
-		AddBroker(m.Connection.Broker).
-		SetClientID(m.Connection.ClientID).
-		SetTLSConfig(m.TLS).
-		SetCleanSession(false).
-		SetAutoReconnect(false).
-		SetConnectRetry(true).
-		SetConnectRetryInterval(30 * time.Second).
-		SetOnConnectHandler(connected).
-		SetConnectionLostHandler(disconnected)
-
-	if m.Connection.UserName != "" {
-		options.SetUsername(m.Connection.UserName)
-		if m.Connection.Password != "" {
-			options.SetPassword(m.Connection.Password)
-		}
-	}
-
-	client := paho.NewClient(options)
-	token := client.Connect()
-	if err := token.Error(); err != nil {
-		return nil, err
+		go m.reconnect(newClient, log)
 	}
 
-	return client, nil
+	newClient = func(broker Broker) client {
+		o := options{
+			broker:   broker.URL,
+			clientID: m.Connection.ClientID,
+			username: broker.UserName,
+			password: broker.Password,
+			TLS:      broker.TLS,
+			timeout:  m.Publish.Timeout,
+			will:     m.will,
+			connected: func(c client) {
+				connected(c, broker)
+			},
+			disconnected: disconnected,
+		}
+
+		if m.embedded != nil {
+			return m.embedded.client(o)
+		}
+
+		if m.Connection.isV5() {
+			return newMQTT5(o, log)
+		}
+
+		return newMQTT3(o)
+	}
+
+	if m.Connection.isV5() && m.embedded == nil {
+		log.Printf("%-5s %-12s %v", "INFO", "mqttd", "Using MQTT v5.0")
+	}
+
+	m.broker = -1
+
+	go m.connect(newClient, log)
 }
 
 func (m *MQTTD) listen(api *uhppoted.UHPPOTED, u uhppote.IUHPPOTE, log *log.Logger) error {
 	log.Printf("%-5s %-12s %v", "INFO", "mqttd", fmt.Sprintf("Listening on %v", u.ListenAddr()))
 	log.Printf("%-5s %-12s %v", "INFO", "mqttd", fmt.Sprintf("Publishing events to %s", m.Topics.Events))
 
-	last := uhppoted.NewEventMap(m.EventMap)
-	if err := last.Load(log); err != nil {
-		log.Printf("WARN  Error loading event map [%v]", err)
-	}
-
 	handler := func(e uhppoted.Event) bool {
+		if m.ha != nil {
+			m.ha.event(e)
+		}
+
+		if m.doors != nil {
+			m.doors.event(e)
+		}
+
 		event := struct {
 			Event any `json:"event"`
 		}{
 			Event: device.Transmogrify(e),
 		}
 
+		// NOTE: events are 'critical' i.e. 'send' only returns once the broker has acknowledged the event (or
+		//       the event has been stored in the outbound queue), so the event map is only updated for events that
+		//       have actually been delivered.
 		if err := m.send(&m.Encryption.EventsKeyID, m.Topics.Events, nil, event, msgEvent, true); err != nil {
 			log.Printf("WARN  %-12s %v", "listen", err)
 			return false
@@ -304,160 +579,517 @@ func (m *MQTTD) listen(api *uhppoted.UHPPOTED, u uhppote.IUHPPOTE, log *log.Logg
 		return true
 	}
 
-	m.interrupt = make(chan os.Signal)
+	m.listening = func(interrupt chan os.Signal) {
+		last := uhppoted.NewEventMap(m.EventMap)
+		if err := last.Load(log); err != nil {
+			log.Printf("WARN  Error loading event map [%v]", err)
+		}
 
-	go func() {
-		api.Listen(handler, last, m.interrupt)
-	}()
+		api.Listen(handler, last, interrupt)
+	}
+
+	// ... load balanced instances only run the event listener if elected
+	if m.election != nil {
+		go m.elect(log)
+	} else {
+		m.startListener()
+	}
 
 	return nil
 }
 
-func (d *dispatcher) dispatch(client paho.Client, msg paho.Message) {
-	ctx := context.WithValue(context.Background(), "client", client)
+func (m *MQTTD) startListener() {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+
+	select {
+	case <-m.closed:
+		return
+	default:
+	}
+
+	if m.interrupt == nil && m.listening != nil {
+		m.interrupt = make(chan os.Signal)
+
+		go m.listening(m.interrupt)
+	}
+}
+
+func (m *MQTTD) stopListener() {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+
+	if m.interrupt != nil {
+		close(m.interrupt)
+		m.interrupt = nil
+	}
+}
+
+func (d *dispatcher) dispatch(msg incoming) {
+	ctx := context.WithValue(context.Background(), "client", d.mqttd.current())
 	ctx = context.WithValue(ctx, "log", d.log)
 
-	if fn, ok := d.table[msg.Topic()]; ok {
-		msg.Ack()
+	if fn, ok := d.lookup(msg.topic); ok {
+		if msg.ack != nil {
+			msg.ack()
+		}
 
-		d.log.Printf("DEBUG %-20s %s", "dispatch", string(msg.Payload()))
+		d.log.Printf("DEBUG %-20s %s", "dispatch", string(msg.payload))
 
-		go func() {
-			rq, err := d.mqttd.unwrap(msg.Payload())
-			if err != nil {
-				d.log.Printf("WARN  %-20s %v", "dispatch", err)
-				return
-			}
+		received := time.Now()
 
-			if err := d.mqttd.authorise(rq.ClientID, msg.Topic()); err != nil {
-				d.log.Printf("WARN  %-20s %v", fn.method, fmt.Errorf("Error authorising request (%v)", err))
-				return
-			}
+		if !d.mqttd.pool.submit(fn.method, func() { d.handle(ctx, msg, fn, received) }) {
+			d.queueRejection(msg, func() {
+				d.reject(msg, fn, common.MakeError(StatusServiceUnavailable, "Server busy - request queue full", nil))
+			})
+		}
+	} else if d.mqttd.Topics.RPC != "" && msg.topic == d.mqttd.Topics.RPC {
+		if msg.ack != nil {
+			msg.ack()
+		}
 
-			replyTo := d.mqttd.Topics.Replies
+		d.log.Printf("DEBUG %-20s %s", "dispatch", string(msg.payload))
 
-			if rq.ClientID != nil {
-				replyTo = d.mqttd.Topics.Replies + "/" + *rq.ClientID
-			}
+		received := time.Now()
 
-			if rq.ReplyTo != nil {
-				replyTo = *rq.ReplyTo
-			}
+		if !d.mqttd.pool.submit(rpcMethod, func() { d.invoke(ctx, msg, received) }) {
+			d.queueRejection(msg, func() {
+				d.rejectRPC(msg, common.MakeError(StatusServiceUnavailable, "Server busy - request queue full", nil))
+			})
+		}
+	} else if strings.HasPrefix(msg.topic, d.mqttd.Topics.Requests+"/") {
+		if msg.ack != nil {
+			msg.ack()
+		}
 
-			meta := metainfo{
-				RequestID: rq.RequestID,
-				ClientID:  rq.ClientID,
-				ServerID:  d.mqttd.ServerID,
-				Method:    fn.method,
-				Nonce:     func() uint64 { return d.mqttd.Encryption.Nonce.Next() },
-			}
+		d.log.Printf("DEBUG %-20s %s", "dispatch", string(msg.payload))
 
-			response, err := fn.f(d.uhppoted, rq.Request)
-
-			if err != nil {
-				d.log.Printf("WARN  %-12s %v", fn.method, err)
-				if response != nil {
-					reply := struct {
-						Error interface{} `json:"error"`
-					}{
-						Error: response,
-					}
-
-					if err := d.mqttd.send(rq.ClientID, replyTo, &meta, reply, msgError, false); err != nil {
-						d.log.Printf("WARN  %-20s %v", fn.method, err)
-					}
-				}
-			} else if response != nil {
-				reply := struct {
-					Response interface{} `json:"response"`
-				}{
-					Response: response,
-				}
-
-				if err := d.mqttd.send(rq.ClientID, replyTo, &meta, reply, msgReply, false); err != nil {
-					d.log.Printf("WARN  %-20s %v", fn.method, err)
-				}
-			}
-		}()
+		d.queueRejection(msg, func() { d.unknown(msg) })
 	}
 }
 
+// Queues the reply to a rejected request on the rejection workers, dropping the request without
+// a reply if the rejection queue is full.
+func (d *dispatcher) queueRejection(msg incoming, f func()) {
+	if !d.mqttd.pool.rejection(f) {
+		d.log.Printf("WARN  %-12s %v", "dispatch", fmt.Errorf("Rejection queue full - dropped request on %v", msg.topic))
+	}
+}
+
+// Returns the dispatch table entry for a request topic or device-addressed request topic.
+func (d *dispatcher) lookup(topic string) (fdispatch, bool) {
+	if fn, ok := d.table[topic]; ok {
+		return fn, true
+	}
+
+	if t, _, ok := d.mqttd.addressed(topic); ok {
+		fn, ok := d.table[t]
+		return fn, ok
+	}
+
+	return fdispatch{}, false
+}
+
+// Replies with a '404 Not Found' error to an authenticated request for an unknown method.
+func (d *dispatcher) unknown(msg incoming) {
+	rq, err := d.mqttd.unwrap(msg.payload)
+	if err != nil {
+		d.refuse(msg, "", err)
+		return
+	}
+
+	rq.properties(msg.props)
+
+	d.refuse(msg, "", unknown(rq, fmt.Errorf("Unknown request topic (%v)", msg.topic)))
+}
+
+// Unwraps and authorises a request, returning the request, the reply topic and the reply
+// metainfo.
+func (d *dispatcher) prepare(msg incoming, fn fdispatch) (*request, string, *metainfo, error) {
+	rq, err := d.mqttd.unwrap(msg.payload)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	rq.properties(msg.props)
+
+	if err := d.mqttd.authorise(rq.ClientID, msg.topic); err != nil {
+		return nil, "", nil, unauthorised(rq, fmt.Errorf("Error authorising request (%v)", err))
+	}
+
+	if _, scope, ok := d.mqttd.addressed(msg.topic); ok {
+		request, err := scoped(rq.Request, scope)
+		if err != nil {
+			return nil, "", nil, badRequest(rq, err)
+		}
+
+		rq.Request = request
+	}
+
+	replyTo, meta := d.address(rq, fn.method)
+
+	return rq, replyTo, meta, nil
+}
+
+// Sets the reply topic, correlation data and request ID of a request from the MQTT v5 message
+// properties (if any).
+func (rq *request) properties(props *properties) {
+	if props != nil {
+		rq.CorrelationData = props.CorrelationData
+
+		if rq.ReplyTo == nil && props.ResponseTopic != "" {
+			rq.ReplyTo = &props.ResponseTopic
+		}
+
+		if rq.RequestID == nil && len(props.CorrelationData) > 0 {
+			requestID := string(props.CorrelationData)
+			rq.RequestID = &requestID
+		}
+	}
+}
+
+// Returns the reply topic and reply metainfo for a request.
+func (d *dispatcher) address(rq *request, method string) (string, *metainfo) {
+	replyTo := d.mqttd.Topics.Replies
+
+	if rq.ClientID != nil {
+		replyTo = d.mqttd.Topics.Replies + "/" + *rq.ClientID
+	}
+
+	if rq.ReplyTo != nil {
+		replyTo = *rq.ReplyTo
+	}
+
+	meta := metainfo{
+		RequestID:       rq.RequestID,
+		ClientID:        rq.ClientID,
+		ServerID:        d.mqttd.ServerID,
+		Method:          method,
+		Nonce:           func() uint64 { return d.mqttd.Encryption.Nonce.Next() },
+		correlationData: rq.CorrelationData,
+	}
+
+	// NOTE: JSON-RPC replies are always JSON
+	if rq.RPC == nil {
+		meta.encoding = rq.Encoding
+	}
+
+	return replyTo, &meta
+}
+
+func (d *dispatcher) handle(ctx context.Context, msg incoming, fn fdispatch, received time.Time) {
+	rq, replyTo, meta, err := d.prepare(msg, fn)
+	if err != nil {
+		d.refuse(msg, fn.method, err)
+		return
+	}
+
+	d.execute(ctx, rq, replyTo, meta, fn, received)
+}
+
+// Executes a request, replying with a '504 Gateway Timeout' error if the request deadline
+// passes before the handler has completed. The late response (if any) is discarded.
+func (d *dispatcher) execute(ctx context.Context, rq *request, replyTo string, meta *metainfo, fn fdispatch, received time.Time) {
+	key := rq.key(fn.method)
+	if rq.replayed != nil {
+		if entry, ok := d.mqttd.cache.lookup(key); ok {
+			d.duplicate(rq, replyTo, meta, fn.method, entry)
+		} else {
+			d.log.Printf("WARN  %-12s %v", fn.method, rq.replayed)
+			d.fail(rq, replyTo, meta, fn.method, common.MakeError(StatusConflict, "Request replayed", nil))
+		}
+
+		return
+	}
+
+	if entry, ok := d.mqttd.cache.claim(key); ok {
+		d.duplicate(rq, replyTo, meta, fn.method, entry)
+		return
+	}
+
+	defer d.mqttd.cache.done(key)
+
+	if err := d.validate(fn.method, rq.Request); err != nil {
+		d.log.Printf("WARN  %-12s %v", fn.method, err)
+		d.fail(rq, replyTo, meta, fn.method, common.MakeError(StatusBadRequest, "Invalid request", err))
+		return
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, d.mqttd.Dispatch.deadline(received, rq.Timeout))
+	defer cancel()
+
+	timedout := func() {
+		d.log.Printf("WARN  %-12s %v", fn.method, fmt.Errorf("Request timeout (%v)", ctx.Err()))
+		d.fail(rq, replyTo, meta, fn.method, common.MakeError(StatusGatewayTimeout, "Request timeout", ctx.Err()))
+	}
+
+	if ctx.Err() != nil {
+		timedout()
+		return
+	}
+
+	type result struct {
+		response interface{}
+		err      error
+	}
+
+	executed := make(chan result, 1)
+
+	go func() {
+		response, err := fn.f(ctx, d.uhppoted, rq.Request)
+		executed <- result{response, err}
+	}()
+
+	select {
+	case r := <-executed:
+		if r.err != nil {
+			d.log.Printf("WARN  %-12s %v", fn.method, r.err)
+			d.fail(rq, replyTo, meta, fn.method, r.response)
+		} else {
+			d.reply(rq, replyTo, meta, fn.method, r.response)
+		}
+
+	case <-ctx.Done():
+		timedout()
+
+		// NOTE: waits for the handler to return so that the worker is not released while the
+		//       handler is still talking to the controllers.
+		<-executed
+	}
+}
+
+// Replies with an error to a request that was not executed.
+func (d *dispatcher) reject(msg incoming, fn fdispatch, e *common.Error) {
+	rq, replyTo, meta, err := d.prepare(msg, fn)
+	if err != nil {
+		d.refuse(msg, fn.method, err)
+		return
+	}
+
+	d.log.Printf("WARN  %-12s %v", fn.method, fmt.Errorf("Request rejected (%v)", e.Message))
+	d.fail(rq, replyTo, meta, fn.method, e)
+}
+
+// Sends the response to a request (if any).
+func (d *dispatcher) reply(rq *request, replyTo string, meta *metainfo, method string, response interface{}) {
+	if rq.RPC != nil {
+		d.rpcResult(rq, replyTo, meta, method, response)
+	} else if response != nil {
+		reply := struct {
+			Response interface{} `json:"response"`
+		}{
+			Response: response,
+		}
+
+		d.respond(rq, replyTo, meta, method, reply, msgReply)
+	}
+}
+
+// Sends an error reply to a request (if any).
+func (d *dispatcher) fail(rq *request, replyTo string, meta *metainfo, method string, e interface{}) {
+	if rq.RPC != nil {
+		d.rpcFault(rq, replyTo, meta, method, e)
+	} else if e != nil {
+		reply := struct {
+			Error interface{} `json:"error"`
+		}{
+			Error: e,
+		}
+
+		d.respond(rq, replyTo, meta, method, reply, msgError)
+	}
+}
+
+// Publishes the reply to a request, caching the reply for duplicate requests.
+func (d *dispatcher) respond(rq *request, replyTo string, meta *metainfo, method string, reply interface{}, msgtype msgType) {
+	d.mqttd.cache.put(rq.key(method), msgtype, reply)
+
+	if err := d.sendReply(rq, replyTo, meta, reply, msgtype); err != nil {
+		d.log.Printf("WARN  %-20s %v", method, err)
+	}
+}
+
+// Replies to a duplicate request with the cached reply (if any), flagged as a duplicate. A
+// duplicate of a request that is still executing is ignored.
+func (d *dispatcher) duplicate(rq *request, replyTo string, meta *metainfo, method string, entry *cached) {
+	if entry.pending {
+		d.log.Printf("WARN  %-12s %v", method, fmt.Errorf("Ignoring duplicate request %v (in progress)", rq.key(method)))
+		return
+	}
+
+	if entry.Message == nil {
+		d.log.Printf("WARN  %-12s %v", method, fmt.Errorf("Ignoring duplicate request %v (reply not cached)", rq.key(method)))
+		return
+	}
+
+	d.log.Printf("WARN  %-12s %v", method, fmt.Errorf("Duplicate request %v - replying with cached reply", rq.key(method)))
+
+	reply := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(entry.Message))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&reply); err != nil {
+		d.log.Printf("WARN  %-20s %v", method, fmt.Errorf("Invalid cached reply (%v)", err))
+		return
+	}
+
+	reply["duplicate"] = true
+
+	if err := d.sendReply(rq, replyTo, meta, reply, entry.Type); err != nil {
+		d.log.Printf("WARN  %-20s %v", method, err)
+	}
+}
+
+func (d *dispatcher) sendReply(rq *request, replyTo string, meta *metainfo, reply interface{}, msgtype msgType) error {
+	if rq.RPC != nil {
+		return d.mqttd.post(rq.ClientID, replyTo, meta.properties(), reply, msgtype, false)
+	}
+
+	if msgtype == msgReply && rq.ChunkSize > 0 {
+		return d.sendChunked(rq, replyTo, meta, reply)
+	}
+
+	return d.mqttd.send(rq.ClientID, replyTo, meta, reply, msgtype, false)
+}
+
+// Validates the request permissions for the client. The resource and action for a device-addressed
+// topic (e.g. .../device/405419896:get) are taken from the equivalent unaddressed topic (e.g.
+// .../device:get), with the device (and door) scope.
 func (m *MQTTD) authorise(clientID *string, topic string) error {
 	if m.Permissions.Enabled {
 		if clientID == nil {
 			return errors.New("Request without client-id")
 		}
 
-		match := regexp.MustCompile(`.*?/(\w+):(\w+)$`).FindStringSubmatch(topic)
-		if len(match) != 3 {
+		translated, scope, addressed := m.addressed(topic)
+		if addressed {
+			topic = translated
+		}
+
+		resource, action, ok := resourceAction(topic)
+		if !ok {
 			return fmt.Errorf("Invalid resource:action (%s)", topic)
 		}
 
-		return m.Permissions.Validate(*clientID, match[1], match[2])
+		if addressed {
+			return m.Permissions.ValidateScope(*clientID, resource, action, scope)
+		}
+
+		return m.Permissions.Validate(*clientID, resource, action)
 	}
 
 	return nil
 }
 
-// TODO: add callback for published/failed
-// func (mqttd *MQTTD) send(destID *string, topic string, message interface{}, msgtype msgType, critical bool) error {
-// 	if mqttd.client == nil || !mqttd.client.IsConnected() {
-// 		return errors.New("No connection to MQTT broker")
-// 	}
-//
-// 	m, err := mqttd.wrap(msgtype, message, destID)
-// 	if err != nil {
-// 		return err
-// 	} else if m == nil {
-// 		return errors.New("'wrap' failed to return a publishable message")
-// 	}
-//
-// 	qos := byte(0)
-// 	retained := false
-// 	if critical {
-// 		qos = mqttd.Alerts.QOS
-// 		retained = mqttd.Alerts.Retained
-// 	}
-//
-// 	token := mqttd.client.Publish(topic, qos, retained, string(m))
-// 	if token.Error() != nil {
-// 		return token.Error()
-// 	}
-//
-// 	return nil
-// }
-//
-// TODO: add callback for published/failed
-func (mqttd *MQTTD) send(destID *string, topic string, meta *metainfo, message interface{}, msgtype msgType, critical bool) error {
-	if mqttd.client == nil || !mqttd.client.IsConnected() {
-		return errors.New("No connection to MQTT broker")
+// Extracts the resource and action from a request topic (e.g. .../device/door/delay:get or
+// .../device/time-profile:get).
+func resourceAction(topic string) (string, string, bool) {
+	match := regexp.MustCompile(`.*?/([\w-]+):(\w+)$`).FindStringSubmatch(topic)
+	if len(match) != 3 {
+		return "", "", false
 	}
 
+	return match[1], match[2], true
+}
+
+func (mqttd *MQTTD) send(destID *string, topic string, meta *metainfo, message interface{}, msgtype msgType, critical bool) error {
+	props := meta.properties()
+
 	content, err := compose(meta, message)
 	if err != nil {
 		return err
 	}
 
-	m, err := mqttd.wrap(msgtype, content, destID)
+	return mqttd.post(destID, topic, props, content, msgtype, critical)
+}
+
+// Wraps (signs and encrypts) and publishes a message, encoded as CBOR or MessagePack if the
+// message content type is set and as JSON otherwise.
+func (mqttd *MQTTD) post(destID *string, topic string, props *properties, content interface{}, msgtype msgType, critical bool) error {
+	var m []byte
+	var err error
+
+	if enc := props.encoding(); enc != encJSON {
+		m, err = mqttd.wrapBinary(enc, msgtype, content, destID)
+	} else {
+		m, err = mqttd.wrap(msgtype, content, destID)
+	}
+
 	if err != nil {
 		return err
 	} else if m == nil {
 		return errors.New("'wrap' failed to return a publishable message")
 	}
 
-	qos := byte(0)
-	retained := false
-	if critical {
-		qos = mqttd.Alerts.QOS
-		retained = mqttd.Alerts.Retained
+	qos, retained := mqttd.qos(msgtype, critical)
+
+	msg := queued{
+		Topic:    topic,
+		QoS:      qos,
+		Retained: retained,
+		Payload:  m,
+		Props:    props,
+		Type:     fmt.Sprintf("%v", msgtype),
+		Critical: critical,
+		Queued:   time.Now(),
 	}
 
-	token := mqttd.client.Publish(topic, qos, retained, string(m))
-	if token.Error() != nil {
-		return token.Error()
+	return mqttd.publish(msg, msgtype, critical)
+}
+
+// Returns the QoS and retained flag for a message.
+func (mqttd *MQTTD) qos(msgtype msgType, critical bool) (byte, bool) {
+	switch {
+	case msgtype == msgReply || msgtype == msgError:
+		return mqttd.Topics.ReplyQoS.QoS, mqttd.Topics.ReplyQoS.Retained
+
+	case msgtype == msgEvent:
+		return mqttd.Topics.EventQoS.QoS, mqttd.Topics.EventQoS.Retained
+
+	case critical:
+		return mqttd.Alerts.QOS, mqttd.Alerts.Retained
+
+	default:
+		return mqttd.Topics.SystemQoS.QoS, mqttd.Topics.SystemQoS.Retained
 	}
+}
 
-	return nil
+// Returns the MQTT v5 properties for a reply. The nonce is evaluated once and fixed so that the
+// 'nonce' user property and the 'nonce' field in the message are the same value.
+func (meta *metainfo) properties() *properties {
+	if meta == nil {
+		return nil
+	}
+
+	props := properties{
+		CorrelationData: meta.correlationData,
+		User: userProperties{
+			"method":    meta.Method,
+			"server-id": meta.ServerID,
+		},
+	}
+
+	if meta.RequestID != nil && props.CorrelationData == nil {
+		props.CorrelationData = []byte(*meta.RequestID)
+	}
+
+	if meta.encoding != encJSON {
+		props.ContentType = meta.encoding.contentType()
+	}
+
+	if meta.Nonce != nil {
+		nonce := meta.Nonce()
+		meta.Nonce = func() uint64 { return nonce }
+		props.User["nonce"] = fmt.Sprintf("%v", nonce)
+	}
+
+	return &props
+}
+
+func (c Connection) isV5() bool {
+	version := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(c.Version)), "v")
+
+	return version == "5" || version == "5.0"
 }
 
 func compose(meta *metainfo, content interface{}) (interface{}, error) {
@@ -0,0 +1,102 @@
+package mqtt
+
+import (
+	"fmt"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqtt3 implements the MQTT v3.1.1 client transport using the Eclipse Paho MQTT client.
+type mqtt3 struct {
+	client  paho.Client
+	timeout time.Duration
+}
+
+func newMQTT3(o options) *mqtt3 {
+	c := mqtt3{
+		timeout: o.timeout,
+	}
+
+	if c.timeout <= 0 {
+		c.timeout = defaultPublishTimeout
+	}
+
+	var connected paho.OnConnectHandler = func(client paho.Client) {
+		o.connected(&c)
+	}
+
+	var disconnected paho.ConnectionLostHandler = func(client paho.Client, err error) {
+		o.disconnected(&c, err)
+	}
+
+	// NOTE: Paho auto-reconnect causes a retry storm if two MQTT clients are using the same client ID.
+	//       'Theoretically' (à la Terminator Genesys) the lockfile should prevent this but careful
+	//       misconfiguration is always a possibility.
+	//
+	//       Connect retry is disabled because reconnecting (and broker failover) is managed by MQTTD.
+	options := paho.
+		NewClientOptions().
+		AddBroker(o.broker).
+		SetClientID(o.clientID).
+		SetTLSConfig(o.TLS).
+		SetCleanSession(false).
+		SetAutoReconnect(false).
+		SetConnectRetry(false).
+		SetOnConnectHandler(connected).
+		SetConnectionLostHandler(disconnected)
+
+	if w := o.will(); w != nil {
+		options.SetBinaryWill(w.topic, w.payload, w.qos, true)
+	}
+
+	if o.username != "" {
+		options.SetUsername(o.username)
+		if o.password != "" {
+			options.SetPassword(o.password)
+		}
+	}
+
+	c.client = paho.NewClient(options)
+
+	return &c
+}
+
+func (c *mqtt3) connect() error {
+	token := c.client.Connect()
+	token.Wait()
+
+	return token.Error()
+}
+
+func (c *mqtt3) disconnect(quiesce uint) {
+	c.client.Disconnect(quiesce)
+}
+
+func (c *mqtt3) isConnected() bool {
+	return c.client.IsConnected()
+}
+
+func (c *mqtt3) subscribe(topic string, qos byte, handler func(incoming)) error {
+	var h paho.MessageHandler = func(client paho.Client, msg paho.Message) {
+		handler(incoming{
+			topic:   msg.Topic(),
+			payload: msg.Payload(),
+			ack:     msg.Ack,
+		})
+	}
+
+	token := c.client.Subscribe(topic, qos, h)
+
+	return token.Error()
+}
+
+// MQTT v3.1.1 has no message properties so 'props' is ignored.
+func (c *mqtt3) publish(topic string, qos byte, retained bool, payload []byte, props *properties) error {
+	token := c.client.Publish(topic, qos, retained, string(payload))
+	if !token.WaitTimeout(c.timeout) {
+		return fmt.Errorf("timeout waiting for broker to acknowledge message")
+	}
+
+	return token.Error()
+}
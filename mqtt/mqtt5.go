@@ -0,0 +1,298 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	paho5 "github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session/state"
+)
+
+// mqtt5 implements the MQTT v5.0 client transport using the Eclipse Paho v5 client. Unlike the
+// v3.1.1 client, the v5 client does not manage the network connection so the dial logic is
+// implemented here.
+type mqtt5 struct {
+	options
+	session  *state.State
+	client   *paho5.Client
+	handlers []subscription
+	log      *log.Logger
+	sync.RWMutex
+}
+
+// subscription is a topic filter and message handler. The handlers are kept in subscription
+// order and a received message is dispatched to the first matching handler.
+type subscription struct {
+	filter  string
+	handler func(incoming)
+}
+
+const keepalive = 30
+const timeout5 = 10 * time.Second
+
+func newMQTT5(o options, log *log.Logger) *mqtt5 {
+	if o.timeout <= 0 {
+		o.timeout = defaultPublishTimeout
+	}
+
+	return &mqtt5{
+		options:  o,
+		session:  state.NewInMemory(),
+		handlers: []subscription{},
+		log:      log,
+	}
+}
+
+func (c *mqtt5) connect() error {
+	return c.dial()
+}
+
+func (c *mqtt5) dial() error {
+	conn, err := dial(c.broker, c.TLS)
+	if err != nil {
+		return err
+	}
+
+	var client *paho5.Client
+
+	client = paho5.NewClient(paho5.ClientConfig{
+		ClientID: c.clientID,
+		Conn:     packets.NewThreadSafeConn(conn),
+		Session:  c.session,
+		OnPublishReceived: []func(paho5.PublishReceived) (bool, error){
+			c.received,
+		},
+		OnClientError: func(err error) {
+			c.lost(client, err)
+		},
+		OnServerDisconnect: func(d *paho5.Disconnect) {
+			c.lost(client, fmt.Errorf("disconnected by server (reason code %v)", d.ReasonCode))
+		},
+	})
+
+	expiry := uint32(0xffffffff)
+	cp := paho5.Connect{
+		ClientID:   c.clientID,
+		KeepAlive:  keepalive,
+		CleanStart: false,
+		Properties: &paho5.ConnectProperties{
+			SessionExpiryInterval: &expiry,
+		},
+	}
+
+	if w := c.will(); w != nil {
+		cp.WillMessage = &paho5.WillMessage{
+			Topic:   w.topic,
+			QoS:     w.qos,
+			Retain:  true,
+			Payload: w.payload,
+		}
+	}
+
+	if c.username != "" {
+		cp.Username = c.username
+		cp.UsernameFlag = true
+		if c.password != "" {
+			cp.Password = []byte(c.password)
+			cp.PasswordFlag = true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout5)
+	defer cancel()
+
+	if _, err := client.Connect(ctx, &cp); err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.Lock()
+	c.client = client
+	c.Unlock()
+
+	c.connected(c)
+
+	return nil
+}
+
+func (c *mqtt5) lost(client *paho5.Client, err error) {
+	c.Lock()
+	if c.client != client {
+		c.Unlock()
+		return
+	}
+
+	c.client = nil
+	c.Unlock()
+
+	c.disconnected(c, err)
+}
+
+func (c *mqtt5) disconnect(quiesce uint) {
+	c.Lock()
+	client := c.client
+	c.client = nil
+	c.Unlock()
+
+	if client != nil {
+		time.Sleep(time.Duration(quiesce) * time.Millisecond)
+		client.Disconnect(&paho5.Disconnect{ReasonCode: 0})
+	}
+}
+
+func (c *mqtt5) isConnected() bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.client != nil
+}
+
+func (c *mqtt5) subscribe(topic string, qos byte, handler func(incoming)) error {
+	c.Lock()
+	client := c.client
+	if ix := slices.IndexFunc(c.handlers, func(s subscription) bool { return s.filter == topic }); ix >= 0 {
+		c.handlers[ix].handler = handler
+	} else {
+		c.handlers = append(c.handlers, subscription{filter: topic, handler: handler})
+	}
+	c.Unlock()
+
+	if client == nil {
+		return fmt.Errorf("no connection to MQTT broker")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout5)
+	defer cancel()
+
+	_, err := client.Subscribe(ctx, &paho5.Subscribe{
+		Subscriptions: []paho5.SubscribeOptions{
+			{Topic: topic, QoS: qos},
+		},
+	})
+
+	return err
+}
+
+func (c *mqtt5) publish(topic string, qos byte, retained bool, payload []byte, props *properties) error {
+	c.RLock()
+	client := c.client
+	c.RUnlock()
+
+	if client == nil {
+		return fmt.Errorf("no connection to MQTT broker")
+	}
+
+	p := paho5.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retained,
+		Payload: payload,
+	}
+
+	if props != nil {
+		p.Properties = &paho5.PublishProperties{
+			ResponseTopic:   props.ResponseTopic,
+			CorrelationData: props.CorrelationData,
+			ContentType:     props.ContentType,
+		}
+
+		for _, k := range props.User.keys() {
+			p.Properties.User.Add(k, props.User[k])
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	_, err := client.Publish(ctx, &p)
+
+	return err
+}
+
+func (c *mqtt5) received(pr paho5.PublishReceived) (bool, error) {
+	p := pr.Packet
+	msg := incoming{
+		topic:   p.Topic,
+		payload: p.Payload,
+	}
+
+	if p.Properties != nil {
+		msg.props = &properties{
+			ResponseTopic:   p.Properties.ResponseTopic,
+			CorrelationData: p.Properties.CorrelationData,
+			ContentType:     p.Properties.ContentType,
+			User:            userProperties{},
+		}
+
+		for _, u := range p.Properties.User {
+			msg.props.User[u.Key] = u.Value
+		}
+	}
+
+	// NOTE: the handler is invoked after releasing the lock so that a slow handler does not
+	//       block 'subscribe'
+	var handler func(incoming)
+
+	c.RLock()
+	for _, s := range c.handlers {
+		if matches(s.filter, p.Topic) {
+			handler = s.handler
+			break
+		}
+	}
+	c.RUnlock()
+
+	if handler != nil {
+		handler(msg)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func dial(broker string, tlsConfig *tls.Config) (net.Conn, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "tcp", "mqtt":
+		return net.DialTimeout("tcp", u.Host, timeout5)
+
+	case "tls", "ssl", "mqtts", "tcps":
+		dialer := net.Dialer{Timeout: timeout5}
+		return tls.DialWithDialer(&dialer, "tcp", u.Host, tlsConfig)
+
+	default:
+		return nil, fmt.Errorf("unsupported MQTT v5 broker URL scheme (%v)", u.Scheme)
+	}
+}
+
+// Matches a topic against an MQTT topic filter (including the '+' and '#' wildcards and shared
+// subscriptions).
+func matches(filter string, topic string) bool {
+	f := strings.Split(unshare(filter), "/")
+	t := strings.Split(topic, "/")
+
+	for i, s := range f {
+		if s == "#" {
+			return true
+		}
+
+		if i >= len(t) || (s != "+" && s != t[i]) {
+			return false
+		}
+	}
+
+	return len(f) == len(t)
+}
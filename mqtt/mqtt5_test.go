@@ -0,0 +1,80 @@
+package mqtt
+
+import (
+	"io"
+	"log"
+	"reflect"
+	"testing"
+
+	paho5 "github.com/eclipse/paho.golang/paho"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter   string
+		topic    string
+		expected bool
+	}{
+		{"uhppoted/gateway/requests/#", "uhppoted/gateway/requests/device/status:get", true},
+		{"uhppoted/gateway/requests/#", "uhppoted/gateway/requests", true},
+		{"uhppoted/gateway/requests/#", "uhppoted/gateway/replies/device/status:get", false},
+		{"uhppoted/gateway/+/device/status:get", "uhppoted/gateway/requests/device/status:get", true},
+		{"uhppoted/gateway/+/device/status:get", "uhppoted/gateway/requests/device/time:get", false},
+		{"uhppoted/gateway/requests", "uhppoted/gateway/requests", true},
+		{"uhppoted/gateway/requests", "uhppoted/gateway/requests/devices:get", false},
+		{"$share/uhppoted/uhppoted/gateway/requests/#", "uhppoted/gateway/requests/device/status:get", true},
+		{"$share/uhppoted/uhppoted/gateway/requests/#", "uhppoted/gateway/replies/device/status:get", false},
+	}
+
+	for _, v := range tests {
+		if matches(v.filter, v.topic) != v.expected {
+			t.Errorf("Incorrect match for filter:%v topic:%v - expected:%v, got:%v", v.filter, v.topic, v.expected, !v.expected)
+		}
+	}
+}
+
+func TestMQTT5ReceivedDispatchesInSubscriptionOrder(t *testing.T) {
+	c := newMQTT5(options{}, log.New(io.Discard, "", 0))
+	received := []string{}
+
+	c.subscribe("uhppoted/gateway/requests/device/+", 1, func(msg incoming) {
+		// ... a handler that subscribes deadlocks if the handler is invoked while holding the lock
+		c.subscribe("uhppoted/gateway/events", 1, func(msg incoming) {})
+		received = append(received, "device")
+	})
+	c.subscribe("uhppoted/gateway/requests/#", 1, func(msg incoming) { received = append(received, "requests") })
+	c.subscribe("uhppoted/gateway/#", 1, func(msg incoming) { received = append(received, "gateway") })
+
+	for _, topic := range []string{
+		"uhppoted/gateway/requests/device:get",
+		"uhppoted/gateway/system",
+		"uhppoted/gateway/requests/device/405419896",
+		"uhppoted/gateway/requests/device/405419896",
+		"uhppoted/other",
+	} {
+		for i := 0; i < 10; i++ {
+			c.received(paho5.PublishReceived{Packet: &paho5.Publish{Topic: topic}})
+		}
+	}
+
+	expected := []string{}
+	for _, v := range []string{"requests", "gateway", "device", "device"} {
+		for i := 0; i < 10; i++ {
+			expected = append(expected, v)
+		}
+	}
+
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Incorrect handlers\n   expected:%v\n   got:     %v", expected, received)
+	}
+
+	// ... resubscribing replaces the handler without changing the order
+	c.subscribe("uhppoted/gateway/requests/#", 1, func(msg incoming) { received = append(received, "resubscribed") })
+
+	received = []string{}
+	c.received(paho5.PublishReceived{Packet: &paho5.Publish{Topic: "uhppoted/gateway/requests/device:get"}})
+
+	if !reflect.DeepEqual(received, []string{"resubscribed"}) {
+		t.Errorf("Incorrect handler after resubscribing - expected:%v, got:%v", []string{"resubscribed"}, received)
+	}
+}
@@ -0,0 +1,81 @@
+package mqtt
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uhppoted/uhppoted-mqtt/auth"
+)
+
+func TestResourceAction(t *testing.T) {
+	tests := []struct {
+		topic    string
+		resource string
+		action   string
+		ok       bool
+	}{
+		{"uhppoted/gateway/requests/device:get", "device", "get", true},
+		{"uhppoted/gateway/requests/device/door/delay:set", "delay", "set", true},
+		{"uhppoted/gateway/requests/device/time-profile:get", "time-profile", "get", true},
+		{"uhppoted/gateway/requests/device/special-events:set", "special-events", "set", true},
+		{"uhppoted/gateway/requests/device", "", "", false},
+	}
+
+	for _, v := range tests {
+		resource, action, ok := resourceAction(v.topic)
+		if resource != v.resource || action != v.action || ok != v.ok {
+			t.Errorf("%v: incorrect resource:action - expected:%v:%v (%v), got:%v:%v (%v)", v.topic, v.resource, v.action, v.ok, resource, action, ok)
+		}
+	}
+}
+
+func TestAuthorise(t *testing.T) {
+	dir := t.TempDir()
+	users := filepath.Join(dir, "users")
+	groups := filepath.Join(dir, "groups")
+
+	if err := os.WriteFile(users, []byte("QWERTY  frontdesk\n"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if err := os.WriteFile(groups, []byte("frontdesk  device:get, status:get@405419896, lock:open@405419896/3\n"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	permissions, err := auth.NewPermissions(true, users, groups, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("Error loading permissions (%v)", err)
+	}
+
+	mqttd := MQTTD{
+		Topics:      Topics{Requests: "uhppoted/gateway/requests"},
+		Permissions: *permissions,
+	}
+
+	tests := []struct {
+		topic      string
+		authorised bool
+	}{
+		{"uhppoted/gateway/requests/device:get", true},
+		{"uhppoted/gateway/requests/device/405419896:get", true},
+		{"uhppoted/gateway/requests/device/303986753:get", true},
+		{"uhppoted/gateway/requests/device/405419896/status:get", true},
+		{"uhppoted/gateway/requests/device/303986753/status:get", false},
+		{"uhppoted/gateway/requests/device/status:get", false},
+		{"uhppoted/gateway/requests/device/405419896/door/3/lock:open", true},
+		{"uhppoted/gateway/requests/device/405419896/door/1/lock:open", false},
+		{"uhppoted/gateway/requests/device/405419896/card:get", false},
+	}
+
+	clientID := "QWERTY"
+	for _, v := range tests {
+		if err := mqttd.authorise(&clientID, v.topic); v.authorised && err != nil {
+			t.Errorf("%v: unexpectedly refused (%v)", v.topic, err)
+		} else if !v.authorised && err == nil {
+			t.Errorf("%v: unexpectedly authorised", v.topic)
+		}
+	}
+}
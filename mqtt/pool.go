@@ -0,0 +1,207 @@
+package mqtt
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Dispatch holds the settings for the request worker pool. Requests are executed by a fixed
+// number of workers from a bounded queue and requests received while the queue is full are
+// rejected with a '503 Service Unavailable' error reply. Limits optionally restricts the number
+// of concurrently executing requests for a method (e.g. get-cards) - a limited method has its own
+// queue (of the same size) and workers (one per concurrent request) so that requests waiting for a
+// limited method never hold up requests for other methods. Timeout is the default
+// deadline for a request (measured from when the request was received), which can be overridden
+// by the 'timeout' field of the request.
+//
+// Requests that are rejected before being executed (queue full, unknown request, etc) are replied
+// to by a small fixed pool of workers with its own queue so that a flood of requests cannot start
+// an unbounded number of (RSA decrypting and publishing) goroutines. Rejections received while the
+// rejection queue is full are dropped without a reply.
+type Dispatch struct {
+	Workers int
+	Queue   int
+	Limits  map[string]int
+	Timeout time.Duration
+}
+
+type pool struct {
+	queue    chan job
+	limits   map[string]chan job
+	rejects  chan func()
+	rejected atomic.Uint64
+	dropped  atomic.Uint64
+	executed atomic.Uint64
+	waited   atomic.Int64
+	maxWait  atomic.Int64
+}
+
+type job struct {
+	method string
+	queued time.Time
+	f      func()
+}
+
+const (
+	StatusServiceUnavailable = http.StatusServiceUnavailable
+	StatusGatewayTimeout     = http.StatusGatewayTimeout
+)
+
+const (
+	defaultWorkers = 8
+	defaultQueue   = 64
+	defaultTimeout = 60 * time.Second
+	rejectWorkers  = 2
+	rejectQueue    = 16
+)
+
+func newPool(d Dispatch, closed <-chan struct{}) *pool {
+	workers := d.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	size := d.Queue
+	if size <= 0 {
+		size = defaultQueue
+	}
+
+	p := pool{
+		queue:   make(chan job, size),
+		limits:  map[string]chan job{},
+		rejects: make(chan func(), rejectQueue),
+	}
+
+	for i := 0; i < workers; i++ {
+		go p.work(p.queue, closed)
+	}
+
+	for i := 0; i < rejectWorkers; i++ {
+		go p.reject(closed)
+	}
+
+	for method, limit := range d.Limits {
+		if limit > 0 {
+			queue := make(chan job, size)
+			p.limits[method] = queue
+
+			for i := 0; i < limit; i++ {
+				go p.work(queue, closed)
+			}
+		}
+	}
+
+	return &p
+}
+
+// Returns the deadline for a request received at 'received', using the request timeout if
+// it has one and the default timeout otherwise.
+func (d Dispatch) deadline(received time.Time, timeout time.Duration) time.Time {
+	if timeout > 0 {
+		return received.Add(timeout)
+	} else if d.Timeout > 0 {
+		return received.Add(d.Timeout)
+	}
+
+	return received.Add(defaultTimeout)
+}
+
+// Queues a request for execution, returning false if the queue is full.
+func (p *pool) submit(method string, f func()) bool {
+	queue := p.queue
+	if q, ok := p.limits[method]; ok {
+		queue = q
+	}
+
+	select {
+	case queue <- job{method: method, queued: time.Now(), f: f}:
+		return true
+
+	default:
+		p.rejected.Add(1)
+		return false
+	}
+}
+
+// Queues the reply to a rejected request, returning false if the rejection queue is full.
+func (p *pool) rejection(f func()) bool {
+	select {
+	case p.rejects <- f:
+		return true
+
+	default:
+		p.dropped.Add(1)
+		return false
+	}
+}
+
+// Returns true if the method has a concurrency limit.
+func (p *pool) limited(method string) bool {
+	if p == nil {
+		return false
+	}
+
+	_, ok := p.limits[method]
+
+	return ok
+}
+
+func (p *pool) work(queue <-chan job, closed <-chan struct{}) {
+	for {
+		select {
+		case <-closed:
+			return
+
+		case j := <-queue:
+			p.exec(j)
+		}
+	}
+}
+
+func (p *pool) reject(closed <-chan struct{}) {
+	for {
+		select {
+		case <-closed:
+			return
+
+		case f := <-p.rejects:
+			f()
+		}
+	}
+}
+
+func (p *pool) exec(j job) {
+	wait := time.Since(j.queued)
+
+	p.executed.Add(1)
+	p.waited.Add(int64(wait))
+
+	for {
+		max := p.maxWait.Load()
+		if int64(wait) <= max || p.maxWait.CompareAndSwap(max, int64(wait)) {
+			break
+		}
+	}
+
+	j.f()
+}
+
+// Returns the current queue length, the number of rejected and dropped requests and the average
+// and maximum time requests have waited in the queue before being executed.
+func (p *pool) stats() (queued int, rejected uint64, dropped uint64, average time.Duration, max time.Duration) {
+	queued = len(p.queue)
+	for _, q := range p.limits {
+		queued += len(q)
+	}
+
+	rejected = p.rejected.Load()
+	dropped = p.dropped.Load()
+	max = time.Duration(p.maxWait.Load())
+
+	if N := p.executed.Load(); N > 0 {
+		average = time.Duration(p.waited.Load() / int64(N))
+	}
+
+	return
+}
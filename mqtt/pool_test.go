@@ -0,0 +1,195 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolRejectsWhenQueueFull(t *testing.T) {
+	closed := make(chan struct{})
+	defer close(closed)
+
+	p := newPool(Dispatch{Workers: 1, Queue: 2}, closed)
+	block := make(chan struct{})
+	started := make(chan struct{})
+
+	p.submit("get-cards", func() { close(started); <-block })
+	<-started
+
+	accepted := 0
+	for i := 0; i < 4; i++ {
+		if p.submit("get-cards", func() {}) {
+			accepted++
+		}
+	}
+
+	close(block)
+
+	if accepted != 2 {
+		t.Errorf("Incorrect number of queued requests - expected:%v, got:%v", 2, accepted)
+	}
+
+	if _, rejected, _, _, _ := p.stats(); rejected != 2 {
+		t.Errorf("Incorrect number of rejected requests - expected:%v, got:%v", 2, rejected)
+	}
+}
+
+func TestPoolMethodLimits(t *testing.T) {
+	closed := make(chan struct{})
+	defer close(closed)
+
+	p := newPool(Dispatch{Workers: 4, Queue: 8, Limits: map[string]int{"get-cards": 1}}, closed)
+
+	var wg sync.WaitGroup
+	var running, max atomic.Int32
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		p.submit("get-cards", func() {
+			defer wg.Done()
+
+			if n := running.Add(1); n > max.Load() {
+				max.Store(n)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			running.Add(-1)
+		})
+	}
+
+	wg.Wait()
+
+	if max.Load() != 1 {
+		t.Errorf("Incorrect maximum concurrent get-cards requests - expected:%v, got:%v", 1, max.Load())
+	}
+}
+
+func TestPoolLimitedMethodDoesNotStarveOtherMethods(t *testing.T) {
+	closed := make(chan struct{})
+	defer close(closed)
+
+	p := newPool(Dispatch{Workers: 2, Queue: 8, Limits: map[string]int{"get-cards": 1}}, closed)
+	block := make(chan struct{})
+	started := make(chan struct{})
+
+	defer close(block)
+
+	p.submit("get-cards", func() { close(started); <-block })
+	<-started
+
+	for i := 0; i < 4; i++ {
+		if !p.submit("get-cards", func() { <-block }) {
+			t.Fatalf("get-cards request unexpectedly rejected")
+		}
+	}
+
+	executed := make(chan struct{})
+	if !p.submit("get-device", func() { close(executed) }) {
+		t.Fatalf("get-device request unexpectedly rejected")
+	}
+
+	select {
+	case <-executed:
+	case <-time.After(time.Second):
+		t.Errorf("get-device request not executed while get-cards requests are waiting for the method limit")
+	}
+}
+
+func TestDispatchDeadline(t *testing.T) {
+	received := time.Date(2022, time.August, 1, 12, 30, 45, 0, time.Local)
+
+	tests := []struct {
+		dispatch Dispatch
+		timeout  time.Duration
+		expected time.Time
+	}{
+		{Dispatch{}, 0, received.Add(60 * time.Second)},
+		{Dispatch{Timeout: 15 * time.Second}, 0, received.Add(15 * time.Second)},
+		{Dispatch{Timeout: 15 * time.Second}, 5 * time.Minute, received.Add(5 * time.Minute)},
+	}
+
+	for _, v := range tests {
+		if deadline := v.dispatch.deadline(received, v.timeout); !deadline.Equal(v.expected) {
+			t.Errorf("Incorrect deadline - expected:%v, got:%v", v.expected, deadline)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	tests := []struct {
+		json     string
+		expected time.Duration
+		valid    bool
+	}{
+		{`{}`, 0, true},
+		{`{"timeout":30}`, 30 * time.Second, true},
+		{`{"timeout":2.5}`, 2500 * time.Millisecond, true},
+		{`{"timeout":"2m30s"}`, 150 * time.Second, true},
+		{`{"timeout":"eventually"}`, 0, false},
+		{`{"timeout":-1}`, 0, false},
+	}
+
+	for _, v := range tests {
+		rq := struct {
+			Timeout timeout `json:"timeout"`
+		}{}
+
+		err := json.Unmarshal([]byte(v.json), &rq)
+		if v.valid && err != nil {
+			t.Errorf("Unexpected error unmarshaling %v (%v)", v.json, err)
+		} else if !v.valid && err == nil {
+			t.Errorf("Expected error unmarshaling %v", v.json)
+		} else if time.Duration(rq.Timeout) != v.expected {
+			t.Errorf("Incorrect timeout for %v - expected:%v, got:%v", v.json, v.expected, time.Duration(rq.Timeout))
+		}
+	}
+}
+
+func TestPoolDefaultQueue(t *testing.T) {
+	closed := make(chan struct{})
+	defer close(closed)
+
+	for _, size := range []int{0, -1} {
+		p := newPool(Dispatch{Workers: 1, Queue: size}, closed)
+
+		if N := cap(p.queue); N != defaultQueue {
+			t.Errorf("Incorrect queue size for 'queue' %v - expected:%v, got:%v", size, defaultQueue, N)
+		}
+	}
+}
+
+func TestPoolRejectionsAreBounded(t *testing.T) {
+	closed := make(chan struct{})
+	defer close(closed)
+
+	p := newPool(Dispatch{Workers: 1, Queue: 1}, closed)
+	block := make(chan struct{})
+	started := sync.WaitGroup{}
+
+	started.Add(rejectWorkers)
+	for i := 0; i < rejectWorkers; i++ {
+		p.rejection(func() { started.Done(); <-block })
+	}
+
+	started.Wait()
+
+	accepted := 0
+	for i := 0; i < rejectQueue+4; i++ {
+		if p.rejection(func() {}) {
+			accepted++
+		}
+	}
+
+	close(block)
+
+	if accepted != rejectQueue {
+		t.Errorf("Incorrect number of queued rejections - expected:%v, got:%v", rejectQueue, accepted)
+	}
+
+	if _, _, dropped, _, _ := p.stats(); dropped != 4 {
+		t.Errorf("Incorrect number of dropped rejections - expected:%v, got:%v", 4, dropped)
+	}
+}
@@ -0,0 +1,256 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Queue holds the settings for the persistent outbound message queue. Events, alerts and
+// replies that cannot be published while the connection to the broker is down are stored
+// in the queue directory (one file per message) and published in order once the connection
+// has been re-established. The oldest messages are discarded if the queue exceeds Size
+// messages and messages older than MaxAge are discarded rather than published.
+type Queue struct {
+	Dir    string
+	Size   int
+	MaxAge time.Duration
+}
+
+type queue struct {
+	Queue
+	sequence uint64
+	files    []string // queued message files in publishing order, loaded once at startup
+	draining bool
+	dropped  atomic.Uint64
+	log      *log.Logger
+	sync.Mutex
+}
+
+type queued struct {
+	Topic    string      `json:"topic"`
+	QoS      byte        `json:"qos"`
+	Retained bool        `json:"retained"`
+	Payload  []byte      `json:"payload"`
+	Props    *properties `json:"properties,omitempty"`
+	Type     string      `json:"type,omitempty"`
+	Critical bool        `json:"critical,omitempty"`
+	Queued   time.Time   `json:"queued"`
+}
+
+var queuedFile = regexp.MustCompile(`^([0-9]{20})\.json$`)
+
+// Initialises the queue directory, queued files and sequence number from the messages left
+// over from a previous run. Returns nil if the queue is not enabled.
+func newQueue(q Queue, log *log.Logger) (*queue, error) {
+	if q.Dir == "" || q.Size <= 0 {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(q.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create queue directory '%v' (%v)", q.Dir, err)
+	}
+
+	qq := queue{
+		Queue: q,
+		log:   log,
+	}
+
+	files, err := qq.list()
+	if err != nil {
+		return nil, err
+	}
+
+	qq.files = files
+
+	if N := len(files); N > 0 {
+		match := queuedFile.FindStringSubmatch(files[N-1])
+		if v, err := strconv.ParseUint(match[1], 10, 64); err == nil {
+			qq.sequence = v
+		}
+	}
+
+	return &qq, nil
+}
+
+// Returns the queued message files in the queue directory in publishing order. Only used to
+// initialise the queue - thereafter the queued files are tracked in memory.
+func (q *queue) list() ([]string, error) {
+	entries, err := os.ReadDir(q.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && queuedFile.MatchString(e.Name()) {
+			files = append(files, e.Name())
+		}
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// Appends a message to the queue, discarding the oldest messages if the queue is full.
+func (q *queue) push(msg queued) error {
+	q.Lock()
+	defer q.Unlock()
+
+	for len(q.files) >= q.Size {
+		if err := os.Remove(filepath.Join(q.Dir, q.files[0])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		q.dropped.Add(1)
+		q.log.Printf("WARN  %-12s %v", "mqttd", fmt.Sprintf("Outbound queue full - discarded oldest message %v", q.files[0]))
+
+		q.files = q.files[1:]
+	}
+
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	q.sequence++
+
+	name := fmt.Sprintf("%020d.json", q.sequence)
+	file := filepath.Join(q.Dir, name)
+	tmp := file + ".tmp"
+
+	if err := os.WriteFile(tmp, bytes, 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, file); err != nil {
+		return err
+	}
+
+	q.files = append(q.files, name)
+
+	return nil
+}
+
+// Returns true if there are queued messages waiting to be published (or being published).
+func (q *queue) pending() bool {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.draining || len(q.files) > 0
+}
+
+func (q *queue) depth() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return len(q.files)
+}
+
+// Publishes the queued messages in order, stopping at the first publish error. Expired and
+// unreadable messages are discarded. Only one drain can be in progress at a time.
+func (q *queue) drain(publish func(queued) error) {
+	q.Lock()
+	if q.draining {
+		q.Unlock()
+		return
+	}
+
+	q.draining = true
+	q.Unlock()
+
+	count := 0
+	for {
+		// NOTE: 'draining' is cleared while holding the lock when the queue is empty so that a message
+		//       pushed concurrently is either published by this drain or starts a new drain.
+		q.Lock()
+		if len(q.files) == 0 {
+			q.draining = false
+			q.Unlock()
+			break
+		}
+
+		name := q.files[0]
+		q.Unlock()
+
+		file := filepath.Join(q.Dir, name)
+		msg := queued{}
+
+		if bytes, err := os.ReadFile(file); err != nil {
+			q.log.Printf("WARN  %-12s %v", "mqttd", fmt.Errorf("Error reading queued message %v (%v)", name, err))
+			q.discard(name)
+			continue
+		} else if err := json.Unmarshal(bytes, &msg); err != nil {
+			q.log.Printf("WARN  %-12s %v", "mqttd", fmt.Errorf("Invalid queued message %v (%v)", name, err))
+			q.discard(name)
+			continue
+		}
+
+		if q.MaxAge > 0 && time.Since(msg.Queued) > q.MaxAge {
+			q.log.Printf("WARN  %-12s %v", "mqttd", fmt.Sprintf("Discarded expired queued message %v (queued %v)", name, msg.Queued.Format("2006-01-02 15:04:05")))
+			q.discard(name)
+			continue
+		}
+
+		if err := publish(msg); err != nil {
+			q.stop()
+			q.log.Printf("WARN  %-12s %v", "mqttd", fmt.Errorf("Error publishing queued message %v (%v)", name, err))
+			return
+		}
+
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			q.stop()
+			q.log.Printf("WARN  %-12s %v", "mqttd", fmt.Errorf("Error removing published message %v from queue (%v)", name, err))
+			return
+		}
+
+		q.remove(name)
+		count++
+	}
+
+	if count > 0 {
+		q.log.Printf("%-5s %-12s %v", "INFO", "mqttd", fmt.Sprintf("Published %v queued messages", count))
+	}
+}
+
+func (q *queue) stop() {
+	q.Lock()
+	q.draining = false
+	q.Unlock()
+}
+
+// Discards an unpublishable message. The message is removed from the queue even if the file
+// could not be deleted so that it does not block the queue (it is reloaded on a restart).
+func (q *queue) discard(name string) {
+	if err := os.Remove(filepath.Join(q.Dir, name)); err != nil && !os.IsNotExist(err) {
+		q.log.Printf("WARN  %-12s %v", "mqttd", fmt.Errorf("Error removing queued message %v (%v)", name, err))
+	}
+
+	if q.remove(name) {
+		q.dropped.Add(1)
+	}
+}
+
+// Removes a published or discarded message file from the head of the queue. The file may
+// already have been discarded by a push to a full queue while it was being published, in
+// which case the queue is left as is.
+func (q *queue) remove(name string) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.files) > 0 && q.files[0] == name {
+		q.files = q.files[1:]
+		return true
+	}
+
+	return false
+}
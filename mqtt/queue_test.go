@@ -0,0 +1,126 @@
+package mqtt
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQueueDrain(t *testing.T) {
+	q, err := newQueue(Queue{Dir: t.TempDir(), Size: 3, MaxAge: time.Hour}, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("Error creating queue (%v)", err)
+	}
+
+	for _, topic := range []string{"A", "B", "C", "D"} {
+		if err := q.push(queued{Topic: topic, Queued: time.Now()}); err != nil {
+			t.Fatalf("Error queueing message (%v)", err)
+		}
+	}
+
+	q.push(queued{Topic: "E", Queued: time.Now().Add(-2 * time.Hour)})
+
+	if depth := q.depth(); depth != 3 {
+		t.Errorf("Incorrect queue depth - expected:%v, got:%v", 3, depth)
+	}
+
+	published := []string{}
+	q.drain(func(msg queued) error {
+		published = append(published, msg.Topic)
+		return nil
+	})
+
+	if expected := []string{"C", "D"}; !reflect.DeepEqual(published, expected) {
+		t.Errorf("Incorrect published messages - expected:%v, got:%v", expected, published)
+	}
+
+	if dropped := q.dropped.Load(); dropped != 3 {
+		t.Errorf("Incorrect dropped count - expected:%v, got:%v", 3, dropped)
+	}
+
+	if q.pending() {
+		t.Errorf("Expected empty queue after drain")
+	}
+}
+
+func TestQueueReload(t *testing.T) {
+	dir := t.TempDir()
+	logger := log.New(io.Discard, "", 0)
+
+	q, _ := newQueue(Queue{Dir: dir, Size: 10}, logger)
+	q.push(queued{Topic: "A", Queued: time.Now()})
+	q.push(queued{Topic: "B", Queued: time.Now()})
+
+	q, err := newQueue(Queue{Dir: dir, Size: 10}, logger)
+	if err != nil {
+		t.Fatalf("Error reloading queue (%v)", err)
+	}
+
+	q.push(queued{Topic: "C", Queued: time.Now()})
+
+	published := []string{}
+	q.drain(func(msg queued) error {
+		published = append(published, msg.Topic)
+		return nil
+	})
+
+	if expected := []string{"A", "B", "C"}; !reflect.DeepEqual(published, expected) {
+		t.Errorf("Incorrect published messages - expected:%v, got:%v", expected, published)
+	}
+}
+
+func TestQueueDepthIsNotRescanned(t *testing.T) {
+	dir := t.TempDir()
+
+	q, err := newQueue(Queue{Dir: dir, Size: 10}, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("Error creating queue (%v)", err)
+	}
+
+	q.push(queued{Topic: "A", Queued: time.Now()})
+	q.push(queued{Topic: "B", Queued: time.Now()})
+
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000099.json"), []byte("{}"), 0600); err != nil {
+		t.Fatalf("Error creating queue file (%v)", err)
+	}
+
+	if depth := q.depth(); depth != 2 {
+		t.Errorf("Incorrect queue depth - expected:%v, got:%v", 2, depth)
+	}
+}
+
+func TestQueuePushWhileDraining(t *testing.T) {
+	q, err := newQueue(Queue{Dir: t.TempDir(), Size: 2}, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("Error creating queue (%v)", err)
+	}
+
+	q.push(queued{Topic: "A", Queued: time.Now()})
+	q.push(queued{Topic: "B", Queued: time.Now()})
+
+	published := []string{}
+	q.drain(func(msg queued) error {
+		if msg.Topic == "A" {
+			q.push(queued{Topic: "C", Queued: time.Now()})
+		}
+
+		published = append(published, msg.Topic)
+		return nil
+	})
+
+	if expected := []string{"A", "B", "C"}; !reflect.DeepEqual(published, expected) {
+		t.Errorf("Incorrect published messages - expected:%v, got:%v", expected, published)
+	}
+
+	if depth := q.depth(); depth != 0 {
+		t.Errorf("Incorrect queue depth - expected:%v, got:%v", 0, depth)
+	}
+
+	if q.pending() {
+		t.Errorf("Expected empty queue after drain")
+	}
+}
@@ -0,0 +1,61 @@
+package mqtt
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Reconnect is the policy for reconnecting to the MQTT brokers after the connection is lost
+// (or could not be established). The delay between retries starts at Delay and is increased
+// by Multiplier after every failed retry, up to MaxDelay. The delay is randomised by +/- Jitter
+// (as a fraction of the delay) so that multiple daemons do not reconnect in lockstep when
+// a broker is restarted. Retries continue indefinitely until connected.
+type Reconnect struct {
+	Delay      time.Duration
+	MaxDelay   time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+const (
+	defaultReconnectDelay    = 10 * time.Second
+	defaultReconnectMaxDelay = 5 * time.Minute
+	defaultReconnectFactor   = 2.0
+)
+
+// Returns the randomised delay before the retry following 'retry' previous failed retries.
+func (r Reconnect) delay(retry int) time.Duration {
+	return r.backoff(retry, rand.Float64())
+}
+
+// Returns the delay for 'retry' with the jitter randomised by 'random' (in the range [0,1)).
+func (r Reconnect) backoff(retry int, random float64) time.Duration {
+	delay := r.Delay
+	if delay <= 0 {
+		delay = defaultReconnectDelay
+	}
+
+	max := r.MaxDelay
+	if max <= 0 {
+		max = defaultReconnectMaxDelay
+	}
+
+	multiplier := r.Multiplier
+	if multiplier < 1.0 {
+		multiplier = defaultReconnectFactor
+	}
+
+	jitter := math.Min(math.Max(r.Jitter, 0.0), 1.0)
+
+	d := math.Min(float64(delay)*math.Pow(multiplier, float64(retry)), float64(max))
+	d = d * (1.0 + jitter*(2.0*random-1.0))
+
+	return time.Duration(d).Round(time.Millisecond)
+}
+
+// Returns the total number of attempts to reconnect to the MQTT brokers since the service
+// was started.
+func (m *MQTTD) reconnects() uint64 {
+	return m.attempts.Load()
+}
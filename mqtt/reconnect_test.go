@@ -0,0 +1,48 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	policy := Reconnect{
+		Delay:      10 * time.Second,
+		MaxDelay:   60 * time.Second,
+		Multiplier: 2.0,
+		Jitter:     0.25,
+	}
+
+	tests := []struct {
+		retry    int
+		random   float64
+		expected time.Duration
+	}{
+		{0, 0.5, 10 * time.Second},
+		{1, 0.5, 20 * time.Second},
+		{2, 0.5, 40 * time.Second},
+		{3, 0.5, 60 * time.Second},
+		{10, 0.5, 60 * time.Second},
+		{0, 0.0, 7500 * time.Millisecond},
+		{1, 1.0, 25 * time.Second},
+		{5, 0.0, 45 * time.Second},
+	}
+
+	for _, v := range tests {
+		if delay := policy.backoff(v.retry, v.random); delay != v.expected {
+			t.Errorf("Incorrect delay for retry %v - expected:%v, got:%v", v.retry, v.expected, delay)
+		}
+	}
+}
+
+func TestReconnectBackoffDefaults(t *testing.T) {
+	policy := Reconnect{}
+
+	if delay := policy.backoff(0, 0.5); delay != defaultReconnectDelay {
+		t.Errorf("Incorrect default initial delay - expected:%v, got:%v", defaultReconnectDelay, delay)
+	}
+
+	if delay := policy.backoff(100, 0.5); delay != defaultReconnectMaxDelay {
+		t.Errorf("Incorrect default maximum delay - expected:%v, got:%v", defaultReconnectMaxDelay, delay)
+	}
+}
@@ -0,0 +1,129 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/uhppoted/uhppoted-mqtt/common"
+)
+
+const (
+	StatusBadRequest   = http.StatusBadRequest
+	StatusUnauthorized = http.StatusUnauthorized
+	StatusForbidden    = http.StatusForbidden
+	StatusNotFound     = http.StatusNotFound
+	StatusConflict     = http.StatusConflict
+)
+
+// refused is the error for a request that could not be unwrapped, authenticated or authorised,
+// with the code and (deliberately non-specific) message for the error reply. 'rq' holds whatever
+// could be extracted from the message to address the reply and is nil if the client is unknown.
+type refused struct {
+	code    int
+	message string
+	rq      *request
+	err     error
+}
+
+func (r *refused) Error() string {
+	return r.err.Error()
+}
+
+func (r *refused) Unwrap() error {
+	return r.err
+}
+
+func badRequest(rq *request, err error) error {
+	return &refused{StatusBadRequest, "Invalid request", rq, err}
+}
+
+func unauthenticated(rq *request, err error) error {
+	return &refused{StatusUnauthorized, "Request not authenticated", rq, err}
+}
+
+func unauthorised(rq *request, err error) error {
+	return &refused{StatusForbidden, "Request not authorised", rq, err}
+}
+
+func replayed(rq *request, err error) error {
+	return &refused{StatusConflict, "Request replayed", rq, err}
+}
+
+func unknown(rq *request, err error) error {
+	return &refused{StatusNotFound, "Unknown request", rq, err}
+}
+
+// Logs a refused request and replies with an error if the client is known.
+func (d *dispatcher) refuse(msg incoming, method string, err error) {
+	tag := method
+	if tag == "" {
+		tag = "dispatch"
+	}
+
+	d.log.Printf("WARN  %-20s %v", tag, err)
+
+	var r *refused
+	if !errors.As(err, &r) || r.rq == nil || r.rq.ClientID == nil {
+		return
+	}
+
+	rq := r.rq
+	if msg.props != nil {
+		rq.CorrelationData = msg.props.CorrelationData
+	}
+
+	replyTo, meta := d.address(rq, method)
+
+	d.fail(rq, replyTo, meta, method, common.MakeError(r.code, r.message, nil))
+}
+
+// Extracts the client-id and request-id (if possible) from a message that could not be
+// authenticated, for addressing the error reply. The reply-to topic is deliberately ignored
+// so that an unauthenticated message cannot direct replies to an arbitrary topic.
+func peek(message []byte) *request {
+	body := struct {
+		Request json.RawMessage `json:"request"`
+	}{}
+
+	if err := json.Unmarshal(message, &body); err != nil {
+		return nil
+	}
+
+	misc := struct {
+		ClientID  *string `json:"client-id"`
+		RequestID *string `json:"request-id"`
+		Version   *string `json:"jsonrpc"`
+	}{}
+
+	if err := json.Unmarshal(body.Request, &misc); err != nil {
+		return nil
+	}
+
+	rq := request{
+		ClientID:  misc.ClientID,
+		RequestID: misc.RequestID,
+	}
+
+	if misc.Version != nil {
+		envelope := jsonrpc{}
+		params := struct {
+			ClientID  *string `json:"client-id"`
+			RequestID *string `json:"request-id"`
+		}{}
+
+		if err := json.Unmarshal(body.Request, &envelope); err == nil {
+			json.Unmarshal(envelope.Params, &params)
+
+			rq = request{
+				ClientID:  params.ClientID,
+				RequestID: params.RequestID,
+				RPC:       &envelope,
+			}
+
+			rq.rpcID()
+		}
+	}
+
+	return &rq
+}
@@ -0,0 +1,87 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/uhppoted/uhppoted-mqtt/auth"
+)
+
+func TestUnwrapRefused(t *testing.T) {
+	tests := []struct {
+		mqttd     *MQTTD
+		payload   string
+		code      int
+		clientID  string
+		requestID string
+	}{
+		{
+			&MQTTD{Authentication: "NONE"},
+			`{"message":{"request":`,
+			StatusBadRequest, "", "",
+		},
+		{
+			&MQTTD{Authentication: "NONE"},
+			`{"message":{"request":{"client-id":"QWERTY","request-id":"AH173635G3","timeout":"eventually"}}}`,
+			StatusBadRequest, "QWERTY", "AH173635G3",
+		},
+		{
+			&MQTTD{Authentication: "NONE", HMAC: auth.HMAC{Required: true}},
+			`{"message":{"request":{"client-id":"QWERTY","request-id":"AH173635G3","reply-to":"elsewhere"}}}`,
+			StatusUnauthorized, "QWERTY", "AH173635G3",
+		},
+		{
+			&MQTTD{Authentication: "HOTP"},
+			`{"message":{"request":{"client-id":"QWERTY","request-id":"AH173635G3"}}}`,
+			StatusUnauthorized, "QWERTY", "AH173635G3",
+		},
+		{
+			&MQTTD{Authentication: "HOTP"},
+			`{"message":{"request":{"request-id":"AH173635G3"}}}`,
+			StatusUnauthorized, "", "AH173635G3",
+		},
+	}
+
+	for _, v := range tests {
+		_, err := v.mqttd.unwrap([]byte(v.payload))
+
+		var r *refused
+		if !errors.As(err, &r) {
+			t.Fatalf("Expected 'refused' error for %v, got:%v", v.payload, err)
+		}
+
+		if r.code != v.code {
+			t.Errorf("Incorrect error code for %v - expected:%v, got:%v", v.payload, v.code, r.code)
+		}
+
+		var clientID, requestID string
+		if r.rq != nil {
+			clientID = deref(r.rq.ClientID)
+			requestID = deref(r.rq.RequestID)
+
+			if r.rq.ReplyTo != nil {
+				t.Errorf("Unexpected reply-to for refused request %v", v.payload)
+			}
+		}
+
+		if clientID != v.clientID || requestID != v.requestID {
+			t.Errorf("Incorrect client-id/request-id for %v - expected:%v/%v, got:%v/%v", v.payload, v.clientID, v.requestID, clientID, requestID)
+		}
+	}
+}
+
+func TestPeekRPC(t *testing.T) {
+	rq := peek([]byte(`{"request":{"jsonrpc":"2.0","method":"get-status","params":{"client-id":"QWERTY"},"id":17}}`))
+
+	if rq == nil || rq.RPC == nil {
+		t.Fatalf("Failed to extract JSON-RPC request")
+	}
+
+	if clientID := deref(rq.ClientID); clientID != "QWERTY" {
+		t.Errorf("Incorrect client-id - expected:%v, got:%v", "QWERTY", clientID)
+	}
+
+	if requestID := deref(rq.RequestID); requestID != "17" {
+		t.Errorf("Incorrect request-id - expected:%v, got:%v", "17", requestID)
+	}
+}
@@ -0,0 +1,209 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/uhppoted/uhppoted-mqtt/common"
+)
+
+// jsonrpc is a JSON-RPC 2.0 request envelope. The method is the dispatch table method name
+// (e.g. get-status) and the params are the request fields that would otherwise be sent to the
+// method request topic. ID is nil for a notification (a request without an 'id').
+type jsonrpc struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// JSON-RPC 2.0 predefined error codes. Errors returned by the request handlers use the
+// common.Error code (e.g. 400, 404, 504).
+const (
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInternalError  = -32603
+)
+
+// Pseudo-method for queueing JSON-RPC requests, which are only resolved to a method after being
+// unwrapped.
+const rpcMethod = "rpc"
+
+// Unwraps a JSON-RPC request. The HMAC, signature and encryption apply to the JSON-RPC envelope
+// and the request meta-info (client-id, reply-to, nonce, etc.) is taken from the 'params'.
+func (mqttd *MQTTD) unwrapRPC(payload []byte) (*request, error) {
+	bytes, signature, err := mqttd.open(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := jsonrpc{}
+	if err := json.Unmarshal(bytes, &envelope); err != nil {
+		return nil, badRequest(nil, fmt.Errorf("Error unmarshaling JSON-RPC request (%v)", err))
+	}
+
+	params := []byte(envelope.Params)
+	if len(params) == 0 || string(params) == "null" {
+		params = []byte("{}")
+	}
+
+	rq, err := mqttd.authenticated(encJSON, bytes, params, signature)
+	if err != nil {
+		var r *refused
+		if errors.As(err, &r) && r.rq != nil {
+			r.rq.RPC = &envelope
+			r.rq.rpcID()
+		}
+
+		return nil, err
+	}
+
+	rq.RPC = &envelope
+	rq.rpcID()
+
+	return rq, nil
+}
+
+// Sets the request ID from the JSON-RPC 'id' if the request does not have a 'request-id'.
+func (rq *request) rpcID() {
+	if id := rq.RPC.ID; rq.RequestID == nil && id != nil && string(id) != "null" {
+		var requestID string
+		if err := json.Unmarshal(id, &requestID); err != nil {
+			requestID = string(id)
+		}
+
+		rq.RequestID = &requestID
+	}
+}
+
+// Unwraps, authorises and executes a JSON-RPC request with the dispatch table method handler.
+// Invoked from the worker pool, with requests for a method with a concurrency limit requeued on
+// the method queue.
+func (d *dispatcher) invoke(ctx context.Context, msg incoming, received time.Time) {
+	rq, err := d.mqttd.unwrapRPC(msg.payload)
+	if err != nil {
+		d.refuse(msg, "", err)
+		return
+	}
+
+	rq.properties(msg.props)
+
+	method := rq.RPC.Method
+	topic, ok := d.methods[method]
+	replyTo, meta := d.address(rq, method)
+
+	if rq.RPC.Version != "2.0" {
+		d.log.Printf("WARN  %-20s %v", "rpc", fmt.Errorf("Invalid JSON-RPC version (%v)", rq.RPC.Version))
+		d.rpcFault(rq, replyTo, meta, method, rpcError{Code: rpcInvalidRequest, Message: "Invalid request"})
+		return
+	}
+
+	if !ok {
+		d.log.Printf("WARN  %-20s %v", "rpc", fmt.Errorf("Unknown JSON-RPC method (%v)", method))
+		d.rpcFault(rq, replyTo, meta, method, rpcError{Code: rpcMethodNotFound, Message: "Method not found"})
+		return
+	}
+
+	if err := d.mqttd.authorise(rq.ClientID, topic); err != nil {
+		d.refuse(msg, method, unauthorised(rq, fmt.Errorf("Error authorising request (%v)", err)))
+		return
+	}
+
+	fn := d.table[topic]
+
+	if !d.mqttd.pool.limited(fn.method) {
+		d.execute(ctx, rq, replyTo, meta, fn, received)
+	} else if !d.mqttd.pool.submit(fn.method, func() { d.execute(ctx, rq, replyTo, meta, fn, received) }) {
+		d.log.Printf("WARN  %-12s %v", fn.method, fmt.Errorf("Request rejected (%v)", "Server busy - request queue full"))
+		d.fail(rq, replyTo, meta, fn.method, common.MakeError(StatusServiceUnavailable, "Server busy - request queue full", nil))
+	}
+}
+
+// Replies with an error to a JSON-RPC request that was not executed.
+func (d *dispatcher) rejectRPC(msg incoming, e *common.Error) {
+	rq, err := d.mqttd.unwrapRPC(msg.payload)
+	if err != nil {
+		d.refuse(msg, "", err)
+		return
+	}
+
+	rq.properties(msg.props)
+
+	method := rq.RPC.Method
+	replyTo, meta := d.address(rq, method)
+
+	if topic, ok := d.methods[method]; ok {
+		if err := d.mqttd.authorise(rq.ClientID, topic); err != nil {
+			d.refuse(msg, method, unauthorised(rq, fmt.Errorf("Error authorising request (%v)", err)))
+			return
+		}
+	}
+
+	d.log.Printf("WARN  %-20s %v", "rpc", fmt.Errorf("Request rejected (%v)", e.Message))
+	d.fail(rq, replyTo, meta, method, e)
+}
+
+// Sends a JSON-RPC 'result' reply. Notifications are not replied to.
+func (d *dispatcher) rpcResult(rq *request, replyTo string, meta *metainfo, method string, response interface{}) {
+	reply := struct {
+		Version string          `json:"jsonrpc"`
+		Result  interface{}     `json:"result"`
+		ID      json.RawMessage `json:"id"`
+	}{
+		Version: "2.0",
+		Result:  response,
+		ID:      rq.RPC.ID,
+	}
+
+	if rq.RPC.ID != nil {
+		d.respond(rq, replyTo, meta, method, reply, msgReply)
+	}
+}
+
+// Sends a JSON-RPC 'error' reply, translating a common.Error into a JSON-RPC error object with
+// the same code. Notifications are not replied to.
+func (d *dispatcher) rpcFault(rq *request, replyTo string, meta *metainfo, method string, e interface{}) {
+	var err rpcError
+
+	switch v := e.(type) {
+	case rpcError:
+		err = v
+
+	case *common.Error:
+		err = rpcError{Code: v.Code, Message: v.Message}
+		if v.Debug != "" {
+			err.Data = v.Debug
+		}
+
+	default:
+		err = rpcError{Code: rpcInternalError, Message: "Internal error", Data: e}
+	}
+
+	id := rq.RPC.ID
+	if id == nil && err.Code == rpcInvalidRequest {
+		id = json.RawMessage("null")
+	}
+
+	reply := struct {
+		Version string          `json:"jsonrpc"`
+		Error   rpcError        `json:"error"`
+		ID      json.RawMessage `json:"id"`
+	}{
+		Version: "2.0",
+		Error:   err,
+		ID:      id,
+	}
+
+	if id != nil {
+		d.respond(rq, replyTo, meta, method, reply, msgReply)
+	}
+}
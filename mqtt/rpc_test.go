@@ -0,0 +1,72 @@
+package mqtt
+
+import (
+	"testing"
+)
+
+func TestUnwrapRPC(t *testing.T) {
+	mqttd := MQTTD{
+		Authentication: "NONE",
+	}
+
+	tests := []struct {
+		payload   string
+		method    string
+		clientID  string
+		requestID string
+		params    string
+		reply     bool
+	}{
+		{
+			`{"message":{"request":{"jsonrpc":"2.0","method":"get-status","params":{"client-id":"QWERTY","device-id":405419896},"id":17}}}`,
+			"get-status", "QWERTY", "17", `{"client-id":"QWERTY","device-id":405419896}`, true,
+		},
+		{
+			`{"message":{"request":{"jsonrpc":"2.0","method":"get-devices","params":{"client-id":"QWERTY"},"id":"AH173635G3"}}}`,
+			"get-devices", "QWERTY", "AH173635G3", `{"client-id":"QWERTY"}`, true,
+		},
+		{
+			`{"message":{"request":{"jsonrpc":"2.0","method":"get-devices","params":{"client-id":"QWERTY","request-id":"R1"},"id":"AH173635G3"}}}`,
+			"get-devices", "QWERTY", "R1", `{"client-id":"QWERTY","request-id":"R1"}`, true,
+		},
+		{
+			`{"message":{"request":{"jsonrpc":"2.0","method":"get-devices"}}}`,
+			"get-devices", "", "", `{}`, false,
+		},
+	}
+
+	for _, v := range tests {
+		rq, err := mqttd.unwrapRPC([]byte(v.payload))
+		if err != nil {
+			t.Fatalf("Unexpected error unwrapping %v (%v)", v.payload, err)
+		}
+
+		if rq.RPC.Method != v.method {
+			t.Errorf("Incorrect method - expected:%v, got:%v", v.method, rq.RPC.Method)
+		}
+
+		if clientID := deref(rq.ClientID); clientID != v.clientID {
+			t.Errorf("Incorrect client ID - expected:%v, got:%v", v.clientID, clientID)
+		}
+
+		if requestID := deref(rq.RequestID); requestID != v.requestID {
+			t.Errorf("Incorrect request ID - expected:%v, got:%v", v.requestID, requestID)
+		}
+
+		if string(rq.Request) != v.params {
+			t.Errorf("Incorrect request - expected:%v, got:%v", v.params, string(rq.Request))
+		}
+
+		if reply := rq.RPC.ID != nil; reply != v.reply {
+			t.Errorf("Incorrect notification - expected:%v, got:%v", !v.reply, !reply)
+		}
+	}
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+
+	return *s
+}
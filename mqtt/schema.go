@@ -0,0 +1,264 @@
+package mqtt
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed schemas.json
+var schemasJSON []byte
+
+// methodSchema holds the description and the JSON Schema for the request and reply of a
+// dispatch table method. The request schema describes only the method fields - the request
+// meta-info (client-id, request-id, reply-to, etc.) is common to all requests.
+type methodSchema struct {
+	Description string          `json:"description"`
+	Request     json.RawMessage `json:"request"`
+	Reply       json.RawMessage `json:"reply"`
+
+	request *schema
+}
+
+// schema is the subset of JSON Schema used to describe the requests and replies (type, enum,
+// minimum/maximum, pattern, properties, required, additionalProperties, items and
+// minItems/maxItems). Annotations (description, format, etc.) are ignored.
+type schema struct {
+	Type                 schemaTypes        `json:"type"`
+	Enum                 []interface{}      `json:"enum"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	Pattern              string             `json:"pattern"`
+	Properties           map[string]*schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *schema            `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+
+	pattern *regexp.Regexp
+	never   bool
+}
+
+type schemaTypes []string
+
+// Loads the embedded request and reply schemas, keyed by method.
+func loadSchemas() (map[string]*methodSchema, error) {
+	schemas := map[string]*methodSchema{}
+	if err := json.Unmarshal(schemasJSON, &schemas); err != nil {
+		return nil, fmt.Errorf("Invalid request schemas (%v)", err)
+	}
+
+	for method, s := range schemas {
+		s.request = &schema{}
+		if err := json.Unmarshal(s.Request, s.request); err != nil {
+			return nil, fmt.Errorf("Invalid request schema for %v (%v)", method, err)
+		}
+	}
+
+	return schemas, nil
+}
+
+// Validates a request against the method request schema.
+func (m *methodSchema) validate(request []byte) error {
+	if len(request) == 0 {
+		request = []byte("{}")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(request))
+	decoder.UseNumber()
+
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return fmt.Errorf("Cannot parse request (%v)", err)
+	}
+
+	return m.request.validate("request", v)
+}
+
+func (s *schema) UnmarshalJSON(b []byte) error {
+	switch string(b) {
+	case "true":
+		*s = schema{}
+		return nil
+
+	case "false":
+		*s = schema{never: true}
+		return nil
+	}
+
+	type plain schema
+
+	p := plain{}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+
+	if p.Pattern != "" {
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return err
+		}
+
+		p.pattern = re
+	}
+
+	*s = schema(p)
+
+	return nil
+}
+
+func (t *schemaTypes) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*t = schemaTypes{s}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+
+	*t = schemaTypes(list)
+
+	return nil
+}
+
+func (s *schema) validate(path string, v interface{}) error {
+	if s.never {
+		return fmt.Errorf("%v: unexpected field", path)
+	}
+
+	if len(s.Type) > 0 && !s.Type.matches(v) {
+		return fmt.Errorf("%v: invalid type (expected %v)", path, strings.Join(s.Type, " or "))
+	}
+
+	if len(s.Enum) > 0 {
+		ok := false
+		for _, e := range s.Enum {
+			if fmt.Sprintf("%v", e) == fmt.Sprintf("%v", v) {
+				ok = true
+				break
+			}
+		}
+
+		if !ok {
+			return fmt.Errorf("%v: invalid value '%v'", path, v)
+		}
+	}
+
+	switch value := v.(type) {
+	case json.Number:
+		f, err := value.Float64()
+		if err != nil {
+			return fmt.Errorf("%v: invalid number '%v'", path, value)
+		}
+
+		if s.Minimum != nil && f < *s.Minimum {
+			return fmt.Errorf("%v: %v is less than %v", path, value, strconv.FormatFloat(*s.Minimum, 'f', -1, 64))
+		}
+
+		if s.Maximum != nil && f > *s.Maximum {
+			return fmt.Errorf("%v: %v is greater than %v", path, value, strconv.FormatFloat(*s.Maximum, 'f', -1, 64))
+		}
+
+	case string:
+		if s.pattern != nil && !s.pattern.MatchString(value) {
+			return fmt.Errorf("%v: invalid value '%v'", path, value)
+		}
+
+	case []interface{}:
+		if s.MinItems != nil && len(value) < *s.MinItems {
+			return fmt.Errorf("%v: expected at least %v items", path, *s.MinItems)
+		}
+
+		if s.MaxItems != nil && len(value) > *s.MaxItems {
+			return fmt.Errorf("%v: expected at most %v items", path, *s.MaxItems)
+		}
+
+		if s.Items != nil {
+			for i, item := range value {
+				if err := s.Items.validate(fmt.Sprintf("%v[%v]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+
+	case map[string]interface{}:
+		for _, field := range s.Required {
+			if _, ok := value[field]; !ok {
+				return fmt.Errorf("%v: missing '%v'", path, field)
+			}
+		}
+
+		keys := []string{}
+		for k := range value {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			p := path + "." + k
+			if property, ok := s.Properties[k]; ok {
+				if err := property.validate(p, value[k]); err != nil {
+					return err
+				}
+			} else if s.AdditionalProperties != nil {
+				if err := s.AdditionalProperties.validate(p, value[k]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (t schemaTypes) matches(v interface{}) bool {
+	for _, name := range t {
+		switch value := v.(type) {
+		case nil:
+			if name == "null" {
+				return true
+			}
+
+		case bool:
+			if name == "boolean" {
+				return true
+			}
+
+		case string:
+			if name == "string" {
+				return true
+			}
+
+		case json.Number:
+			if name == "number" {
+				return true
+			}
+
+			if _, err := strconv.ParseInt(value.String(), 10, 64); err == nil && name == "integer" {
+				return true
+			}
+
+		case []interface{}:
+			if name == "array" {
+				return true
+			}
+
+		case map[string]interface{}:
+			if name == "object" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,72 @@
+package mqtt
+
+import (
+	"testing"
+)
+
+func TestLoadSchemas(t *testing.T) {
+	schemas, err := loadSchemas()
+	if err != nil {
+		t.Fatalf("Error loading request schemas (%v)", err)
+	}
+
+	for _, method := range []string{
+		"get-devices", "get-device", "get-status", "get-time", "set-time", "get-door-delay", "set-door-delay",
+		"get-door-control", "set-door-control", "open-door", "record-special-events", "get-cards", "delete-cards",
+		"get-card", "put-card", "delete-card", "get-time-profile", "set-time-profile", "get-time-profiles",
+		"set-time-profiles", "clear-time-profiles", "set-task-list", "get-events", "get-event",
+		"acl:show", "acl:grant", "acl:revoke", "acl:upload", "acl:download", "acl:compare",
+		"batch", "get-api",
+	} {
+		if s, ok := schemas[method]; !ok {
+			t.Errorf("Missing schema for %v", method)
+		} else if len(s.Request) == 0 || len(s.Reply) == 0 {
+			t.Errorf("Missing request/reply schema for %v", method)
+		}
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	schemas, err := loadSchemas()
+	if err != nil {
+		t.Fatalf("Error loading request schemas (%v)", err)
+	}
+
+	tests := []struct {
+		method   string
+		request  string
+		expected string
+	}{
+		{"get-devices", ``, ""},
+		{"get-device", `{"client-id":"QWERTY","request-id":"AB","device-id":405419896}`, ""},
+		{"get-device", `{"client-id":"QWERTY"}`, "request: missing 'device-id'"},
+		{"get-device", `{"device-id":"405419896"}`, "request.device-id: invalid type (expected integer)"},
+		{"get-device", `{"device-id":0}`, "request.device-id: 0 is less than 1"},
+		{"get-device", `{"device-id":405419896.5}`, "request.device-id: invalid type (expected integer)"},
+		{"set-door-control", `{"device-id":405419896,"door":3,"control":"controlled"}`, ""},
+		{"set-door-control", `{"device-id":405419896,"door":5,"control":"controlled"}`, "request.door: 5 is greater than 4"},
+		{"set-door-control", `{"device-id":405419896,"door":3,"control":"open"}`, "request.control: invalid value 'open'"},
+		{"set-time", `{"device-id":405419896,"date-time":"2022-08-01 12:34:56"}`, ""},
+		{"set-time", `{"device-id":405419896,"date-time":"2022-08-01"}`, "request.date-time: invalid value '2022-08-01'"},
+		{"put-card", `{"device-id":405419896,"card":{"card-number":8165538,"start-date":"2022-01-01","end-date":"2022-12-31","doors":{"1":true,"2":29}}}`, ""},
+		{"put-card", `{"device-id":405419896,"card":{"card-number":8165538,"doors":{"1":"yes"}}}`, "request.card.doors.1: invalid type (expected boolean or integer)"},
+		{"get-event", `{"device-id":405419896,"event-index":"last"}`, ""},
+		{"get-event", `{"device-id":405419896,"event-index":17}`, ""},
+		{"get-event", `{"device-id":405419896,"event-index":"previous"}`, "request.event-index: invalid value 'previous'"},
+		{"set-task-list", `{"device-id":405419896,"tasks":[{"task":"enable time profile","start-date":"2022-01-01","end-date":"2022-12-31"},{"task":1}]}`, "request.tasks[1]: missing 'start-date'"},
+		{"batch", `{"requests":[]}`, "request.requests: expected at least 1 items"},
+		{"get-cards", `{"device-id":405419896,"offset":1,"limit":100}`, ""},
+		{"get-cards", `{"device-id":405419896,"offset":1,"limit":9223372036854775807}`, "request.limit: 9223372036854775807 is greater than 2147483647"},
+		{"get-events", `{"device-id":405419896,"limit":2147483648}`, "request.limit: 2147483648 is greater than 2147483647"},
+		{"acl:show", `{"card-number":8165538,"offset":1,"limit":9223372036854775807}`, "request.limit: 9223372036854775807 is greater than 2147483647"},
+	}
+
+	for _, v := range tests {
+		err := schemas[v.method].validate([]byte(v.request))
+		if v.expected == "" && err != nil {
+			t.Errorf("%v: unexpected error validating %v (%v)", v.method, v.request, err)
+		} else if v.expected != "" && (err == nil || err.Error() != v.expected) {
+			t.Errorf("%v: incorrect validation error for %v\n   expected:%v\n   got:     %v", v.method, v.request, v.expected, err)
+		}
+	}
+}
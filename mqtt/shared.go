@@ -0,0 +1,187 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shared holds the settings for running multiple load balanced instances of the daemon against
+// the same broker. Requests are received using an MQTT shared subscription for Group (so each
+// request is only handled by one instance) and the instances elect a single instance (identified
+// by Instance) to run the UDP event listener, using a retained lease on the election topic that is
+// renewed by the elected instance every Lease/3.
+type Shared struct {
+	Group    string
+	Instance string
+	Lease    time.Duration
+}
+
+type election struct {
+	topic   string
+	leader  string
+	expires time.Time
+	elected bool
+	sync.Mutex
+}
+
+type claim struct {
+	Instance string `json:"instance"`
+	Lease    uint32 `json:"lease"`
+}
+
+const defaultLease = 30 * time.Second
+
+func (s Shared) enabled() bool {
+	return s.Group != ""
+}
+
+func (s Shared) lease() time.Duration {
+	if s.Lease <= 0 {
+		return defaultLease
+	}
+
+	return s.Lease
+}
+
+// Returns the requests topic filter, as a shared subscription if running as a load balanced
+// instance.
+func (m *MQTTD) requests() string {
+	if m.Shared.enabled() {
+		return fmt.Sprintf("$share/%v/%v/#", m.Shared.Group, m.Topics.Requests)
+	}
+
+	return m.Topics.Requests + "/#"
+}
+
+// Returns the JSON-RPC topic filter (if not already covered by the requests topic filter), as a
+// shared subscription if running as a load balanced instance.
+func (m *MQTTD) rpc() string {
+	if m.Topics.RPC == "" || matches(m.Topics.Requests+"/#", m.Topics.RPC) {
+		return ""
+	} else if m.Shared.enabled() {
+		return fmt.Sprintf("$share/%v/%v", m.Shared.Group, m.Topics.RPC)
+	}
+
+	return m.Topics.RPC
+}
+
+// Periodically renews (or claims) the event listener lease and starts/stops the event listener
+// depending on whether this instance holds the lease.
+func (m *MQTTD) elect(log *log.Logger) {
+	tick := time.NewTicker(m.Shared.lease() / 3)
+	defer tick.Stop()
+
+	for {
+		m.campaign(log)
+
+		select {
+		case <-m.closed:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func (m *MQTTD) campaign(log *log.Logger) {
+	e := m.election
+	me := m.Shared.Instance
+
+	e.Lock()
+	leader := e.leader
+	expired := time.Now().After(e.expires)
+	e.Unlock()
+
+	if leader == "" || leader == me || expired {
+		c := claim{
+			Instance: me,
+			Lease:    uint32(m.Shared.lease().Seconds()),
+		}
+
+		if client := m.current(); client != nil && client.isConnected() {
+			if bytes, err := json.Marshal(c); err != nil {
+				log.Printf("WARN  %-12s %v", "mqttd", err)
+			} else if err := client.publish(e.topic, 1, true, bytes, nil); err != nil {
+				log.Printf("WARN  %-12s %v", "mqttd", fmt.Errorf("Error renewing event listener lease (%v)", err))
+			}
+		}
+	}
+
+	m.elected(log)
+}
+
+// Handler for the election topic. An empty message releases the lease.
+func (m *MQTTD) claimed(msg incoming, log *log.Logger) {
+	e := m.election
+	c := claim{}
+
+	if len(msg.payload) > 0 {
+		if err := json.Unmarshal(msg.payload, &c); err != nil {
+			log.Printf("WARN  %-12s %v", "mqttd", fmt.Errorf("Invalid event listener lease (%v)", err))
+			return
+		}
+	}
+
+	lease := time.Duration(c.Lease) * time.Second
+	if lease <= 0 {
+		lease = m.Shared.lease()
+	}
+
+	// NOTE: the lease expiry is relative to the local time the claim was received to avoid
+	//       depending on the clocks of the instances being synchronised.
+	e.Lock()
+	e.leader = c.Instance
+	e.expires = time.Now().Add(lease)
+	e.Unlock()
+
+	m.elected(log)
+}
+
+// Starts the event listener if this instance holds an unexpired lease, stops it otherwise.
+func (m *MQTTD) elected(log *log.Logger) {
+	e := m.election
+	me := m.Shared.Instance
+
+	e.Lock()
+	elected := e.leader == me && time.Now().Before(e.expires)
+	changed := elected != e.elected
+	e.elected = elected
+	leader := e.leader
+	e.Unlock()
+
+	if changed && elected {
+		log.Printf("%-5s %-12s %v", "INFO", "mqttd", fmt.Sprintf("Instance %v elected to run event listener", me))
+		m.startListener()
+	} else if changed {
+		log.Printf("%-5s %-12s %v", "INFO", "mqttd", fmt.Sprintf("Stopping event listener (elected instance is '%v')", leader))
+		m.stopListener()
+	}
+}
+
+// Releases the event listener lease (if held) so that another instance can take over
+// without waiting for the lease to expire.
+func (m *MQTTD) resign(c client) {
+	if e := m.election; e != nil && c != nil && c.isConnected() {
+		e.Lock()
+		elected := e.elected
+		e.Unlock()
+
+		if elected {
+			c.publish(e.topic, 1, true, []byte{}, nil)
+		}
+	}
+}
+
+// Removes the '$share/<group>/' prefix from a shared subscription topic filter.
+func unshare(filter string) string {
+	if strings.HasPrefix(filter, "$share/") {
+		if parts := strings.SplitN(filter, "/", 3); len(parts) == 3 {
+			return parts[2]
+		}
+	}
+
+	return filter
+}
@@ -0,0 +1,78 @@
+package mqtt
+
+import (
+	"errors"
+	"time"
+
+	"github.com/uhppoted/uhppote-core/types"
+)
+
+const (
+	online  = "online"
+	offline = "offline"
+)
+
+// will is the MQTT 'last will and testament' message published (retained) by the broker if
+// the connection is lost without a clean disconnect.
+type will struct {
+	topic   string
+	qos     byte
+	payload []byte
+}
+
+// Returns the retained 'offline' message registered with the broker as the last will and
+// testament for the connection.
+func (m *MQTTD) will() *will {
+	payload, err := m.status(offline)
+	if err != nil {
+		return nil
+	}
+
+	return &will{
+		topic:   m.Topics.Status,
+		qos:     m.Alerts.QOS,
+		payload: payload,
+	}
+}
+
+// Publishes a retained 'online'/'offline' status message to the server status topic.
+func (m *MQTTD) publishStatus(c client, state string) error {
+	if c == nil || !c.isConnected() {
+		return errors.New("No connection to MQTT broker")
+	}
+
+	payload, err := m.status(state)
+	if err != nil {
+		return err
+	}
+
+	return c.publish(m.Topics.Status, m.Alerts.QOS, true, payload, nil)
+}
+
+// statusMessage is the retained 'online'/'offline' server status message.
+type statusMessage struct {
+	ServerID  string         `json:"server-id"`
+	Status    string         `json:"status"`
+	Timestamp types.DateTime `json:"timestamp"`
+}
+
+func (m *MQTTD) status(state string) ([]byte, error) {
+	message := struct {
+		Status statusMessage `json:"status"`
+	}{
+		Status: statusMessage{
+			ServerID:  m.ServerID,
+			Status:    state,
+			Timestamp: types.DateTime(time.Now()),
+		},
+	}
+
+	payload, err := m.wrap(msgSystem, message, &m.Encryption.SystemKeyID)
+	if err != nil {
+		return nil, err
+	} else if payload == nil {
+		return nil, errors.New("'wrap' failed to return a publishable message")
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,176 @@
+package simulator
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/uhppoted/uhppote-core/types"
+)
+
+// Maximum number of tasks in a controller task list.
+const maxTasks = 64
+
+func (s *Simulator) GetCards(deviceID uint32) (uint32, error) {
+	return get(s, deviceID, func(c *controller) (uint32, error) {
+		return uint32(len(c.cards)), nil
+	})
+}
+
+// Returns the card at the (1-based) index, or nil if there is no card at the index.
+func (s *Simulator) GetCardByIndex(deviceID, index uint32) (*types.Card, error) {
+	return get(s, deviceID, func(c *controller) (*types.Card, error) {
+		if index < 1 || index > uint32(len(c.cards)) {
+			return nil, nil
+		}
+
+		card := c.cards[index-1]
+
+		return &card, nil
+	})
+}
+
+func (s *Simulator) GetCardByID(deviceID, cardNumber uint32) (*types.Card, error) {
+	return get(s, deviceID, func(c *controller) (*types.Card, error) {
+		if card, ok := c.card(cardNumber); ok {
+			return &card, nil
+		}
+
+		return nil, nil
+	})
+}
+
+// Adds or replaces a card. The card list is kept sorted by card number, the same as the
+// controller card list.
+func (s *Simulator) PutCard(deviceID uint32, card types.Card) (bool, error) {
+	return get(s, deviceID, func(c *controller) (bool, error) {
+		if card.CardNumber == 0 || card.CardNumber == 0xffffffff {
+			return false, nil
+		}
+
+		for door, profile := range card.Doors {
+			if door < 1 || door > 4 {
+				return false, fmt.Errorf("invalid door (%v)", door)
+			} else if _, ok := c.profiles[profile]; profile > 1 && !ok {
+				return false, fmt.Errorf("time profile %v is not defined", profile)
+			}
+		}
+
+		doors := map[uint8]uint8{1: 0, 2: 0, 3: 0, 4: 0}
+		for door, profile := range card.Doors {
+			doors[door] = profile
+		}
+
+		card.Doors = doors
+
+		ix := sort.Search(len(c.cards), func(i int) bool { return c.cards[i].CardNumber >= card.CardNumber })
+		if ix < len(c.cards) && c.cards[ix].CardNumber == card.CardNumber {
+			c.cards[ix] = card
+		} else {
+			c.cards = append(c.cards[:ix], append([]types.Card{card}, c.cards[ix:]...)...)
+		}
+
+		return true, nil
+	})
+}
+
+func (s *Simulator) DeleteCard(deviceID uint32, cardNumber uint32) (bool, error) {
+	return get(s, deviceID, func(c *controller) (bool, error) {
+		for i, card := range c.cards {
+			if card.CardNumber == cardNumber {
+				c.cards = append(c.cards[:i], c.cards[i+1:]...)
+				return true, nil
+			}
+		}
+
+		return false, nil
+	})
+}
+
+func (s *Simulator) DeleteCards(deviceID uint32) (bool, error) {
+	return get(s, deviceID, func(c *controller) (bool, error) {
+		c.cards = []types.Card{}
+
+		return true, nil
+	})
+}
+
+// Returns the time profile, or nil if the profile is not defined.
+func (s *Simulator) GetTimeProfile(deviceID uint32, profileID uint8) (*types.TimeProfile, error) {
+	return get(s, deviceID, func(c *controller) (*types.TimeProfile, error) {
+		if profile, ok := c.profiles[profileID]; ok {
+			return &profile, nil
+		}
+
+		return nil, nil
+	})
+}
+
+func (s *Simulator) SetTimeProfile(deviceID uint32, profile types.TimeProfile) (bool, error) {
+	return get(s, deviceID, func(c *controller) (bool, error) {
+		if profile.ID < 2 || profile.ID > 254 {
+			return false, fmt.Errorf("invalid time profile ID (%v)", profile.ID)
+		} else if profile.From == nil || profile.To == nil {
+			return false, fmt.Errorf("time profile %v requires a start and end date", profile.ID)
+		}
+
+		if linked := profile.LinkedProfileID; linked != 0 {
+			if _, ok := c.profiles[linked]; !ok {
+				return false, nil
+			}
+		}
+
+		c.profiles[profile.ID] = profile
+
+		return true, nil
+	})
+}
+
+func (s *Simulator) ClearTimeProfiles(deviceID uint32) (bool, error) {
+	return get(s, deviceID, func(c *controller) (bool, error) {
+		c.profiles = map[uint8]types.TimeProfile{}
+
+		return true, nil
+	})
+}
+
+// ClearTaskList, AddTask and RefreshTaskList model the controller task list: tasks are added
+// to a pending list which replaces the active task list when the task list is refreshed.
+func (s *Simulator) ClearTaskList(deviceID uint32) (bool, error) {
+	return get(s, deviceID, func(c *controller) (bool, error) {
+		c.pending = []types.Task{}
+
+		return true, nil
+	})
+}
+
+func (s *Simulator) AddTask(deviceID uint32, task types.Task) (bool, error) {
+	return get(s, deviceID, func(c *controller) (bool, error) {
+		if len(c.pending) >= maxTasks {
+			return false, nil
+		} else if _, ok := c.doors[task.Door]; !ok {
+			return false, fmt.Errorf("invalid door (%v)", task.Door)
+		}
+
+		c.pending = append(c.pending, task)
+
+		return true, nil
+	})
+}
+
+func (s *Simulator) RefreshTaskList(deviceID uint32) (bool, error) {
+	return get(s, deviceID, func(c *controller) (bool, error) {
+		c.tasks = c.pending
+		c.pending = []types.Task{}
+
+		return true, nil
+	})
+}
+
+func (c *controller) card(cardNumber uint32) (types.Card, bool) {
+	ix := sort.Search(len(c.cards), func(i int) bool { return c.cards[i].CardNumber >= cardNumber })
+	if ix < len(c.cards) && c.cards[ix].CardNumber == cardNumber {
+		return c.cards[ix], true
+	}
+
+	return types.Card{}, false
+}
@@ -0,0 +1,350 @@
+package simulator
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/uhppoted/uhppote-core/types"
+	"github.com/uhppoted/uhppote-core/uhppote"
+)
+
+// Event types and reasons recorded by the simulated controllers.
+const (
+	eventSwipe uint8 = 1
+	eventDoor  uint8 = 2
+
+	reasonSwipe          uint8 = 1
+	reasonNoAccess       uint8 = 6
+	reasonNormallyClosed uint8 = 11
+	reasonTimePeriod     uint8 = 13
+	reasonPushButton     uint8 = 20
+	reasonDoorOpened     uint8 = 23
+	reasonDoorClosed     uint8 = 24
+	reasonRemoteOpen     uint8 = 44
+)
+
+// Time a door stays open after being unlocked.
+const opened = 3 * time.Second
+
+// Maximum number of events waiting to be delivered to the listener, after which events are
+// dropped (as with a lost UDP event packet, the event is still in the controller event log).
+const pendingEvents = 256
+
+// Returns the event at the index, the first event for index 0 and the last event for index
+// 0xffffffff. Returns nil if there is no event at the index and an 'overwritten' error if
+// the event has been discarded from the event log.
+func (s *Simulator) GetEvent(deviceID, index uint32) (*types.Event, error) {
+	return get(s, deviceID, func(c *controller) (*types.Event, error) {
+		N := len(c.events)
+		if N == 0 {
+			return nil, nil
+		}
+
+		first := c.events[0].Index
+		last := c.events[N-1].Index
+
+		switch {
+		case index == 0:
+			e := c.events[0]
+			return &e, nil
+
+		case index == 0xffffffff:
+			e := c.events[N-1]
+			return &e, nil
+
+		case index < first:
+			return nil, fmt.Errorf("event at index %v has been overwritten", index)
+
+		case index > last:
+			return nil, nil
+
+		default:
+			e := c.events[index-first]
+			return &e, nil
+		}
+	})
+}
+
+func (s *Simulator) GetEventIndex(deviceID uint32) (*types.EventIndex, error) {
+	return get(s, deviceID, func(c *controller) (*types.EventIndex, error) {
+		return &types.EventIndex{SerialNumber: types.SerialNumber(deviceID), Index: c.index}, nil
+	})
+}
+
+func (s *Simulator) SetEventIndex(deviceID, index uint32) (*types.EventIndexResult, error) {
+	return get(s, deviceID, func(c *controller) (*types.EventIndexResult, error) {
+		changed := c.index != index
+		c.index = index
+
+		return &types.EventIndexResult{SerialNumber: types.SerialNumber(deviceID), Index: index, Changed: changed}, nil
+	})
+}
+
+// Delivers the controller events to the listener until the q channel is signalled, generating
+// a random card swipe or door event every Interval (if Interval is not zero) and executing the
+// controller task lists every minute. As with the UHPPOTE controllers, events are only
+// delivered for controllers with the listener address set to the simulator listen address.
+//
+// Events are recorded by the request handlers and door timers as well as the event generator
+// but are only ever delivered from this goroutine, because the listener (like the UDP event
+// listener) expects events one at a time.
+func (s *Simulator) Listen(listener uhppote.Listener, q chan os.Signal) error {
+	events := make(chan *types.Status, pendingEvents)
+
+	s.Lock()
+	s.events = events
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		s.events = nil
+		s.Unlock()
+	}()
+
+	listener.OnConnected()
+
+	var generate <-chan time.Time
+	if s.Interval > 0 {
+		ticker := time.NewTicker(s.Interval)
+		generate = ticker.C
+
+		defer ticker.Stop()
+	}
+
+	tasks := time.NewTicker(time.Minute)
+
+	defer tasks.Stop()
+
+	for {
+		select {
+		case status := <-events:
+			listener.OnEvent(status)
+
+		case <-generate:
+			s.generate()
+
+		case <-tasks.C:
+			s.schedule()
+
+		case <-q:
+			return nil
+		}
+	}
+}
+
+// Generates a card swipe (or, occasionally, a pushbutton) event on a random door of a random
+// controller. Most swipes use a card from the controller card list and are granted or denied
+// according to the card permissions, time profiles and door control state.
+func (s *Simulator) generate() {
+	s.Lock()
+
+	ids := []uint32{}
+	for id := range s.controllers {
+		ids = append(ids, id)
+	}
+
+	if len(ids) == 0 {
+		s.Unlock()
+		return
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	deviceID := ids[rand.IntN(len(ids))]
+	c := s.controllers[deviceID]
+	door := uint8(1 + rand.IntN(len(c.doors)))
+	direction := uint8(1 + rand.IntN(2))
+
+	var e types.Event
+	if rand.IntN(10) == 0 {
+		e = types.Event{Type: eventDoor, Granted: true, Door: door, Direction: direction, Reason: reasonPushButton}
+		c.doors[door].button = true
+		c.doors[door].unlocked = c.now().Add(time.Duration(c.doors[door].delay) * time.Second)
+	} else {
+		card := 10000000 + uint32(rand.IntN(90000000))
+		if len(c.cards) > 0 && rand.IntN(5) != 0 {
+			card = c.cards[rand.IntN(len(c.cards))].CardNumber
+		}
+
+		granted, reason := c.swipe(card, door)
+		e = types.Event{Type: eventSwipe, Granted: granted, Door: door, Direction: direction, CardNumber: card, Reason: reason}
+
+		if granted {
+			c.doors[door].unlocked = c.now().Add(time.Duration(c.doors[door].delay) * time.Second)
+		}
+	}
+
+	s.Unlock()
+
+	s.record(deviceID, e)
+
+	if e.Granted {
+		s.cycle(deviceID, door)
+	}
+}
+
+// Executes the controller door control tasks scheduled for the current minute.
+func (s *Simulator) schedule() {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, c := range s.controllers {
+		now := c.now()
+		today := types.ToDate(now.Year(), now.Month(), now.Day())
+		hhmm := types.HHmmFromTime(now)
+
+		for _, task := range c.tasks {
+			d, ok := c.doors[task.Door]
+			if !ok || !task.Weekdays[now.Weekday()] || today.Before(task.From) || today.After(task.To) || !task.Start.Equals(hhmm) {
+				continue
+			}
+
+			switch task.Task {
+			case types.DoorControlled:
+				d.mode = types.Controlled
+			case types.DoorNormallyOpen:
+				d.mode = types.NormallyOpen
+			case types.DoorNormallyClosed:
+				d.mode = types.NormallyClosed
+			case types.TriggerOnce:
+				d.unlocked = now.Add(time.Duration(d.delay) * time.Second)
+			}
+		}
+	}
+}
+
+// Opens and then closes a door that has been unlocked, recording the door opened and closed
+// events if special events are enabled.
+func (s *Simulator) cycle(deviceID uint32, door uint8) {
+	special := s.open(deviceID, door, true)
+	if special {
+		s.record(deviceID, types.Event{Type: eventDoor, Granted: true, Door: door, Direction: 1, Reason: reasonDoorOpened})
+	}
+
+	time.AfterFunc(opened, func() {
+		if s.open(deviceID, door, false) {
+			s.record(deviceID, types.Event{Type: eventDoor, Granted: true, Door: door, Direction: 1, Reason: reasonDoorClosed})
+		}
+	})
+}
+
+func (s *Simulator) open(deviceID uint32, door uint8, open bool) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if c, ok := s.controllers[deviceID]; ok {
+		if d, ok := c.doors[door]; ok {
+			d.open = open
+			d.button = d.button && open
+			return c.specialEvents
+		}
+	}
+
+	return false
+}
+
+// Adds an event to the controller event log and queues it for delivery to the listener.
+func (s *Simulator) record(deviceID uint32, e types.Event) {
+	s.Lock()
+
+	c, ok := s.controllers[deviceID]
+	if !ok {
+		s.Unlock()
+		return
+	}
+
+	e.SerialNumber = types.SerialNumber(deviceID)
+	e.Index = 1
+	e.Timestamp = types.DateTime(c.now())
+
+	if N := len(c.events); N > 0 {
+		e.Index = c.events[N-1].Index + 1
+	}
+
+	c.events = append(c.events, e)
+	if len(c.events) > maxEvents {
+		c.events = c.events[len(c.events)-maxEvents:]
+	}
+
+	c.sequence++
+
+	events := s.events
+	deliver := s.listen != nil && c.listener.String() == s.listen.String()
+
+	s.Unlock()
+
+	// NOTE: never blocks because events generated by Listen are queued on the same goroutine
+	//       that delivers them
+	if events != nil && deliver {
+		if status, err := s.GetStatus(deviceID); err == nil {
+			select {
+			case events <- status:
+			default:
+			}
+		}
+	}
+}
+
+// Returns whether a card swipe is granted and the event reason.
+func (c *controller) swipe(cardNumber uint32, door uint8) (bool, uint8) {
+	now := c.now()
+	today := types.ToDate(now.Year(), now.Month(), now.Day())
+
+	if d, ok := c.doors[door]; !ok {
+		return false, reasonNoAccess
+	} else if d.mode == types.NormallyClosed {
+		return false, reasonNormallyClosed
+	}
+
+	card, ok := c.card(cardNumber)
+	if !ok || card.From == nil || card.To == nil || today.Before(*card.From) || today.After(*card.To) {
+		return false, reasonNoAccess
+	}
+
+	switch profile := card.Doors[door]; {
+	case profile == 0:
+		return false, reasonNoAccess
+
+	case profile == 1:
+		return true, reasonSwipe
+
+	case c.permitted(profile, now):
+		return true, reasonSwipe
+
+	default:
+		return false, reasonTimePeriod
+	}
+}
+
+// Returns true if the time is within the time profile (or one of the linked time profiles).
+func (c *controller) permitted(profileID uint8, now time.Time) bool {
+	today := types.ToDate(now.Year(), now.Month(), now.Day())
+	hhmm := types.HHmmFromTime(now)
+	midnight := types.NewHHmm(0, 0)
+
+	for i, id := 0, profileID; i < len(c.profiles) && id != 0; i++ {
+		p, ok := c.profiles[id]
+		if !ok {
+			return false
+		}
+
+		if p.From != nil && p.To != nil && !today.Before(*p.From) && !today.After(*p.To) && p.Weekdays[now.Weekday()] {
+			for _, segment := range p.Segments {
+				if segment.Start.Equals(midnight) && segment.End.Equals(midnight) {
+					continue
+				}
+
+				if !hhmm.Before(segment.Start) && !hhmm.After(segment.End) {
+					return true
+				}
+			}
+		}
+
+		id = p.LinkedProfileID
+	}
+
+	return false
+}
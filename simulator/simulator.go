@@ -0,0 +1,329 @@
+package simulator
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uhppoted/uhppote-core/types"
+	"github.com/uhppoted/uhppote-core/uhppote"
+)
+
+// Simulator is an in-process uhppote.IUHPPOTE implementation that models the configured
+// controllers (doors, cards, time profiles, task lists and event logs) for running without
+// UHPPOTE hardware. Card swipe and door events are generated every Interval while the event
+// listener is running.
+type Simulator struct {
+	Interval time.Duration
+
+	controllers map[uint32]*controller
+	listen      *net.UDPAddr
+	events      chan *types.Status
+	sync.Mutex
+}
+
+type controller struct {
+	device        uhppote.Device
+	address       net.IP
+	mask          net.IP
+	gateway       net.IP
+	mac           types.MacAddress
+	listener      net.UDPAddr
+	offset        time.Duration
+	doors         map[uint8]*door
+	cards         []types.Card
+	profiles      map[uint8]types.TimeProfile
+	tasks         []types.Task
+	pending       []types.Task
+	events        []types.Event
+	index         uint32
+	sequence      uint32
+	specialEvents bool
+}
+
+type door struct {
+	mode     types.ControlState
+	delay    uint8
+	open     bool
+	button   bool
+	unlocked time.Time
+}
+
+// Simulated controller firmware version and release date.
+const version = types.Version(0x0892)
+
+var released = types.ToDate(2018, time.November, 5)
+
+// Maximum number of events in a controller event log, after which the oldest events are
+// discarded (i.e. the first event index increases).
+const maxEvents = 10000
+
+func NewSimulator(devices []uhppote.Device, listenAddr types.ListenAddr, interval time.Duration) *Simulator {
+	listen := net.UDPAddr(listenAddr)
+
+	s := Simulator{
+		Interval:    interval,
+		controllers: map[uint32]*controller{},
+		listen:      &listen,
+	}
+
+	for _, d := range devices {
+		c := controller{
+			device:   d,
+			address:  net.IPv4(192, 168, 1, byte(100+len(s.controllers))),
+			mask:     net.IPv4(255, 255, 255, 0),
+			gateway:  net.IPv4(192, 168, 1, 1),
+			mac:      types.MacAddress{0x00, 0x12, byte(d.DeviceID >> 24), byte(d.DeviceID >> 16), byte(d.DeviceID >> 8), byte(d.DeviceID)},
+			doors:    map[uint8]*door{},
+			cards:    []types.Card{},
+			profiles: map[uint8]types.TimeProfile{},
+			tasks:    []types.Task{},
+			events:   []types.Event{},
+		}
+
+		if d.Address != nil && d.Address.IP.To4() != nil && !d.Address.IP.IsUnspecified() {
+			c.address = d.Address.IP.To4()
+		}
+
+		c.listener = listen
+
+		for i := uint8(1); i <= 4; i++ {
+			c.doors[i] = &door{mode: types.Controlled, delay: 5}
+		}
+
+		s.controllers[d.DeviceID] = &c
+	}
+
+	return &s
+}
+
+func (s *Simulator) DeviceList() map[uint32]uhppote.Device {
+	list := map[uint32]uhppote.Device{}
+	for id, c := range s.controllers {
+		list[id] = c.device
+	}
+
+	return list
+}
+
+func (s *Simulator) ListenAddr() *net.UDPAddr {
+	return s.listen
+}
+
+func (s *Simulator) GetDevices() ([]types.Device, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	devices := []types.Device{}
+	for _, c := range s.controllers {
+		devices = append(devices, c.info())
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].SerialNumber < devices[j].SerialNumber })
+
+	return devices, nil
+}
+
+func (s *Simulator) GetDevice(deviceID uint32) (*types.Device, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	c, ok := s.controllers[deviceID]
+	if !ok {
+		return nil, nil
+	}
+
+	device := c.info()
+
+	return &device, nil
+}
+
+func (s *Simulator) SetAddress(deviceID uint32, address, mask, gateway net.IP) (*types.Result, error) {
+	return get(s, deviceID, func(c *controller) (*types.Result, error) {
+		c.address = address
+		c.mask = mask
+		c.gateway = gateway
+
+		return &types.Result{SerialNumber: types.SerialNumber(deviceID), Succeeded: true}, nil
+	})
+}
+
+func (s *Simulator) GetListener(deviceID uint32) (*types.Listener, error) {
+	return get(s, deviceID, func(c *controller) (*types.Listener, error) {
+		return &types.Listener{SerialNumber: types.SerialNumber(deviceID), Address: c.listener}, nil
+	})
+}
+
+func (s *Simulator) SetListener(deviceID uint32, address net.UDPAddr) (*types.Result, error) {
+	return get(s, deviceID, func(c *controller) (*types.Result, error) {
+		c.listener = address
+
+		return &types.Result{SerialNumber: types.SerialNumber(deviceID), Succeeded: true}, nil
+	})
+}
+
+func (s *Simulator) GetTime(deviceID uint32) (*types.Time, error) {
+	return get(s, deviceID, func(c *controller) (*types.Time, error) {
+		return &types.Time{SerialNumber: types.SerialNumber(deviceID), DateTime: types.DateTime(c.now())}, nil
+	})
+}
+
+func (s *Simulator) SetTime(deviceID uint32, datetime time.Time) (*types.Time, error) {
+	return get(s, deviceID, func(c *controller) (*types.Time, error) {
+		c.offset = time.Until(datetime).Truncate(time.Second)
+
+		return &types.Time{SerialNumber: types.SerialNumber(deviceID), DateTime: types.DateTime(c.now())}, nil
+	})
+}
+
+func (s *Simulator) GetDoorControlState(deviceID uint32, d byte) (*types.DoorControlState, error) {
+	return get(s, deviceID, func(c *controller) (*types.DoorControlState, error) {
+		dd, ok := c.doors[d]
+		if !ok {
+			return nil, fmt.Errorf("invalid door (%v)", d)
+		}
+
+		return &types.DoorControlState{
+			SerialNumber: types.SerialNumber(deviceID),
+			Door:         d,
+			ControlState: dd.mode,
+			Delay:        dd.delay,
+		}, nil
+	})
+}
+
+func (s *Simulator) SetDoorControlState(deviceID uint32, d uint8, state types.ControlState, delay uint8) (*types.DoorControlState, error) {
+	return get(s, deviceID, func(c *controller) (*types.DoorControlState, error) {
+		dd, ok := c.doors[d]
+		if !ok {
+			return nil, fmt.Errorf("invalid door (%v)", d)
+		} else if state < types.NormallyOpen || state > types.Controlled {
+			return nil, fmt.Errorf("invalid door control state (%v)", state)
+		}
+
+		dd.mode = state
+		dd.delay = delay
+
+		return &types.DoorControlState{
+			SerialNumber: types.SerialNumber(deviceID),
+			Door:         d,
+			ControlState: dd.mode,
+			Delay:        dd.delay,
+		}, nil
+	})
+}
+
+func (s *Simulator) RecordSpecialEvents(deviceID uint32, enable bool) (bool, error) {
+	return get(s, deviceID, func(c *controller) (bool, error) {
+		c.specialEvents = enable
+
+		return true, nil
+	})
+}
+
+func (s *Simulator) GetStatus(deviceID uint32) (*types.Status, error) {
+	return get(s, deviceID, func(c *controller) (*types.Status, error) {
+		now := c.now()
+		status := types.Status{
+			SerialNumber:   types.SerialNumber(deviceID),
+			DoorState:      map[uint8]bool{},
+			DoorButton:     map[uint8]bool{},
+			SystemDateTime: types.DateTime(now),
+			SequenceId:     c.sequence,
+		}
+
+		for i, d := range c.doors {
+			status.DoorState[i] = d.open
+			status.DoorButton[i] = d.button
+
+			if d.mode == types.NormallyOpen || (d.mode == types.Controlled && now.Before(d.unlocked)) {
+				status.RelayState |= 1 << (i - 1)
+			}
+		}
+
+		if N := len(c.events); N > 0 {
+			e := c.events[N-1]
+			status.Event = &types.StatusEvent{
+				Index:      e.Index,
+				Type:       e.Type,
+				Granted:    e.Granted,
+				Door:       e.Door,
+				Direction:  e.Direction,
+				CardNumber: e.CardNumber,
+				Timestamp:  &e.Timestamp,
+				Reason:     e.Reason,
+			}
+		}
+
+		return &status, nil
+	})
+}
+
+// Unlocks a door for the door delay, recording a 'remote open door' event and, if special
+// events are enabled, the door opened/closed events.
+func (s *Simulator) OpenDoor(deviceID uint32, d uint8) (*types.Result, error) {
+	result, err := get(s, deviceID, func(c *controller) (*types.Result, error) {
+		dd, ok := c.doors[d]
+		if !ok {
+			return nil, fmt.Errorf("invalid door (%v)", d)
+		}
+
+		dd.unlocked = c.now().Add(time.Duration(dd.delay) * time.Second)
+
+		return &types.Result{SerialNumber: types.SerialNumber(deviceID), Succeeded: true}, nil
+	})
+
+	if err == nil {
+		s.record(deviceID, types.Event{Type: eventDoor, Granted: true, Door: d, Direction: 1, Reason: reasonRemoteOpen})
+		s.cycle(deviceID, d)
+	}
+
+	return result, err
+}
+
+// Invokes a function on a controller, returning an error if the controller is not one of the
+// simulated controllers.
+func get[T any](s *Simulator, deviceID uint32, f func(c *controller) (T, error)) (T, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	c, ok := s.controllers[deviceID]
+	if !ok {
+		var zero T
+		return zero, fmt.Errorf("no reply from %v (not a simulated controller)", deviceID)
+	}
+
+	return f(c)
+}
+
+func (c *controller) info() types.Device {
+	port := 60000
+	if c.device.Address != nil && c.device.Address.Port != 0 {
+		port = c.device.Address.Port
+	}
+
+	return types.Device{
+		Name:         c.device.Name,
+		SerialNumber: types.SerialNumber(c.device.DeviceID),
+		IpAddress:    c.address,
+		SubnetMask:   c.mask,
+		Gateway:      c.gateway,
+		MacAddress:   c.mac,
+		Version:      version,
+		Date:         released,
+		Address:      net.UDPAddr{IP: c.address, Port: port},
+		TimeZone:     c.device.TimeZone,
+	}
+}
+
+// Returns the controller local time (seconds precision, as per the controller clock).
+func (c *controller) now() time.Time {
+	location := time.Local
+	if c.device.TimeZone != nil {
+		location = c.device.TimeZone
+	}
+
+	return time.Now().Add(c.offset).In(location).Truncate(time.Second)
+}
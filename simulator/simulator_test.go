@@ -0,0 +1,227 @@
+package simulator
+
+import (
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/uhppoted/uhppote-core/types"
+	"github.com/uhppoted/uhppote-core/uhppote"
+)
+
+func TestSimulatorCards(t *testing.T) {
+	var u uhppote.IUHPPOTE = simulator()
+
+	from := types.ToDate(2022, time.January, 1)
+	to := types.ToDate(2099, time.December, 31)
+
+	for _, card := range []uint32{8165538, 6154410, 8165537} {
+		if ok, err := u.PutCard(405419896, types.Card{CardNumber: card, From: &from, To: &to, Doors: map[uint8]uint8{1: 1}}); err != nil || !ok {
+			t.Fatalf("Error adding card %v (%v %v)", card, ok, err)
+		}
+	}
+
+	if N, err := u.GetCards(405419896); err != nil || N != 3 {
+		t.Errorf("Incorrect number of cards - expected:%v, got:%v (%v)", 3, N, err)
+	}
+
+	if card, err := u.GetCardByIndex(405419896, 2); err != nil || card == nil || card.CardNumber != 8165537 {
+		t.Errorf("Incorrect card at index 2 - expected:%v, got:%+v (%v)", 8165537, card, err)
+	}
+
+	if card, err := u.GetCardByID(405419896, 6154410); err != nil || card == nil || card.Doors[2] != 0 {
+		t.Errorf("Incorrect card 6154410 - got:%+v (%v)", card, err)
+	}
+
+	if ok, err := u.PutCard(405419896, types.Card{CardNumber: 8165538, From: &from, To: &to, Doors: map[uint8]uint8{1: 29}}); err == nil || ok {
+		t.Errorf("Expected error adding card with undefined time profile")
+	}
+
+	if ok, err := u.DeleteCard(405419896, 8165537); err != nil || !ok {
+		t.Errorf("Error deleting card 8165537 (%v %v)", ok, err)
+	}
+
+	if card, err := u.GetCardByID(405419896, 8165537); err != nil || card != nil {
+		t.Errorf("Expected nil card for deleted card 8165537, got %+v (%v)", card, err)
+	}
+
+	if _, err := u.GetCards(303986753); err == nil {
+		t.Errorf("Expected error for unknown controller")
+	}
+}
+
+func TestSimulatorSwipe(t *testing.T) {
+	s := simulator()
+
+	now := time.Now()
+	today := types.ToDate(now.Year(), now.Month(), now.Day())
+	expired := types.ToDate(2020, time.December, 31)
+	from := types.ToDate(2022, time.January, 1)
+	to := types.ToDate(2099, time.December, 31)
+
+	never := types.TimeProfile{
+		ID:       29,
+		From:     &today,
+		To:       &today,
+		Weekdays: types.Weekdays{},
+		Segments: types.Segments{},
+	}
+
+	s.SetTimeProfile(405419896, never)
+	s.PutCard(405419896, types.Card{CardNumber: 8165538, From: &from, To: &to, Doors: map[uint8]uint8{1: 1, 2: 29}})
+	s.PutCard(405419896, types.Card{CardNumber: 6154410, From: &from, To: &expired, Doors: map[uint8]uint8{1: 1}})
+	s.SetDoorControlState(405419896, 3, types.NormallyClosed, 5)
+
+	tests := []struct {
+		card    uint32
+		door    uint8
+		granted bool
+		reason  uint8
+	}{
+		{8165538, 1, true, reasonSwipe},
+		{8165538, 2, false, reasonTimePeriod},
+		{8165538, 3, false, reasonNormallyClosed},
+		{8165538, 4, false, reasonNoAccess},
+		{6154410, 1, false, reasonNoAccess},
+		{1234567, 1, false, reasonNoAccess},
+	}
+
+	c := s.controllers[405419896]
+	for _, v := range tests {
+		if granted, reason := c.swipe(v.card, v.door); granted != v.granted || reason != v.reason {
+			t.Errorf("card %v, door %v: incorrect access - expected:%v %v, got:%v %v", v.card, v.door, v.granted, v.reason, granted, reason)
+		}
+	}
+}
+
+func TestSimulatorEvents(t *testing.T) {
+	s := simulator()
+
+	if e, err := s.GetEvent(405419896, 0); err != nil || e != nil {
+		t.Errorf("Expected nil event for empty event log, got %+v (%v)", e, err)
+	}
+
+	for i := 0; i < maxEvents+5; i++ {
+		s.record(405419896, types.Event{Type: eventSwipe, Door: 1, CardNumber: 8165538, Reason: reasonNoAccess})
+	}
+
+	first, _ := s.GetEvent(405419896, 0)
+	last, _ := s.GetEvent(405419896, 0xffffffff)
+
+	if first == nil || first.Index != 6 {
+		t.Errorf("Incorrect first event - expected index:%v, got:%+v", 6, first)
+	}
+
+	if last == nil || last.Index != maxEvents+5 {
+		t.Errorf("Incorrect last event - expected index:%v, got:%+v", maxEvents+5, last)
+	}
+
+	if e, err := s.GetEvent(405419896, 17); err != nil || e == nil || e.Index != 17 || e.CardNumber != 8165538 {
+		t.Errorf("Incorrect event 17 - got:%+v (%v)", e, err)
+	}
+
+	if _, err := s.GetEvent(405419896, 5); err == nil {
+		t.Errorf("Expected 'overwritten' error for discarded event")
+	}
+
+	if e, err := s.GetEvent(405419896, maxEvents+6); err != nil || e != nil {
+		t.Errorf("Expected nil event after last event, got %+v (%v)", e, err)
+	}
+
+	if status, err := s.GetStatus(405419896); err != nil || status.Event == nil || status.Event.Index != maxEvents+5 {
+		t.Errorf("Incorrect status event - got:%+v (%v)", status, err)
+	}
+}
+
+func simulator() *Simulator {
+	devices := []uhppote.Device{
+		*uhppote.NewDevice("Alpha", 405419896, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 100), Port: 60000}, []string{}),
+	}
+
+	return NewSimulator(devices, types.ListenAddr(net.UDPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 60001}), 0)
+}
+
+// listener records the delivered events without any locking, so that the race detector reports
+// concurrent calls to OnEvent.
+type listener struct {
+	connected chan struct{}
+	delivered chan struct{}
+	active    atomic.Int32
+	events    []uint32
+	t         *testing.T
+}
+
+func (l *listener) OnConnected() {
+	close(l.connected)
+}
+
+func (l *listener) OnEvent(status *types.Status) {
+	if l.active.Add(1) > 1 {
+		l.t.Errorf("OnEvent called concurrently")
+	}
+
+	defer l.active.Add(-1)
+
+	time.Sleep(5 * time.Millisecond)
+
+	l.events = append(l.events, status.Event.Index)
+	l.delivered <- struct{}{}
+}
+
+func (l *listener) OnError(err error) bool {
+	return true
+}
+
+func TestSimulatorListenDeliversEventsSequentially(t *testing.T) {
+	s := simulator()
+	l := listener{
+		connected: make(chan struct{}),
+		delivered: make(chan struct{}, 16),
+		t:         t,
+	}
+
+	q := make(chan os.Signal)
+	done := make(chan struct{})
+
+	go func() {
+		s.Listen(&l, q)
+		close(done)
+	}()
+
+	<-l.connected
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.OpenDoor(405419896, uint8(1+i%4))
+		}()
+	}
+
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		select {
+		case <-l.delivered:
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for event %v", i+1)
+		}
+	}
+
+	q <- os.Interrupt
+	<-done
+
+	sort.Slice(l.events, func(i, j int) bool { return l.events[i] < l.events[j] })
+
+	for i, index := range l.events {
+		if index != uint32(i+1) {
+			t.Errorf("Incorrect delivered events - expected:1..10, got:%v", l.events)
+			break
+		}
+	}
+}